@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/penguinpowernz/mole/internal/util"
+	"github.com/penguinpowernz/mole/pkg/tunnel"
+)
+
+const connsUsage = `Usage: mole conns [-s socket]
+
+Show the connections going through the tunnels of the running client
+`
+
+const killUsage = `Usage: mole kill [-s socket] <id>...
+
+Close the connections with the given IDs
+`
+
+// runConnsCommand will print the connections of a running client
+func runConnsCommand(args []string) {
+	cf := util.NewControlFlags("conns", connsUsage, tunnel.DefaultControlSocket())
+	cf.Parse(args, 0)
+
+	res, err := tunnel.SendControlRequest(cf.Socket, "conns")
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	printTunnelStatus(res.Tunnels)
+}
+
+// runKillCommand will close connections in a running client
+func runKillCommand(args []string) {
+	cf := util.NewControlFlags("kill", killUsage, tunnel.DefaultControlSocket())
+	cf.Parse(args, 1)
+
+	res, err := tunnel.SendControlRequest(cf.Socket, "kill", cf.Args()...)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(res.Message)
+}
+
+func printTunnelStatus(tuns []tunnel.TunnelStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, st := range tuns {
+		fmt.Fprintf(w, "%s\n", st.Name)
+		fmt.Fprintf(w, "  accepted %d, active %d, queued %d, failed dials %d, rejected %d, sent %d bytes, received %d bytes\n",
+			st.Stats.Accepted, st.Stats.Active, st.Stats.Queued, st.Stats.FailedDials, st.Stats.Rejected, st.Stats.BytesSent, st.Stats.BytesReceived)
+
+		if st.LastDialError != "" {
+			fmt.Fprintf(w, "  last failed dial: %s\n", st.LastDialError)
+		}
+
+		if st.Stats.ClosedIdle > 0 || st.Stats.ClosedLifetime > 0 {
+			fmt.Fprintf(w, "  closed %d for being idle, %d at their max lifetime\n", st.Stats.ClosedIdle, st.Stats.ClosedLifetime)
+		}
+
+		if q := st.Quota; q != nil {
+			fmt.Fprintf(w, "  quota used %d of %s today, %d of %s this month\n", q.DailyUsed, quotaLimit(q.Daily), q.MonthlyUsed, quotaLimit(q.Monthly))
+		}
+
+		if len(st.Conns) == 0 {
+			continue
+		}
+
+		fmt.Fprintln(w, "  ID\tSOURCE\tDESTINATION\tDURATION\tSENT\tRECEIVED")
+		for _, c := range st.Conns {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%d\t%d\n", c.ID, c.Source, c.Destination,
+				time.Since(c.Started).Round(time.Second), c.BytesSent, c.BytesReceived)
+		}
+	}
+	w.Flush()
+}
+
+// quotaLimit will describe the number of bytes in a quota, which is unlimited if it is 0
+func quotaLimit(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/penguinpowernz/mole/internal/util"
+	"github.com/penguinpowernz/mole/pkg/tunnel"
+)
+
+// runEnrollCommand will enroll with a mole server using a token and save
+// the server to the config file
+func runEnrollCommand(args []string) {
+	var addr, token, keyfile, cfgFile string
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	fs.StringVar(&addr, "a", "", "the address of the server to enroll with")
+	fs.StringVar(&token, "t", "", "the enrollment token given by the server")
+	fs.StringVar(&keyfile, "i", "", "identity file (private key) to enroll, instead of the default key from the config")
+	fs.StringVar(&cfgFile, "c", "", "the config file to save the server to")
+	fs.Parse(args)
+
+	if addr == "" || token == "" {
+		fmt.Println("Usage: mole enroll -a host:port -t TOKEN [-i keyfile] [-c config]")
+		os.Exit(2)
+	}
+
+	if cfgFile == "" {
+		fn, found := util.FindConfig()
+		if !found {
+			fn = util.ConfigFiles[0]
+			log.Println("config file not found, generating one at", fn)
+			if err := tunnel.GenerateConfigIfNeeded(fn); err != nil {
+				panic(err)
+			}
+		}
+		cfgFile = fn
+	}
+
+	cfg, err := tunnel.LoadConfig(cfgFile)
+	if err != nil {
+		log.Fatal("Failed to load config from ", cfgFile, " - ", err)
+	}
+
+	key := cfg.KeyForAddress(addr)
+	if keyfile != "" {
+		key = privateKeyText(keyfile)
+	}
+
+	if key == "" {
+		log.Fatal("no private key to enroll with, specify one with -i")
+	}
+
+	cl, err := tunnel.Enroll(addr, token, key)
+	if err != nil {
+		log.Fatal("Failed to enroll with ", addr, " - ", err)
+	}
+
+	cfg.SetClient(cl)
+	if err := cfg.Save(); err != nil {
+		log.Fatal("Failed to save config to ", cfgFile, " - ", err)
+	}
+
+	fmt.Printf("Enrolled with %s, saved to %s with %d tunnel(s)\n", addr, cfgFile, len(cl.Tunnels))
+}
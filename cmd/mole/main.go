@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -18,8 +19,26 @@ import (
 )
 
 func main() {
-	var addr, remote, local, generateConfig, localTunnel, remoteTunnel, keyfile, cfgFile string
-	var reverse bool
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "enroll":
+			runEnrollCommand(os.Args[2:])
+			return
+		case "conns":
+			runConnsCommand(os.Args[2:])
+			return
+		case "kill":
+			runKillCommand(os.Args[2:])
+			return
+		case "ui":
+			runUICommand(os.Args[2:])
+			return
+		}
+	}
+
+	var addr, remote, local, generateConfig, localTunnel, remoteTunnel, keyfile, cfgFile, controlSocket, statusAddr string
+	var reverse, jsonStats bool
+	var drainTimeout time.Duration
 	flag.StringVar(&addr, "a", "", "the address to connect to")
 	flag.StringVar(&remote, "r", "", "the remote port")
 	flag.BoolVar(&reverse, "rr", false, "reverse port forward")
@@ -29,6 +48,10 @@ func main() {
 	flag.StringVar(&keyfile, "i", "", "identity file (private key) to use, or override config with")
 	flag.StringVar(&cfgFile, "c", "", "the config file to use")
 	flag.StringVar(&generateConfig, "g", "", "generate a new config file to the given location")
+	flag.StringVar(&controlSocket, "s", tunnel.DefaultControlSocket(), "the control socket to listen on for mole conns and mole kill")
+	flag.StringVar(&statusAddr, "status", "", "serve the status as JSON over HTTP on this address or unix socket path")
+	flag.BoolVar(&jsonStats, "json", false, "dump the status as JSON on USR1")
+	flag.DurationVar(&drainTimeout, "drain", 30*time.Second, "how long to wait for connections to finish when quitting")
 	flag.Parse()
 
 	if generateConfig != "" {
@@ -39,6 +62,11 @@ func main() {
 		local, remote = sshutil.ParsePortForwardDefinition(localTunnel)
 	}
 
+	if remoteTunnel != "" {
+		local, remote = sshutil.ParsePortForwardDefinition(remoteTunnel)
+		reverse = true
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -56,13 +84,34 @@ func main() {
 		if keyfile == "" {
 			keyfile = os.Getenv("HOME") + "/.ssh/id_rsa"
 		}
-		cfg = makeSingleTunnelConfig(addr, remote, local, keyfile)
+		cfg = makeSingleTunnelConfig(addr, remote, local, keyfile, reverse)
 	default:
 		cfg = loadConfig(cfgFile, keyfile)
 	}
 
+	if err := cfg.LoadQuotas(); err != nil {
+		log.Println("ERROR: failed to load the quotas:", err)
+	}
+	go cfg.SaveQuotasEvery(ctx, time.Minute, events)
+
+	drainer := tunnel.NewDrainer()
+	tctx := tunnel.WithDrainer(ctx, drainer)
 	for _, cl := range cfg.Clients {
-		go cl.OpenTunnels(ctx, events)
+		go cl.OpenTunnels(tctx, events)
+	}
+
+	go func() {
+		if err := cfg.ListenAndServeControl(ctx, controlSocket); err != nil {
+			log.Println("ERROR: control socket stopped:", err)
+		}
+	}()
+
+	if statusAddr != "" {
+		go func() {
+			if err := cfg.ListenAndServeStatus(ctx, statusAddr); err != nil {
+				log.Println("ERROR: status server stopped:", err)
+			}
+		}()
 	}
 
 	// USR1 will dump stats
@@ -71,6 +120,10 @@ func main() {
 	go func() {
 		for {
 			<-sigusr1
+			if jsonStats {
+				dumpJSONStats(cfg)
+				continue
+			}
 			dumpStats(cfg.Tunnels().Open())
 		}
 	}()
@@ -84,39 +137,69 @@ func main() {
 		syscall.SIGTERM,
 	)
 
+	log.Println("waiting for quit signal")
+	<-sigexit
+	cancel()
+
+	log.Printf("draining %d connections for up to %s, send the signal again to exit now", drainer.Active(), drainTimeout)
+	drainCtx, stop := context.WithTimeout(context.Background(), drainTimeout)
+	defer stop()
+
 	go func() {
 		<-sigexit
-		cancel()
+		log.Println("killing the remaining connections")
+		stop()
 	}()
 
-	log.Println("waiting for quit signal")
-	<-ctx.Done()
-	time.Sleep(time.Second / 2)
+	drained, killed := drainer.Drain(drainCtx)
+	if err := cfg.SaveQuotas(); err != nil {
+		log.Println("ERROR: failed to save the quotas:", err)
+	}
+	log.Printf("shutdown complete, %d connections drained, %d killed", drained, killed)
 }
 
 func dumpStats(tuns []*tunnel.Tunnel) {
+	sts := []tunnel.TunnelStatus{}
 	for _, tun := range tuns {
-		if tun.IsOpen {
-			fmt.Println(tun)
+		if tun.Opened() {
+			sts = append(sts, tun.Status())
 		}
 	}
+	printTunnelStatus(sts)
+}
+
+func dumpJSONStats(cfg *tunnel.Config) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(cfg.Status()); err != nil {
+		log.Println("ERROR: failed to encode the status:", err)
+	}
 }
 
-func makeSingleTunnelConfig(a, r, l, k string) *tunnel.Config {
+func makeSingleTunnelConfig(a, r, l, k string, reverse bool) *tunnel.Config {
 	data, err := ioutil.ReadFile(k)
 	if err != nil {
 		panic(err)
 	}
 	log.Printf("found keyfile at: %s", k)
 
+	opts := []tunnel.Option{tunnel.Local(l), tunnel.Remote(r)}
+	if reverse {
+		opts = append(opts, tunnel.Reverse())
+	}
+
+	tun, err := tunnel.NewTunnelFromOpts(opts...)
+	if err != nil {
+		panic(err)
+	}
+
 	return &tunnel.Config{
 		Clients: []*tunnel.Client{
 			{
 				Private: string(data),
 				Address: a,
-				Tunnels: []*tunnel.Tunnel{
-					{Local: l, Remote: r},
-				},
+				Tunnels: []*tunnel.Tunnel{tun},
 			},
 		},
 	}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+	"github.com/penguinpowernz/mole/pkg/sshutil"
+	"github.com/penguinpowernz/mole/pkg/tunnel"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const uiUsage = `Usage: mole ui [-c config] [-drain 30s]
+
+Show a dashboard of the clients and tunnels in the config, which can be
+enabled, disabled, added and saved back to the config while they run
+`
+
+const uiHelp = "up/down select  e enable/disable  r reconnect  a add tunnel  s save  q quit"
+
+// maxUILogs is how many log lines the dashboard keeps
+const maxUILogs = 500
+
+// the ANSI escape codes used to draw the dashboard
+const (
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearDown  = "\x1b[J"
+	ansiAltScreen  = "\x1b[?1049h"
+	ansiMainScreen = "\x1b[?1049l"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiReverse    = "\x1b[7m"
+	ansiBold       = "\x1b[1m"
+	ansiDim        = "\x1b[2m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+	ansiReset      = "\x1b[0m"
+)
+
+// dashboard is the state of the terminal UI
+type dashboard struct {
+	cfg    *tunnel.Config
+	ctx    context.Context
+	events event.Dispatcher
+
+	rows     []dashboardRow
+	selected int
+	adding   bool
+	input    string
+	message  string
+
+	logs []string
+
+	last   map[*tunnel.Tunnel]tunnel.TunnelStats
+	rates  map[*tunnel.Tunnel][2]float64
+	lastAt time.Time
+
+	mu *sync.Mutex
+}
+
+// dashboardRow is a client, or one of its tunnels, in the dashboard
+type dashboardRow struct {
+	client *tunnel.Client
+	tun    *tunnel.Tunnel
+}
+
+// runUICommand will run the tunnels in the config with a dashboard in the terminal
+func runUICommand(args []string) {
+	var cfgFile string
+	var drainTimeout time.Duration
+	fs := flag.NewFlagSet("ui", flag.ExitOnError)
+	fs.StringVar(&cfgFile, "c", "", "the config file to use")
+	fs.DurationVar(&drainTimeout, "drain", 30*time.Second, "how long to wait for connections to finish when quitting")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, uiUsage) }
+	fs.Parse(args)
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		fmt.Println("ERROR: mole ui needs to be run in a terminal")
+		os.Exit(1)
+	}
+
+	cfg := loadConfig(cfgFile, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	drainer := tunnel.NewDrainer()
+	d := &dashboard{
+		cfg:    cfg,
+		ctx:    tunnel.WithDrainer(ctx, drainer),
+		events: event.New(),
+		last:   map[*tunnel.Tunnel]tunnel.TunnelStats{},
+		rates:  map[*tunnel.Tunnel][2]float64{},
+		mu:     new(sync.Mutex),
+	}
+
+	// everything that would be logged goes to the log pane instead
+	log.SetFlags(0)
+	log.SetOutput(d)
+	d.events.On("log", func(msg string) error {
+		d.log(msg)
+		return nil
+	})
+	d.events.On("error", func(err error) error {
+		d.log("ERROR: " + err.Error())
+		return nil
+	})
+
+	if err := cfg.LoadQuotas(); err != nil {
+		d.log("ERROR: failed to load the quotas: " + err.Error())
+	}
+	go cfg.SaveQuotasEvery(ctx, time.Minute, d.events)
+
+	for _, cl := range cfg.Clients {
+		for _, tun := range cl.Tunnels {
+			if !tun.Disabled {
+				cl.OpenTunnel(d.ctx, tun, d.events)
+			}
+		}
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		fmt.Println("ERROR: failed to setup the terminal:", err)
+		os.Exit(1)
+	}
+
+	fmt.Print(ansiAltScreen + ansiHideCursor)
+	d.run()
+	fmt.Print(ansiShowCursor + ansiMainScreen)
+	terminal.Restore(fd, state)
+
+	log.SetFlags(log.LstdFlags)
+	log.SetOutput(os.Stderr)
+	cancel()
+
+	log.Printf("draining %d connections for up to %s", drainer.Active(), drainTimeout)
+	drainCtx, stop := context.WithTimeout(context.Background(), drainTimeout)
+	defer stop()
+
+	drained, killed := drainer.Drain(drainCtx)
+	if err := cfg.SaveQuotas(); err != nil {
+		log.Println("ERROR: failed to save the quotas:", err)
+	}
+	log.Printf("shutdown complete, %d connections drained, %d killed", drained, killed)
+}
+
+// run will draw the dashboard and handle the keys until it is told to quit
+func (d *dashboard) run() {
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		d.draw()
+
+		select {
+		case key, ok := <-keys:
+			if !ok || !d.handleKey(key) {
+				return
+			}
+		case <-sigs:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// handleKey will act on the key that was pressed, returning false to quit
+func (d *dashboard) handleKey(key string) bool {
+	if d.adding {
+		d.handlePromptKey(key)
+		return true
+	}
+
+	d.message = ""
+	switch key {
+	case "q", "\x03":
+		return false
+	case "\x1b[A", "k":
+		if d.selected > 0 {
+			d.selected--
+		}
+	case "\x1b[B", "j":
+		if d.selected < len(d.rows)-1 {
+			d.selected++
+		}
+	case "e", " ":
+		d.toggle()
+	case "r":
+		d.reconnect()
+	case "a":
+		if row, ok := d.selectedRow(); ok {
+			d.adding = true
+			d.input = ""
+			d.message = "add a tunnel to " + row.client.Address + " like L 8080:localhost:80 or R 0:localhost:3000: "
+		}
+	case "s":
+		d.save()
+	}
+
+	return true
+}
+
+// handlePromptKey will edit the tunnel being added
+func (d *dashboard) handlePromptKey(key string) {
+	switch key {
+	case "\x1b", "\x03":
+		d.adding = false
+		d.message = "cancelled"
+	case "\r", "\n":
+		d.adding = false
+		d.addTunnel(d.input)
+	case "\x7f", "\b":
+		if len(d.input) > 0 {
+			d.input = d.input[:len(d.input)-1]
+		}
+	default:
+		if !strings.HasPrefix(key, "\x1b") {
+			d.input += key
+		}
+	}
+}
+
+func (d *dashboard) selectedRow() (dashboardRow, bool) {
+	if d.selected < 0 || d.selected >= len(d.rows) {
+		return dashboardRow{}, false
+	}
+	return d.rows[d.selected], true
+}
+
+// toggle will enable or disable the selected tunnel
+func (d *dashboard) toggle() {
+	row, ok := d.selectedRow()
+	if !ok || row.tun == nil {
+		d.message = "select a tunnel to enable or disable it"
+		return
+	}
+
+	if row.tun.Disabled {
+		row.tun.Disabled = false
+		row.client.OpenTunnel(d.ctx, row.tun, d.events)
+		d.message = "enabled " + row.tun.Name()
+		return
+	}
+
+	row.tun.Disabled = true
+	row.tun.Close()
+	d.message = "disabled " + row.tun.Name()
+}
+
+// reconnect will reconnect the client of the selected row
+func (d *dashboard) reconnect() {
+	row, ok := d.selectedRow()
+	if !ok {
+		return
+	}
+
+	if err := row.client.Reconnect(); err != nil {
+		d.message = "failed to reconnect: " + err.Error()
+		return
+	}
+	d.message = "reconnecting to " + row.client.Address
+}
+
+// addTunnel will add a tunnel in the SSH format to the client of the selected
+// row and open it
+func (d *dashboard) addTunnel(input string) {
+	row, ok := d.selectedRow()
+	if !ok {
+		return
+	}
+
+	tun, err := parseTunnel(input)
+	if err != nil {
+		d.message = err.Error()
+		return
+	}
+
+	row.client.Tunnels = append(row.client.Tunnels, tun)
+	row.client.OpenTunnel(d.ctx, tun, d.events)
+	d.message = "added " + strings.TrimSpace(input) + ", press s to save it"
+}
+
+// parseTunnel will parse a tunnel in the SSH format, like L 8080:localhost:80
+func parseTunnel(input string) (*tunnel.Tunnel, error) {
+	input = strings.TrimSpace(input)
+	if len(input) < 2 {
+		return nil, errors.New("no tunnel given")
+	}
+
+	kind := strings.ToUpper(input[:1])
+	def := strings.TrimSpace(input[1:])
+	if (kind != "L" && kind != "R") || strings.Count(def, ":") < 1 || strings.Count(def, ":") > 3 {
+		return nil, errors.New("invalid tunnel, should be like L 8080:localhost:80 or R 0:localhost:3000")
+	}
+
+	// the ports are set directly instead of through the L and R keys of the
+	// config file, because L there has the remote port first unlike ssh -L
+	dest, listen := sshutil.ParsePortForwardDefinition(def)
+	opts := []tunnel.Option{tunnel.Local(listen), tunnel.Remote(dest)}
+	if kind == "R" {
+		opts = []tunnel.Option{tunnel.Local(dest), tunnel.Remote(listen), tunnel.Reverse()}
+	}
+
+	tun, err := tunnel.NewTunnelFromOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel: %s", err)
+	}
+
+	return tun, nil
+}
+
+// save will save the config file
+func (d *dashboard) save() {
+	if d.cfg.Filename == "" {
+		d.message = "there is no config file to save to"
+		return
+	}
+
+	if err := d.cfg.Save(); err != nil {
+		d.message = "failed to save the config: " + err.Error()
+		return
+	}
+	d.message = "saved to " + d.cfg.Filename
+}
+
+// Write will add the lines written by the log package to the log pane
+func (d *dashboard) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		d.log(line)
+	}
+	return len(b), nil
+}
+
+func (d *dashboard) log(msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.logs = append(d.logs, time.Now().Format("15:04:05")+" "+msg)
+	if len(d.logs) > maxUILogs {
+		d.logs = d.logs[len(d.logs)-maxUILogs:]
+	}
+}
+
+// updateRates will work out the throughput of each tunnel since it was last updated
+func (d *dashboard) updateRates() {
+	now := time.Now()
+	elapsed := now.Sub(d.lastAt).Seconds()
+	if elapsed < 0.5 {
+		return
+	}
+
+	for _, row := range d.rows {
+		if row.tun == nil {
+			continue
+		}
+
+		st := row.tun.Stats()
+		if last, found := d.last[row.tun]; found {
+			d.rates[row.tun] = [2]float64{
+				float64(st.BytesSent-last.BytesSent) / elapsed,
+				float64(st.BytesReceived-last.BytesReceived) / elapsed,
+			}
+		}
+		d.last[row.tun] = st
+	}
+
+	d.lastAt = now
+}
+
+// draw will draw the dashboard to fit the terminal
+func (d *dashboard) draw() {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 40 || height < 12 {
+		width, height = 80, 24
+	}
+
+	d.rows = d.rows[:0]
+	for _, cl := range d.cfg.Clients {
+		if cl.Address == "*" {
+			continue
+		}
+		d.rows = append(d.rows, dashboardRow{client: cl})
+		for _, tun := range cl.Tunnels {
+			d.rows = append(d.rows, dashboardRow{client: cl, tun: tun})
+		}
+	}
+	if d.selected >= len(d.rows) {
+		d.selected = len(d.rows) - 1
+	}
+	d.updateRates()
+
+	labelWidth := width - 50
+	if labelWidth < 20 {
+		labelWidth = 20
+	}
+
+	lines := []string{
+		ansiBold + fit("mole ui  "+d.cfg.Filename, width) + ansiReset,
+		ansiDim + fmt.Sprintf("%-*s %-14s %5s %8s %9s %9s", labelWidth, "SERVER / TUNNEL", "STATE", "CONNS", "ACCEPTED", "SENT/s", "RECV/s") + ansiReset,
+	}
+
+	// keep the selected row in view, leaving room for the logs
+	tableHeight := height - len(lines) - 9
+	first := 0
+	if d.selected >= tableHeight {
+		first = d.selected - tableHeight + 1
+	}
+
+	for i := first; i < len(d.rows) && i < first+tableHeight; i++ {
+		line := d.drawRow(d.rows[i], labelWidth)
+		if i == d.selected {
+			line = ansiReverse + line + ansiReset
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, "")
+	if d.adding {
+		lines = append(lines, ansiYellow+fit(d.message+d.input, width-1)+ansiReset+ansiReverse+" "+ansiReset)
+	} else {
+		lines = append(lines, ansiYellow+fit(d.message, width)+ansiReset)
+	}
+	lines = append(lines, ansiDim+strings.Repeat("-", width)+ansiReset)
+
+	d.mu.Lock()
+	logs := d.logs
+	if n := height - len(lines) - 1; len(logs) > n && n > 0 {
+		logs = logs[len(logs)-n:]
+	}
+	for _, l := range logs {
+		lines = append(lines, fit(l, width))
+	}
+	d.mu.Unlock()
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, ansiDim+fit(uiHelp, width)+ansiReset)
+
+	fmt.Print(ansiHome + strings.Join(lines, ansiClearLine+"\r\n") + ansiClearDown)
+}
+
+// drawRow will draw the row for a client or tunnel
+func (d *dashboard) drawRow(row dashboardRow, labelWidth int) string {
+	if row.tun == nil {
+		st := row.client.Status()
+		state, color := "disconnected", ansiRed
+		if st.Connected {
+			state, color = fmt.Sprintf("connected %.0fms", st.RTTMS), ansiGreen
+		}
+
+		label := row.client.Address
+		if st.Server != "" && st.Server != label {
+			label += " via " + st.Server
+		}
+
+		line := fmt.Sprintf("%-*s ", labelWidth, fit(label, labelWidth))
+		line += color + fmt.Sprintf("%-14s", state) + ansiReset
+		if !st.Connected && st.LastError != "" {
+			line += " " + ansiDim + st.LastError + ansiReset
+		}
+		return line
+	}
+
+	st := row.tun.Status()
+	label := fmt.Sprintf("  L %s --> %s", st.Local, st.Remote)
+	if st.Direction == "reverse" {
+		label = fmt.Sprintf("  R %s <-- %s", st.Local, st.Remote)
+	}
+
+	state, color := "closed", ansiRed
+	switch {
+	case st.Disabled:
+		state, color = "disabled", ansiDim
+	case st.Quota != nil && st.Quota.Exceeded:
+		state, color = "quota used", ansiYellow
+	case st.Open:
+		state, color = "open", ansiGreen
+	}
+
+	if st.Health != nil && st.Health.LastCheck != nil && !st.Health.Healthy && !st.Disabled {
+		state, color = state+" unhealthy", ansiYellow
+	}
+
+	rate := d.rates[row.tun]
+	return fmt.Sprintf("%-*s ", labelWidth, fit(label, labelWidth)) +
+		color + fmt.Sprintf("%-14s", state) + ansiReset +
+		fmt.Sprintf(" %5d %8d %9s %9s", st.Stats.Active, st.Stats.Accepted, humanBytes(rate[0]), humanBytes(rate[1]))
+}
+
+// fit will cut the string down to the given width
+func fit(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	if width < 1 {
+		return ""
+	}
+	return s[:width-1] + "~"
+}
+
+// humanBytes will format a number of bytes with a unit
+func humanBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
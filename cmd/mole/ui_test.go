@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/penguinpowernz/mole/pkg/tunnel"
+)
+
+func TestParseTunnel(t *testing.T) {
+	tun, err := parseTunnel("l 8080:localhost:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tun.Local != "127.0.0.1:8080" || tun.Remote != "localhost:80" || tun.Reverse {
+		t.Errorf("expected a local tunnel from 8080 to 80 but got %s -> %s", tun.Local, tun.Remote)
+	}
+
+	tun, err = parseTunnel(" R 0:localhost:3000 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tun.Reverse || tun.Remote != "127.0.0.1:0" || tun.Local != "localhost:3000" {
+		t.Errorf("expected a reverse tunnel from 0 to 3000 but got %s -> %s", tun.Remote, tun.Local)
+	}
+
+	// it should be read back the same once it is saved to the config file
+	data, err := json.Marshal(tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := new(tunnel.Tunnel)
+	if err := json.Unmarshal(data, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.Local != tun.Local || saved.Remote != tun.Remote || saved.Reverse != tun.Reverse {
+		t.Errorf("expected the saved tunnel to be %s -> %s but got %s -> %s", tun.Remote, tun.Local, saved.Remote, saved.Local)
+	}
+
+	for _, input := range []string{"", "L", "X 8080:localhost:80", "L 8080", "L 1:2:3:4:5"} {
+		if _, err := parseTunnel(input); err == nil {
+			t.Errorf("expected %q to be invalid", input)
+		}
+	}
+}
+
+func TestDashboardAddTunnelInvalid(t *testing.T) {
+	cl := &tunnel.Client{Address: "localhost:1"}
+	d := &dashboard{
+		cfg:  &tunnel.Config{Clients: []*tunnel.Client{cl}},
+		rows: []dashboardRow{{client: cl}},
+		mu:   new(sync.Mutex),
+	}
+
+	d.addTunnel("L 8080")
+	if len(cl.Tunnels) != 0 || d.message == "" {
+		t.Errorf("expected the invalid tunnel to not be added but got: %s", d.message)
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"short", 10, "short"},
+		{"exact", 5, "exact"},
+		{"too long", 5, "too ~"},
+		{"anything", 0, ""},
+	}
+
+	for _, tt := range tests {
+		if got := fit(tt.s, tt.width); got != tt.want {
+			t.Errorf("expected fit(%q, %d) to be %q but got %q", tt.s, tt.width, tt.want, got)
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n    float64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KB"},
+		{1536, "1.5KB"},
+		{5 * 1024 * 1024, "5.0MB"},
+		{3 * 1024 * 1024 * 1024 * 1024 * 1024, "3072.0TB"},
+	}
+
+	for _, tt := range tests {
+		if got := humanBytes(tt.n); got != tt.want {
+			t.Errorf("expected humanBytes(%.0f) to be %q but got %q", tt.n, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/penguinpowernz/mole/internal/util"
+	"github.com/penguinpowernz/mole/pkg/tunnel/server"
+)
+
+// parseControlFlags will parse the flags for commands that talk to a running
+// server over the control socket, exiting with the usage if there are less
+// than the minimum number of arguments.  It returns the parsed flags and the
+// control socket to use
+func parseControlFlags(name, usage string, args []string, minArgs int) (*flag.FlagSet, string) {
+	cf := util.NewControlFlags(name, usage, "")
+	cfgFile := cf.String("c", "", "the config file to find the control socket in")
+	cf.Parse(args, minArgs)
+
+	if cf.Socket == "" {
+		cf.Socket = controlSocketFromConfig(*cfgFile)
+	}
+
+	return cf.FlagSet, cf.Socket
+}
+
+func controlSocketFromConfig(cfgFile string) string {
+	if cfgFile == "" {
+		fn, found := util.FindConfig()
+		if !found {
+			return server.DefaultControlSocket
+		}
+		cfgFile = fn
+	}
+
+	cfg, err := server.LoadConfig(cfgFile)
+	if err != nil {
+		return server.DefaultControlSocket
+	}
+
+	return cfg.ControlSocketFilename()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/penguinpowernz/mole/pkg/tunnel/server"
+)
+
+const keysUsage = `Usage: moled keys [-c config] [-s socket] <command> [args]
+
+Commands:
+  list                      list the authorized keys
+  pending                   list the keys waiting for approval
+  approve <fingerprint>...  authorize the pending keys
+  deny <fingerprint>...     deny the pending keys
+  revoke <fingerprint>...   remove the authorized keys
+  add <public key|file>     authorize the given public key
+`
+
+// runKeysCommand will manage the keys of a running server over its control socket
+func runKeysCommand(args []string) {
+	fs, socket := parseControlFlags("keys", keysUsage, args, 1)
+
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	if cmd == "add" && len(cmdArgs) == 1 && fileExists(cmdArgs[0]) {
+		data, err := ioutil.ReadFile(cmdArgs[0])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		cmdArgs = []string{strings.TrimSpace(string(data))}
+	}
+
+	res, err := server.SendControlRequest(socket, cmd, cmdArgs...)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	switch cmd {
+	case "list":
+		printKeys(res.Keys)
+	case "pending":
+		printPendingKeys(res.Pending)
+	default:
+		fmt.Println(res.Message)
+	}
+}
+
+func printKeys(keys []server.KeyInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FINGERPRINT\tTYPE\tCOMMENT")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", k.Fingerprint, k.Type, k.Comment)
+	}
+	w.Flush()
+}
+
+func printPendingKeys(keys []*server.PendingKey) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FINGERPRINT\tTYPE\tUSER\tADDRESS\tFIRST SEEN\tATTEMPTS")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", k.Fingerprint, k.Type, k.User, k.Address, k.FirstSeen.Format(time.RFC3339), k.Attempts)
+	}
+	w.Flush()
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/AlexanderGrom/go-event"
-	"github.com/penguinpowernz/mole/internal/app"
 	"github.com/penguinpowernz/mole/internal/util"
 	"github.com/penguinpowernz/mole/pkg/tunnel/server"
 )
@@ -20,55 +19,75 @@ import (
 var svr *server.Server
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keys":
+			runKeysCommand(os.Args[2:])
+			return
+		case "token":
+			runTokenCommand(os.Args[2:])
+			return
+		case "status":
+			runStatusCommand(os.Args[2:])
+			return
+		case "unban":
+			runUnbanCommand(os.Args[2:])
+			return
+		}
+	}
+
 	var cfgFile, generateConfig, port string
-	var interactiveAccept, interactiveUDS bool
+	var interactiveAccept bool
 	flag.StringVar(&generateConfig, "g", "", "generate a new config file to the given location")
 	flag.StringVar(&cfgFile, "c", "", "the config file to use")
 	flag.StringVar(&port, "p", "", "the port to serve the server on")
 	flag.BoolVar(&interactiveAccept, "i", false, "interactively accept public keys (useful for setting up)")
-	flag.BoolVar(&interactiveUDS, "I", false, "don't run the server, just listen for public key requests")
 	flag.Parse()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if !interactiveUDS {
-		if generateConfig != "" {
-			tryToGenerateConfig(generateConfig)
-		}
+	if generateConfig != "" {
+		tryToGenerateConfig(generateConfig)
+	}
 
-		cfg := loadConfig(cfgFile)
+	cfg := loadConfig(cfgFile)
 
-		if port = normalizePort(port); port != "" {
-			cfg.ListenPort = port
-		}
+	if port = normalizePort(port); port != "" {
+		cfg.ListenPort = port
+	}
 
-		if !cfg.RunServer {
-			log.Fatal("configured to not run server, nothing to do...")
-		}
+	if !cfg.RunServer {
+		log.Fatal("configured to not run server, nothing to do...")
+	}
 
-		events := event.New()
-		logEvents(events)
+	events := event.New()
+	logEvents(events)
 
-		svr := server.NewServer(cfg, events)
-		go runServer(ctx, cfg, svr)
+	svr := server.NewServer(cfg, events)
+	go runServer(ctx, cfg, svr)
 
-		if interactiveAccept {
-			server.InteractivelyAcceptPublicKeys(svr, cfg)
-			return
+	go func() {
+		if err := svr.ListenAndServeControl(ctx); err != nil {
+			log.Println("ERROR: control socket stopped:", err)
 		}
-	}
-	if interactiveUDS {
-		// run the interactive public key authorizer, listen for requests
-		// from an already running moled process
-		go func() {
-			err := app.UDSAuthServer(ctx)
-			if err != nil {
-				log.Println(err)
-				cancel()
-			}
-		}()
+	}()
+
+	go func() {
+		if err := svr.ListenAndServeHTTP(ctx); err != nil {
+			log.Println("ERROR: HTTP front stopped:", err)
+		}
+	}()
+
+	go func() {
+		if err := svr.ListenAndServeSNI(ctx); err != nil {
+			log.Println("ERROR: TLS front stopped:", err)
+		}
+	}()
 
+	if interactiveAccept {
+		server.InteractivelyAcceptPublicKeys(svr, cfg)
+		return
 	}
 
 	sigc := make(chan os.Signal, 1)
@@ -79,12 +98,27 @@ func main() {
 		syscall.SIGTERM,
 	)
 
+	<-sigc
+	cancel()
+
+	drainTimeout, err := cfg.DrainTimeoutDuration()
+	if err != nil {
+		log.Println("ERROR: invalid drain_timeout:", err)
+		drainTimeout = server.DefaultDrainTimeout
+	}
+
+	log.Printf("draining connections for up to %s, send the signal again to exit now", drainTimeout)
+	drainCtx, stop := context.WithTimeout(context.Background(), drainTimeout)
+	defer stop()
+
 	go func() {
 		<-sigc
-		cancel()
+		log.Println("killing the remaining connections")
+		stop()
 	}()
 
-	<-ctx.Done()
+	drained, killed := svr.Drain(drainCtx)
+	log.Printf("shutdown complete, %d connections drained, %d killed", drained, killed)
 }
 
 func runServer(ctx context.Context, cfg *server.Config, svr *server.Server) {
@@ -94,7 +128,7 @@ func runServer(ctx context.Context, cfg *server.Config, svr *server.Server) {
 		log.Println("server stopped")
 
 		// don't loop if the ctx was done
-		if ctx.Err() == nil {
+		if ctx.Err() != nil {
 			return
 		}
 
@@ -169,4 +203,8 @@ func logEvents(events event.Dispatcher) {
 		log.Println(msg)
 		return nil
 	})
+	events.On("audit", func(ev server.AuditEvent) error {
+		log.Println(ev)
+		return nil
+	})
 }
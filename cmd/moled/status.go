@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/penguinpowernz/mole/pkg/tunnel/server"
+)
+
+const statusUsage = `Usage: moled status [-c config] [-s socket]
+
+Show the connections, rejections and bans of the running server
+`
+
+const unbanUsage = `Usage: moled unban [-c config] [-s socket] <ip>...
+
+Remove the bans on the given IPs
+`
+
+// runStatusCommand will print the status of a running server
+func runStatusCommand(args []string) {
+	_, socket := parseControlFlags("status", statusUsage, args, 0)
+
+	res, err := server.SendControlRequest(socket, "status")
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	printLimitStatus(res.Limits)
+}
+
+// runUnbanCommand will remove bans from a running server
+func runUnbanCommand(args []string) {
+	fs, socket := parseControlFlags("unban", unbanUsage, args, 1)
+
+	res, err := server.SendControlRequest(socket, "unban", fs.Args()...)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(res.Message)
+}
+
+func printLimitStatus(st *server.LimitStatus) {
+	if st == nil {
+		return
+	}
+
+	fmt.Println("Connections:", st.Connections)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, ip := range sortedKeys(st.ConnectionsPerIP) {
+		fmt.Fprintf(w, "  %s\t%d\n", ip, st.ConnectionsPerIP[ip])
+	}
+	w.Flush()
+
+	fmt.Println("\nRejections:")
+	for _, r := range sortedKeys(st.Rejections) {
+		fmt.Fprintf(w, "  %s\t%d\n", r, st.Rejections[r])
+	}
+	w.Flush()
+
+	fmt.Println("\nBans:")
+	fmt.Fprintln(w, "  IP\tUNTIL\tCOUNT\tREASON")
+	for _, ban := range st.Bans {
+		fmt.Fprintf(w, "  %s\t%s\t%d\t%s\n", ban.IP, ban.Until.Format(time.RFC3339), ban.Count, ban.Reason)
+	}
+	w.Flush()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/penguinpowernz/mole/pkg/tunnel/server"
+)
+
+const tokenUsage = `Usage: moled token [-c config] [-s socket] <command> [args]
+
+Commands:
+  create [-uses n] [-ttl duration] [-note text] [-L def]... [-R def]...
+                        create a new enrollment token
+  list                  list the enrollment tokens that can still be used
+  revoke <id>...        revoke the enrollment tokens
+`
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (sl *stringList) String() string     { return strings.Join(*sl, ",") }
+func (sl *stringList) Set(v string) error { *sl = append(*sl, v); return nil }
+
+// runTokenCommand will manage the enrollment tokens of a running server over its control socket
+func runTokenCommand(args []string) {
+	fs, socket := parseControlFlags("token", tokenUsage, args, 1)
+
+	req := server.ControlRequest{Command: "token-" + fs.Arg(0), Args: fs.Args()[1:]}
+	if fs.Arg(0) == "create" {
+		req.Token = parseTokenOptions(req.Args)
+		req.Args = nil
+	}
+
+	res, err := server.SendControl(socket, req)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	switch fs.Arg(0) {
+	case "create":
+		fmt.Println(res.Token)
+	case "list":
+		printTokens(res.Tokens)
+	default:
+		fmt.Println(res.Message)
+	}
+}
+
+func parseTokenOptions(args []string) *server.TokenOptions {
+	var locals, remotes stringList
+	opts := &server.TokenOptions{}
+	fs := flag.NewFlagSet("token create", flag.ExitOnError)
+	fs.IntVar(&opts.MaxUses, "uses", 1, "how many times the token can be used")
+	fs.DurationVar(&opts.TTL, "ttl", 24*time.Hour, "how long until the token expires")
+	fs.StringVar(&opts.Note, "note", "", "a note to remember the token by")
+	fs.Var(&locals, "L", "local port forward in SSH format to add to the enrolled clients config")
+	fs.Var(&remotes, "R", "remote port forward in SSH format to add to the enrolled clients config")
+	fs.Parse(args)
+
+	for _, def := range locals {
+		opts.Tunnels = append(opts.Tunnels, server.TokenTunnel{L: def})
+	}
+	for _, def := range remotes {
+		opts.Tunnels = append(opts.Tunnels, server.TokenTunnel{R: def})
+	}
+
+	return opts
+}
+
+func printTokens(tokens []*server.EnrollToken) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSES\tEXPIRES\tTUNNELS\tNOTE")
+	for _, tok := range tokens {
+		expires := "never"
+		if !tok.Expires.IsZero() {
+			expires = tok.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d/%d\t%s\t%d\t%s\n", tok.ID, tok.Uses, tok.MaxUses, expires, len(tok.Tunnels), tok.Note)
+	}
+	w.Flush()
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// ListenUnix will listen on a unix socket at the given path that only the
+// current user can access.  The socket is made in a private directory and moved
+// into place once it is locked down, so nobody else can connect to it before that
+func ListenUnix(fn string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(fn), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	os.Remove(fn)
+	if err := os.Rename(tmp, fn); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// ServeControl will listen on the control socket until the context is done,
+// passing the line of JSON sent on each connection to the handler and replying
+// with what it returns as JSON.  The socket is only accessible by the current user
+func ServeControl(ctx context.Context, fn string, handle func([]byte) interface{}) error {
+	ln, err := ListenUnix(fn)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fn)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go handleControlConn(conn, handle)
+	}
+}
+
+func handleControlConn(conn net.Conn, handle func([]byte) interface{}) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(handle(line))
+	if err != nil {
+		return
+	}
+	conn.Write(append(data, '\n'))
+}
+
+// SendControl will send the request as JSON to the process listening on the
+// control socket and decode its reply into the response
+func SendControl(socket string, req, res interface{}) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(conn).Decode(res)
+}
+
+// ControlFlags are the flags of the commands that talk to a running mole or
+// moled over its control socket
+type ControlFlags struct {
+	*flag.FlagSet
+	Socket string
+}
+
+// NewControlFlags will create the flags for the command with the given usage,
+// with -s to give the control socket instead of the default one
+func NewControlFlags(name, usage, socket string) *ControlFlags {
+	cf := &ControlFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	cf.StringVar(&cf.Socket, "s", socket, "the control socket to send the command to")
+	cf.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	return cf
+}
+
+// Parse will parse the flags, exiting with the usage if there are less than
+// the minimum number of arguments
+func (cf *ControlFlags) Parse(args []string, minArgs int) {
+	cf.FlagSet.Parse(args)
+
+	if cf.NArg() < minArgs {
+		cf.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,155 @@
+// Package proxyproto writes the headers of the PROXY protocol, which pass the
+// address of the original client on to a service behind a proxy or tunnel
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// the versions of the PROXY protocol
+const (
+	V1 = "v1"
+	V2 = "v2"
+)
+
+// TypeFingerprint is the v2 TLV type that carries the fingerprint of the SSH
+// key that was used to authenticate, which is in the range for custom types
+const TypeFingerprint = 0xE0
+
+// v2Signature starts every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// TLV is an extra type-length-value field in a version 2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a PROXY protocol header for a TCP connection from the source to the
+// destination.  If the source isn't a TCP address the header says that the
+// addresses are unknown, and if the destination isn't one it is left as 0.0.0.0:0
+type Header struct {
+	Version     string
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// Validate will return an error if the version is not known
+func Validate(version string) error {
+	switch version {
+	case V1, V2:
+		return nil
+	}
+	return fmt.Errorf("unknown PROXY protocol version: %s", version)
+}
+
+// addrs will return the IPs and ports of the addresses, as IPv6 if they are
+// not both IPv4, or false if the source isn't a TCP address
+func (h Header) addrs() (src, dst net.IP, sport, dport int, v4, ok bool) {
+	s, sok := h.Source.(*net.TCPAddr)
+	if !sok || s.IP == nil {
+		return
+	}
+
+	d, dok := h.Destination.(*net.TCPAddr)
+	if !dok || d.IP == nil {
+		d = &net.TCPAddr{IP: net.IPv4zero}
+		if s.IP.To4() == nil {
+			d.IP = net.IPv6unspecified
+		}
+	}
+
+	src, dst, v4 = s.IP.To4(), d.IP.To4(), true
+	if src == nil || dst == nil {
+		src, dst, v4 = s.IP.To16(), d.IP.To16(), false
+	}
+	return src, dst, s.Port, d.Port, v4, true
+}
+
+// Bytes will encode the header
+func (h Header) Bytes() ([]byte, error) {
+	switch h.Version {
+	case V1:
+		return h.v1(), nil
+	case V2:
+		return h.v2()
+	}
+	return nil, Validate(h.Version)
+}
+
+func (h Header) v1() []byte {
+	src, dst, sport, dport, v4, ok := h.addrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP4"
+	if !v4 {
+		proto = "TCP6"
+	}
+
+	return []byte("PROXY " + proto + " " + v1Addr(src, v4) + " " + v1Addr(dst, v4) + " " + strconv.Itoa(sport) + " " + strconv.Itoa(dport) + "\r\n")
+}
+
+// v1Addr will format the IP, writing IPv4 addresses in IPv6 headers as IPv6
+// as Go would write them as IPv4
+func v1Addr(ip net.IP, v4 bool) string {
+	if ip4 := ip.To4(); !v4 && ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h Header) v2() ([]byte, error) {
+	body := new(bytes.Buffer)
+
+	// the addresses are left out and the family is unspecified when unknown
+	family := byte(0x00)
+	if src, dst, sport, dport, v4, ok := h.addrs(); ok {
+		family = 0x21
+		if v4 {
+			family = 0x11
+		}
+		body.Write(src)
+		body.Write(dst)
+		binary.Write(body, binary.BigEndian, uint16(sport))
+		binary.Write(body, binary.BigEndian, uint16(dport))
+	}
+
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xffff {
+			return nil, fmt.Errorf("TLV %#x is too long", tlv.Type)
+		}
+		body.WriteByte(tlv.Type)
+		binary.Write(body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+
+	if body.Len() > 0xffff {
+		return nil, fmt.Errorf("header is too long")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(v2Signature)
+	buf.WriteByte(0x21) // version 2, PROXY command
+	buf.WriteByte(family)
+	binary.Write(buf, binary.BigEndian, uint16(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// Write will write the header to the given writer
+func (h Header) Write(w io.Writer) error {
+	b, err := h.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,72 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestV1(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+		expected string
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234},
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+			"PROXY TCP4 203.0.113.7 127.0.0.1 51234 8080\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+			"PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 51234 8080\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234},
+			&net.UnixAddr{Name: "/tmp/x.sock", Net: "unix"},
+			"PROXY TCP4 203.0.113.7 0.0.0.0 51234 0\r\n",
+		},
+		{
+			&net.UnixAddr{Name: "/tmp/x.sock", Net: "unix"},
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+			"PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, tc := range tests {
+		b, err := Header{Version: V1, Source: tc.src, Destination: tc.dst}.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.expected {
+			t.Errorf("expected %q but got %q", tc.expected, b)
+		}
+	}
+}
+
+func TestV2(t *testing.T) {
+	h := Header{
+		Version:     V2,
+		Source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 0x1234},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+		TLVs:        []TLV{{Type: TypeFingerprint, Value: []byte("SHA256:abc")}},
+	}
+
+	b, err := h.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0x00, 12+3+10)
+	expected = append(expected, 203, 0, 113, 7, 10, 0, 0, 1, 0x12, 0x34, 0x00, 80)
+	expected = append(expected, TypeFingerprint, 0x00, 10)
+	expected = append(expected, "SHA256:abc"...)
+
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected %x but got %x", expected, b)
+	}
+
+	if _, err := (Header{Version: "v3"}).Bytes(); err == nil {
+		t.Error("expected an unknown version to fail")
+	}
+}
@@ -0,0 +1,24 @@
+package sshutil
+
+import "encoding/json"
+
+// EnrollChannelType is the SSH channel type a client opens after authenticating
+// with an enrollment token, in order to have its public key authorized
+const EnrollChannelType = "enroll@mole"
+
+// EnrollQuestion is the keyboard-interactive question the server asks to get
+// the enrollment token from the client
+const EnrollQuestion = "Enrollment token: "
+
+// EnrollRequest is sent as the extra data when opening the enrollment channel
+type EnrollRequest struct {
+	PublicKey string
+}
+
+// EnrollResponse is written back to the client over the enrollment channel
+// once its public key has been authorized
+type EnrollResponse struct {
+	Fingerprint string          `json:"fingerprint"`
+	HostKey     string          `json:"host_key"`
+	Config      json.RawMessage `json:"config,omitempty"`
+}
@@ -0,0 +1,10 @@
+package sshutil
+
+// NoticeRequestType is the global request the server sends to tell the client
+// something about its session, like that it is about to be disconnected
+const NoticeRequestType = "notice@mole"
+
+// Notice is the payload of a notice request
+type Notice struct {
+	Message string
+}
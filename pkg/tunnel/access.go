@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// contextKeyAccess holds the access list of the tunnel
+var contextKeyAccess = contextKey("access")
+
+// accessList says which addresses can connect to a tunnel
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newAccessList will parse the allowed and denied CIDRs or IPs, returning nil
+// if there are none
+func newAccessList(allow, deny []string) (*accessList, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	acl := &accessList{}
+	for _, l := range []struct {
+		cidrs []string
+		nets  *[]*net.IPNet
+	}{{allow, &acl.allow}, {deny, &acl.deny}} {
+		for _, s := range l.cidrs {
+			n, err := parseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			*l.nets = append(*l.nets, n)
+		}
+	}
+
+	return acl, nil
+}
+
+// parseCIDR will parse the CIDR, or a single IP as a CIDR that only contains it
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP or CIDR: %s", s)
+		}
+
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP or CIDR: %s", s)
+	}
+	return n, nil
+}
+
+// permits will return true if the address can connect.  Denied addresses are
+// checked first, then the address has to be allowed if there are any allowed.
+// Addresses that aren't IPs can only connect when nothing is allowed
+func (acl *accessList) permits(addr net.Addr) bool {
+	if acl == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, _ := net.SplitHostPort(addr.String())
+		ip = net.ParseIP(host)
+	}
+
+	if ip == nil {
+		return len(acl.allow) == 0
+	}
+
+	for _, n := range acl.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(acl.allow) == 0 {
+		return true
+	}
+
+	for _, n := range acl.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func withAccessList(ctx context.Context, acl *accessList) context.Context {
+	if acl == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyAccess, acl)
+}
+
+// permitted will check if the peer of a connection to the tunnel in the
+// context can connect to it, closing it and counting it as rejected if not
+func permitted(ctx context.Context, conn net.Conn, peer net.Addr, to string) bool {
+	acl, _ := ctx.Value(contextKeyAccess).(*accessList)
+	if acl.permits(peer) {
+		return true
+	}
+
+	reject(conn)
+	connTrackerOf(ctx).rejected()
+	log.Printf("rejected connection from %s to %s", peer, to)
+	return false
+}
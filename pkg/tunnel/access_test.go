@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	acl, err := newAccessList([]string{"192.168.1.0/24", "10.0.0.5"}, []string{"192.168.1.13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"192.168.1.10:5000": true,
+		"192.168.1.13:5000": false,
+		"10.0.0.5:5000":     true,
+		"10.0.0.6:5000":     false,
+		"[::1]:5000":        false,
+	}
+
+	for addr, expected := range tests {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+		if acl.permits(a) != expected {
+			t.Errorf("expected %s to be permitted: %v", addr, expected)
+		}
+	}
+
+	// names can't be checked against the allowed CIDRs
+	if acl.permits(namedAddr{"app.example.com", 443}) {
+		t.Error("expected a name to not be permitted when there are allowed CIDRs")
+	}
+
+	if _, err := newAccessList([]string{"192.168.1.0/33"}, nil); err == nil {
+		t.Error("expected an invalid CIDR to fail")
+	}
+
+	tr := newConnTracker()
+	ctx := withAccessList(withConnTracker(context.Background(), tr), acl)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	if permitted(ctx, c1, &net.TCPAddr{IP: net.ParseIP("10.0.0.6")}, "localhost:80") {
+		t.Fatal("expected the connection to be rejected")
+	}
+
+	if st := tr.Stats(); st.Rejected != 1 || st.Accepted != 0 {
+		t.Errorf("expected the rejection to be counted but got %+v", st)
+	}
+}
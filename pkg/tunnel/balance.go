@@ -0,0 +1,217 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+)
+
+// the ways a tunnel can balance connections across its targets
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConns = "least_conns"
+	BalanceRandom     = "random"
+)
+
+// targetDownFor is how long a target is skipped for after it failed to be dialed
+const targetDownFor = 30 * time.Second
+
+// Target is one of the remote addresses a local tunnel balances connections
+// across, which can be reached through another client in the config
+type Target struct {
+	active int64
+
+	Remote string `json:"remote"`
+	Via    string `json:"via,omitempty"`
+
+	via       *Client
+	downUntil time.Time
+}
+
+// TargetStatus is the status of one of the targets of a tunnel
+type TargetStatus struct {
+	Remote string `json:"remote"`
+	Via    string `json:"via,omitempty"`
+	Active int64  `json:"active"`
+	Down   bool   `json:"down"`
+}
+
+// balancer picks the target for each connection to a tunnel
+type balancer struct {
+	policy  string
+	targets []*Target
+	next    int
+	rand    *rand.Rand
+	mu      *sync.Mutex
+}
+
+func newBalancer(policy string, targets []*Target) (*balancer, error) {
+	switch policy {
+	case "":
+		policy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConns, BalanceRandom:
+	default:
+		return nil, fmt.Errorf("unknown balance policy: %s", policy)
+	}
+
+	for _, t := range targets {
+		if t.Remote == "" {
+			return nil, errors.New("target has no remote address")
+		}
+		t.Remote = normalizePort(t.Remote)
+	}
+
+	return &balancer{
+		policy:  policy,
+		targets: targets,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		mu:      new(sync.Mutex),
+	}, nil
+}
+
+// order will return the targets in the order they should be tried, with the
+// ones that are marked as down at the end
+func (b *balancer) order() []*Target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(b.targets)
+	targets := make([]*Target, 0, n)
+
+	switch b.policy {
+	case BalanceRandom:
+		for _, i := range b.rand.Perm(n) {
+			targets = append(targets, b.targets[i])
+		}
+	case BalanceLeastConns:
+		targets = append(targets, b.targets...)
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && atomic.LoadInt64(&targets[j].active) < atomic.LoadInt64(&targets[j-1].active); j-- {
+				targets[j], targets[j-1] = targets[j-1], targets[j]
+			}
+		}
+	default:
+		for i := 0; i < n; i++ {
+			targets = append(targets, b.targets[(b.next+i)%n])
+		}
+		b.next = (b.next + 1) % n
+	}
+
+	now := time.Now()
+	up, down := []*Target{}, []*Target{}
+	for _, t := range targets {
+		if now.Before(t.downUntil) {
+			down = append(down, t)
+			continue
+		}
+		up = append(up, t)
+	}
+
+	return append(up, down...)
+}
+
+// dial will dial the targets in turn until one of them connects, marking the
+// ones that fail as down.  The done func must be called when the connection
+// has finished
+func (b *balancer) dial(conn SSHConn) (net.Conn, *Target, func(), error) {
+	var err error
+	for _, t := range b.order() {
+		c := conn
+		if t.via != nil {
+			c = t.via
+		}
+
+		var upstream net.Conn
+		upstream, err = c.Dial("tcp", t.Remote)
+		b.setDown(t, err != nil)
+		if err != nil {
+			continue
+		}
+
+		atomic.AddInt64(&t.active, 1)
+		return upstream, t, func() { atomic.AddInt64(&t.active, -1) }, nil
+	}
+
+	return nil, nil, nil, fmt.Errorf("all targets failed, the last with: %s", err)
+}
+
+// setDown will mark the target as down for a while, or as up again
+func (b *balancer) setDown(t *Target, down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t.downUntil = time.Time{}
+	if down {
+		t.downUntil = time.Now().Add(targetDownFor)
+	}
+}
+
+// status will return the status of the targets
+func (b *balancer) status() []TargetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	sts := []TargetStatus{}
+	for _, t := range b.targets {
+		sts = append(sts, TargetStatus{
+			Remote: t.Remote,
+			Via:    t.Via,
+			Active: atomic.LoadInt64(&t.active),
+			Down:   now.Before(t.downUntil),
+		})
+	}
+	return sts
+}
+
+// dialer will return a RemoteDialer that spreads the connections across the targets
+func (b *balancer) dialer() RemoteDialer {
+	addrs := []string{}
+	for _, t := range b.targets {
+		addrs = append(addrs, t.Remote)
+	}
+	remotes := strings.Join(addrs, ",")
+
+	return func(conn SSHConn) (net.Conn, string, func(), error) {
+		c, t, done, err := b.dial(conn)
+		if err != nil {
+			return nil, remotes, nil, err
+		}
+		return c, t.Remote, done, nil
+	}
+}
+
+// startTargets will start connecting the other clients the targets go through
+func (tun *Tunnel) startTargets(ctx context.Context, ev event.Dispatcher) {
+	for _, t := range tun.Targets {
+		if t.via != nil {
+			t.via.Start(ctx, ev)
+		}
+	}
+}
+
+// linkTargets will find the clients that the targets of the tunnels go through
+func (cfg Config) linkTargets() error {
+	for _, cl := range cfg.Clients {
+		for _, tun := range cl.Tunnels {
+			for _, t := range tun.Targets {
+				if t.Via == "" || t.Via == cl.Address {
+					continue
+				}
+
+				if t.via = cfg.ClientWithAddress(t.Via); t.via == nil {
+					return fmt.Errorf("target %s of %s goes via unknown client %s", t.Remote, cl.Address, t.Via)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeConn dials a pipe for every address except the ones that are down
+type fakeConn struct {
+	down   map[string]bool
+	dialed []string
+}
+
+func (c *fakeConn) Dial(n, a string) (net.Conn, error) {
+	c.dialed = append(c.dialed, a)
+	if c.down[a] {
+		return nil, errors.New("connection refused")
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (c *fakeConn) Listen(n, a string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestBalancerSkipsFailedTargets(t *testing.T) {
+	b, err := newBalancer("", []*Target{{Remote: "a:80"}, {Remote: "b:80"}, {Remote: "c:80"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &fakeConn{down: map[string]bool{"b:80": true}}
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		_, tgt, done, err := b.dial(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+		picked = append(picked, tgt.Remote)
+	}
+
+	// b fails on the second dial so c is tried, then b is skipped while it is down
+	expected := []string{"a:80", "c:80", "c:80", "a:80"}
+	for i := range expected {
+		if picked[i] != expected[i] {
+			t.Fatalf("expected %v but got %v", expected, picked)
+		}
+	}
+
+	if sts := b.status(); !sts[1].Down || sts[0].Down {
+		t.Errorf("expected only b to be down but got %+v", sts)
+	}
+
+	conn.down = map[string]bool{"a:80": true, "b:80": true, "c:80": true}
+	if _, _, _, err := b.dial(conn); err == nil {
+		t.Error("expected an error when all the targets are down")
+	}
+}
+
+func TestBalancerLeastConns(t *testing.T) {
+	b, _ := newBalancer(BalanceLeastConns, []*Target{{Remote: "a:80"}, {Remote: "b:80"}})
+	conn := &fakeConn{}
+
+	_, first, _, _ := b.dial(conn)
+	_, second, done, _ := b.dial(conn)
+	if first.Remote != "a:80" || second.Remote != "b:80" {
+		t.Fatalf("expected the connections to be spread but got %s and %s", first.Remote, second.Remote)
+	}
+
+	done()
+	if _, tgt, _, _ := b.dial(conn); tgt.Remote != "b:80" {
+		t.Errorf("expected the target with the least connections but got %s", tgt.Remote)
+	}
+
+	if _, err := newBalancer("fastest", nil); err == nil {
+		t.Error("expected an unknown policy to be invalid")
+	}
+}
+
+func TestBalancerDialer(t *testing.T) {
+	b, _ := newBalancer(BalanceLeastConns, []*Target{{Remote: "a:80"}, {Remote: "b:80"}})
+	conn := &fakeConn{}
+	dial := b.dialer()
+
+	c, remote, done, err := dial(conn)
+	if err != nil || remote != "a:80" {
+		t.Fatalf("expected a:80 to be dialed but got %s and %v", remote, err)
+	}
+	c.Close()
+
+	if _, remote, _, _ := dial(conn); remote != "b:80" {
+		t.Errorf("expected the connection to go to b:80 while a:80 is busy but got %s", remote)
+	}
+	done()
+
+	conn.down = map[string]bool{"a:80": true, "b:80": true}
+	if _, remote, _, err := dial(conn); err == nil || remote != "a:80,b:80" {
+		t.Errorf("expected all of the targets to fail but got %s and %v", remote, err)
+	}
+}
@@ -0,0 +1,302 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contextKeyBandwidth holds the bandwidth limits and quota of the tunnel
+var contextKeyBandwidth = contextKey("bandwidth")
+
+// maxChunk is the most that is read or written at once when shaping
+const maxChunk = 32 * 1024
+
+// Bandwidth limits how fast data goes through a tunnel, or through all of the
+// tunnels of a client.  The rates are bytes per second and the sizes are bytes,
+// both with an optional unit like 512KB or 10MB.  Upload is the data going
+// from the local side to the other end of the tunnel and download is the data
+// coming back
+type Bandwidth struct {
+	Upload   string `json:"upload,omitempty"`
+	Download string `json:"download,omitempty"`
+
+	// Burst is how much can be sent at once after being idle, which is a
+	// seconds worth of the rate by default
+	Burst string `json:"burst,omitempty"`
+
+	// PerConn is the rate that each connection is limited to in each direction
+	PerConn string `json:"per_conn,omitempty"`
+
+	// DailyQuota and MonthlyQuota are how many bytes can go through a tunnel
+	// in both directions before it is closed until the day or month is over
+	DailyQuota   string `json:"daily_quota,omitempty"`
+	MonthlyQuota string `json:"monthly_quota,omitempty"`
+}
+
+// bandwidth is the parsed limits, with the buckets shared by all connections
+type bandwidth struct {
+	up      *bucket
+	down    *bucket
+	perConn float64
+	burst   float64
+}
+
+// newBandwidth will parse the limits and quotas, returning nil for either if
+// there aren't any
+func newBandwidth(bw *Bandwidth) (*bandwidth, *quota, error) {
+	if bw == nil {
+		return nil, nil, nil
+	}
+
+	var up, down, burst, perConn, daily, monthly int64
+	for _, v := range []struct {
+		name string
+		s    string
+		n    *int64
+	}{
+		{"upload", bw.Upload, &up},
+		{"download", bw.Download, &down},
+		{"burst", bw.Burst, &burst},
+		{"per_conn", bw.PerConn, &perConn},
+		{"daily_quota", bw.DailyQuota, &daily},
+		{"monthly_quota", bw.MonthlyQuota, &monthly},
+	} {
+		if v.s == "" {
+			continue
+		}
+
+		n, err := parseBytes(v.s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid bandwidth %s: %s", v.name, err)
+		}
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("invalid bandwidth %s: must be more than 0", v.name)
+		}
+		*v.n = n
+	}
+
+	var b *bandwidth
+	if up > 0 || down > 0 || perConn > 0 {
+		b = &bandwidth{
+			up:      newBucket(float64(up), float64(burst)),
+			down:    newBucket(float64(down), float64(burst)),
+			perConn: float64(perConn),
+			burst:   float64(burst),
+		}
+	}
+
+	var q *quota
+	if daily > 0 || monthly > 0 {
+		q = newQuota(daily, monthly)
+	}
+
+	return b, q, nil
+}
+
+// parseBytes will parse a number of bytes with an optional unit, which are
+// powers of 1024
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	num := strings.TrimRight(s, "KMGTIB")
+	unit := strings.TrimSpace(strings.TrimPrefix(s, num))
+
+	mult := float64(1)
+	switch strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I") {
+	case "":
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	default:
+		return 0, fmt.Errorf("unknown unit in %s", s)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a size: %s", s)
+	}
+	return int64(n * mult), nil
+}
+
+// bucket is a token bucket that fills at the rate up to the burst
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     *sync.Mutex
+}
+
+// newBucket will create a full bucket, returning nil if there is no rate
+func newBucket(rate, burst float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now(), mu: new(sync.Mutex)}
+}
+
+// reserve will take n tokens from the bucket, returning how long to wait
+// until they would have been there
+func (b *bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait will take n tokens from each of the buckets, sleeping until the
+// slowest of them would have had them
+func wait(buckets []*bucket, n int) {
+	var d time.Duration
+	for _, b := range buckets {
+		if w := b.reserve(n); w > d {
+			d = w
+		}
+	}
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// shaping is what limits the connections of a tunnel
+type shaping struct {
+	tunnel *bandwidth
+	client *bandwidth
+	quota  *quota
+}
+
+// withBandwidth will return a context that makes the tunnels connections be
+// limited by its own and its clients bandwidth, counting them in the quota
+func withBandwidth(ctx context.Context, tun, client *bandwidth, q *quota) context.Context {
+	if tun == nil && client == nil && q == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyBandwidth, shaping{tun, client, q})
+}
+
+// shape will wrap the local side of a connection so that it is limited by the
+// bandwidth in the context, if there is any
+func shape(ctx context.Context, conn net.Conn) net.Conn {
+	s, ok := ctx.Value(contextKeyBandwidth).(shaping)
+	if !ok {
+		return conn
+	}
+
+	sc := &shapedConn{Conn: conn, chunk: maxChunk, quota: s.quota}
+
+	var perConn, burst float64
+	for _, b := range []*bandwidth{s.tunnel, s.client} {
+		if b == nil {
+			continue
+		}
+
+		if b.up != nil {
+			sc.up = append(sc.up, b.up)
+		}
+		if b.down != nil {
+			sc.down = append(sc.down, b.down)
+		}
+		if perConn == 0 {
+			perConn, burst = b.perConn, b.burst
+		}
+	}
+
+	if perConn > 0 {
+		sc.up = append(sc.up, newBucket(perConn, burst))
+		sc.down = append(sc.down, newBucket(perConn, burst))
+	}
+
+	// never ask for more than a bucket can hold or it would go into debt
+	for _, b := range append(sc.up, sc.down...) {
+		if int(b.burst) < sc.chunk {
+			sc.chunk = int(b.burst)
+		}
+	}
+	if sc.chunk < 1 {
+		sc.chunk = 1
+	}
+
+	return sc
+}
+
+// errQuotaExceeded stops connections when the quota of the tunnel is used up
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// shapedConn limits the rate that data is read and written on the local side
+// of a connection, which is uploading and downloading respectively
+type shapedConn struct {
+	net.Conn
+	up    []*bucket
+	down  []*bucket
+	chunk int
+	quota *quota
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if c.quota.exceeded() {
+		return 0, errQuotaExceeded
+	}
+
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		wait(c.up, n)
+		c.quota.add(n)
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if c.quota.exceeded() {
+			return written, errQuotaExceeded
+		}
+
+		b := p
+		if len(b) > c.chunk {
+			b = b[:c.chunk]
+		}
+
+		wait(c.down, len(b))
+		n, err := c.Conn.Write(b)
+		written += n
+		c.quota.add(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite will half close the connection if it can be
+func (c *shapedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,168 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := map[string]int64{
+		"512":    512,
+		"100B":   100,
+		"2KB":    2048,
+		"1.5MB":  1572864,
+		"1 GiB":  1 << 30,
+		"10m":    10 << 20,
+		"1TB":    1 << 40,
+		"0.5kib": 512,
+	}
+
+	for s, expected := range tests {
+		n, err := parseBytes(s)
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", s, err)
+			continue
+		}
+		if n != expected {
+			t.Errorf("expected %s to be %d but got %d", s, expected, n)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "10PB", "ten"} {
+		if _, err := parseBytes(s); err == nil {
+			t.Errorf("expected %q to fail", s)
+		}
+	}
+
+	if _, _, err := newBandwidth(&Bandwidth{Upload: "0"}); err == nil {
+		t.Error("expected a rate of 0 to fail")
+	}
+}
+
+func TestShapedConn(t *testing.T) {
+	bw, q, err := newBandwidth(&Bandwidth{Upload: "64KB", Burst: "16KB", DailyQuota: "96KB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	conn := shape(withBandwidth(context.Background(), bw, nil, q), c1)
+	if conn.(*shapedConn).chunk != 16*1024 {
+		t.Errorf("expected the chunks to be the size of the burst but got %d", conn.(*shapedConn).chunk)
+	}
+
+	go c2.Write(make([]byte, 48*1024))
+
+	// the burst goes straight away and the rest at 64KB/s
+	start := time.Now()
+	if _, err := io.ReadFull(conn, make([]byte, 48*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("expected reading 48KB to take about 500ms but it took %s", d)
+	}
+
+	go c2.Write(make([]byte, 48*1024))
+	n, err := io.ReadFull(conn, make([]byte, 64*1024))
+	if err != errQuotaExceeded {
+		t.Errorf("expected the quota to be exceeded but got %v", err)
+	}
+	if n != 48*1024 {
+		t.Errorf("expected to read up to the quota but read %d bytes", n)
+	}
+
+	if st := q.status(); !st.Exceeded || st.DailyUsed != 96*1024 || st.ResetsAt == nil {
+		t.Errorf("expected the status to show the quota was used but got %+v", st)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Date(2026, 10, 19, 23, 0, 0, 0, time.Local)
+	q := newQuota(100, 1000)
+	q.now = func() time.Time { return now }
+
+	hit := q.hitChan()
+	q.add(99)
+	if q.exceeded() {
+		t.Fatal("expected the quota to not be exceeded yet")
+	}
+
+	q.add(1)
+	select {
+	case <-hit:
+	default:
+		t.Fatal("expected the channel to be closed when the quota was used up")
+	}
+
+	if r := q.resetAt(); !r.Equal(time.Date(2026, 10, 20, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("expected the daily quota to reset at midnight but got %s", r)
+	}
+
+	// a new day starts the daily count again but not the monthly one
+	now = now.Add(2 * time.Hour)
+	if q.exceeded() {
+		t.Fatal("expected the quota to reset the next day")
+	}
+	if st := q.status(); st.DailyUsed != 0 || st.MonthlyUsed != 100 {
+		t.Errorf("expected only the daily count to reset but got %+v", st)
+	}
+
+	select {
+	case <-q.hitChan():
+		t.Fatal("expected a new channel once the quota reset")
+	default:
+	}
+
+	q.add(900)
+	if r := q.resetAt(); !r.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("expected the monthly quota to reset next month but got %s", r)
+	}
+}
+
+func TestSaveQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	load := func() *Config {
+		tun, err := NewTunnelFromOpts(Local("8080"), Remote("80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tun.Bandwidth = &Bandwidth{MonthlyQuota: "1GB"}
+		if err := tun.setupStrategy(); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &Config{
+			Filename: filepath.Join(dir, "mole.yml"),
+			Clients:  []*Client{{Address: "example.com:22", Tunnels: []*Tunnel{tun}}},
+		}
+		if err := cfg.LoadQuotas(); err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	cfg := load()
+	cfg.Clients[0].Tunnels[0].quota.add(1234)
+	if err := cfg.SaveQuotas(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = load()
+	if used := cfg.Clients[0].Tunnels[0].quota.status().MonthlyUsed; used != 1234 {
+		t.Errorf("expected the usage to be kept across restarts but got %d", used)
+	}
+}
@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// boundConn will tell the tunnel which address its remote listener was bound to
+type boundConn struct {
+	SSHConn
+	tun *Tunnel
+}
+
+// Listen will listen on the remote server and record the address that was bound
+func (c boundConn) Listen(n, a string) (net.Listener, error) {
+	l, err := c.SSHConn.Listen(n, a)
+	if err == nil {
+		c.tun.setBound(l.Addr().String())
+	}
+	return l, err
+}
+
+// BoundAddr will return the address the remote side of a reverse tunnel was
+// bound to, which has the port the server picked when the tunnel asked for port 0
+func (tun *Tunnel) BoundAddr() string {
+	addr, _ := tun.bound.Load().(string)
+	return addr
+}
+
+// setBound will record the bound address, writing it to the state file and
+// running the hook if the tunnel has them
+func (tun *Tunnel) setBound(addr string) {
+	tun.bound.Store(addr)
+
+	if tun.events != nil && addr != tun.Remote {
+		tun.events.Go("log", fmt.Sprintf("reverse tunnel from %s on %s was bound to %s", tun.Remote, tun.addr, addr))
+		tun.events.Go("tunnel.bound", tun)
+	}
+
+	if tun.StateFile != "" {
+		if err := writeFileAtomic(tun.StateFile, []byte(addr+"\n")); err != nil {
+			tun.error(fmt.Errorf("failed to write the state file for %s: %s", tun.Name(), err))
+		}
+	}
+
+	if tun.OnBound != "" {
+		go tun.runHook(addr)
+	}
+}
+
+// runHook will run the on_bound command with the addresses of the tunnel in the environment
+func (tun *Tunnel) runHook(addr string) {
+	_, port, _ := net.SplitHostPort(addr)
+
+	cmd := exec.Command("sh", "-c", tun.OnBound)
+	cmd.Env = append(os.Environ(),
+		"MOLE_SERVER="+tun.addr,
+		"MOLE_LOCAL="+tun.Local,
+		"MOLE_REMOTE="+addr,
+		"MOLE_REMOTE_PORT="+port,
+	)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		tun.error(fmt.Errorf("the on_bound hook for %s failed: %s: %s", tun.Name(), err, out))
+	}
+}
+
+func (tun *Tunnel) error(err error) {
+	if tun.events != nil {
+		tun.events.Go("error", err)
+	}
+}
+
+// writeFileAtomic will write the file by renaming a temporary one over it, so
+// that anything reading it never sees it half written
+func writeFileAtomic(fn string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
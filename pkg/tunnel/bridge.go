@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bridgeBufferSize is the size of the buffers used to copy between connections
+const bridgeBufferSize = 32 * 1024
+
+// halfCloseLinger is how long a bridge waits for the other side to finish once
+// one side is done sending, so that a peer that never closes isn't kept forever
+const halfCloseLinger = time.Minute
+
+// bridgeBuffers are reused by the bridges so that each connection doesn't
+// need its own pair of buffers
+var bridgeBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bridgeBufferSize)
+		return &b
+	},
+}
+
+// errCantCloseWrite is returned when a connection can't be half closed
+var errCantCloseWrite = errors.New("connection can't be half closed")
+
+// closeWrite will half close the connection so that the other end sees that
+// nothing more will be sent, which TCP, unix and SSH channel connections can do
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errCantCloseWrite
+}
+
+// isClosedErr will return true if the error is only because the connection
+// was closed, which is how bridged connections normally end
+func isClosedErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+		strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// Bridge will mirror two active network connections using the given context
+// to allow stopping the mirror.  When one side is done sending, the other side
+// is half closed so that it can still send its response, and the connections
+// are closed once both sides are done or the other side hasn't finished within
+// a minute.  Connections that can't be half closed are both closed as soon as
+// either side is done
+func Bridge(ctx context.Context, upstream, downstream net.Conn) {
+	lingerBridge(ctx, upstream, downstream, halfCloseLinger)
+}
+
+// lingerBridge will bridge the connections, closing them both once the linger
+// has passed after the first side is done
+func lingerBridge(ctx context.Context, upstream, downstream net.Conn, linger time.Duration) {
+	done := make(chan struct{}, 2)
+
+	// Copy localConn.Reader to sshConn.Writer
+	go func() {
+		pipe(upstream, downstream)
+		done <- struct{}{}
+	}()
+
+	// Copy sshConn.Reader to localConn.Writer
+	go func() {
+		pipe(downstream, upstream)
+		done <- struct{}{}
+	}()
+
+	defer downstream.Close()
+	defer upstream.Close()
+
+	var lingered <-chan time.Time
+	for n := 0; n < 2; n++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lingered:
+			return
+		case <-done:
+		}
+
+		if lingered == nil {
+			t := time.NewTimer(linger)
+			defer t.Stop()
+			lingered = t.C
+		}
+	}
+}
+
+// pipe will copy from the source to the destination and then half close the
+// destination.  If that fails, or the copy did, both connections are closed
+// as the other direction can't carry on
+func pipe(dst, src net.Conn) {
+	buf := bridgeBuffers.Get().(*[]byte)
+	defer bridgeBuffers.Put(buf)
+
+	_, err := io.CopyBuffer(dst, src, *buf)
+	if err != nil && !isClosedErr(err) {
+		log.Printf("io.Copy failed: %v", err)
+	}
+
+	if err != nil || closeWrite(dst) != nil {
+		dst.Close()
+		src.Close()
+	}
+}
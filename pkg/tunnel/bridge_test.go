@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpPair will return both ends of a TCP connection
+func tcpPair(t testing.TB, l net.Listener) (net.Conn, net.Conn) {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestBridgeHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, downstream := tcpPair(t, l)
+	upstream, server := tcpPair(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	// the tracked connection has to pass the half close on too
+	tr := newConnTracker()
+	tracked, done := tr.track(upstream, downstream, "client", "server")
+	defer done()
+
+	bridged := make(chan struct{})
+	go func() {
+		Bridge(context.Background(), upstream, tracked)
+		close(bridged)
+	}()
+
+	// the server only responds once the client is done sending
+	go func() {
+		req, _ := ioutil.ReadAll(server)
+		server.Write(append([]byte("got "), req...))
+		server.Close()
+	}()
+
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+
+	res, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(res) != "got request" {
+		t.Errorf("expected the response after the half close but got %q", res)
+	}
+
+	<-bridged
+}
+
+func TestBridgeLingersAfterHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, downstream := tcpPair(t, l)
+	upstream, server := tcpPair(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	bridged := make(chan struct{})
+	go func() {
+		lingerBridge(context.Background(), upstream, downstream, 100*time.Millisecond)
+		close(bridged)
+	}()
+
+	// the server reads the request but never answers or closes
+	go ioutil.ReadAll(server)
+
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+
+	select {
+	case <-bridged:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the bridge to give up on the server after the linger")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Errorf("expected the client to be closed but got %v", err)
+	}
+}
+
+// opaqueConn hides the ReadFrom of TCP connections so that the bridge copies
+// with its buffers like it does for SSH channels
+type opaqueConn struct {
+	net.Conn
+}
+
+// BenchmarkBridge copies through many bridges at once to show the throughput
+// and the allocations of the copying
+func BenchmarkBridge(b *testing.B) {
+	for _, n := range []int{1, 64, 512} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			benchmarkBridge(b, n)
+		})
+	}
+}
+
+func benchmarkBridge(b *testing.B, conns int) {
+	const chunk = 32 * 1024
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writers := make([]net.Conn, conns)
+	readers := make([]net.Conn, conns)
+	for i := range writers {
+		w, downstream := tcpPair(b, l)
+		upstream, r := tcpPair(b, l)
+		go Bridge(ctx, opaqueConn{upstream}, opaqueConn{downstream})
+		writers[i], readers[i] = w, r
+		defer w.Close()
+		defer r.Close()
+	}
+
+	buf := make([]byte, chunk)
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		n := b.N / conns
+		if i < b.N%conns {
+			n++
+		}
+
+		wg.Add(2)
+		go func(w net.Conn, n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				w.Write(buf)
+			}
+		}(writers[i], n)
+		go func(r net.Conn, n int) {
+			defer wg.Done()
+			io.CopyN(ioutil.Discard, r, int64(n*chunk))
+		}(readers[i], n)
+	}
+	wg.Wait()
+}
+
+// BenchmarkBridgeShortConns bridges a short exchange on many connections at
+// once to show the allocations of setting up each bridge
+func BenchmarkBridgeShortConns(b *testing.B) {
+	msg := make([]byte, 1024)
+	b.ReportAllocs()
+	b.SetParallelism(64)
+
+	b.RunParallel(func(pb *testing.PB) {
+		req := make([]byte, len(msg))
+		res := make([]byte, len(msg))
+		for pb.Next() {
+			client, downstream := net.Pipe()
+			upstream, server := net.Pipe()
+			go Bridge(context.Background(), upstream, downstream)
+
+			go func() {
+				io.ReadFull(server, req)
+				server.Write(msg)
+				server.Close()
+			}()
+
+			client.Write(msg)
+			io.ReadFull(client, res)
+			client.Close()
+		}
+	})
+}
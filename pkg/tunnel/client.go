@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AlexanderGrom/go-event"
+	"github.com/penguinpowernz/mole/pkg/sshutil"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -34,8 +37,47 @@ type Client struct {
 	Host    string    `json:"host"`
 	Tunnels []*Tunnel `json:"tunnels"`
 
+	// OnDemand will only connect when a connection comes in to one of the
+	// tunnels, disconnecting again after being idle for the IdleTimeout
+	OnDemand    bool   `json:"on_demand,omitempty"`
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+
+	// Addresses are the servers that can be connected to instead of the Address,
+	// or they can be looked up from the SRV record.  The Policy picks which one
+	// to connect to and Failback will go back to the first one when it recovers
+	Addresses []string `json:"addresses,omitempty"`
+	SRV       string   `json:"srv,omitempty"`
+	Policy    string   `json:"policy,omitempty"`
+	Failback  bool     `json:"failback,omitempty"`
+
+	// Allow and Deny are the IPs or CIDRs that can connect to the tunnels that
+	// don't have their own
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// Bandwidth limits all of the tunnels together, with the per connection
+	// rate used for tunnels that don't have their own
+	Bandwidth *Bandwidth `json:"bandwidth,omitempty"`
+
+	// MaxConnections limits the connections going through all of the tunnels
+	// together, which is on top of any limits that the tunnels have
+	MaxConnections int     `json:"max_connections,omitempty"`
+	QueueSize      int     `json:"queue_size,omitempty"`
+	QueueTimeout   string  `json:"queue_timeout,omitempty"`
+	AcceptRate     float64 `json:"accept_rate,omitempty"`
+
 	mu       *sync.Mutex
+	started  int32
 	deadChan chan struct{}
+	events   event.Dispatcher
+	state    *clientState
+	demand   *onDemand
+	acl      *accessList
+	bw       *bandwidth
+	limits   *connLimiter
+
+	named   map[string]*namedListener
+	namedMu *sync.Mutex
 }
 
 func (cl *Client) init() error {
@@ -48,7 +90,7 @@ func (cl *Client) init() error {
 	}
 
 	if cl.Host != "" {
-		k, err := ssh.ParsePublicKey([]byte(cl.Host))
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cl.Host))
 		if err != nil {
 			return fmt.Errorf("couldn't update hostkey for %s: %s", cl.Address, err)
 		}
@@ -61,19 +103,66 @@ func (cl *Client) init() error {
 	}
 
 	sshcfg.Auth = append(sshcfg.Auth, ssh.PublicKeys(privkey))
+
+	idle, err := parseIdleTimeout(cl.IdleTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid idle timeout for %s: %s", cl.Address, err)
+	}
+
+	if err := cl.validatePolicy(); err != nil {
+		return err
+	}
+
 	cl.sshcfg = sshcfg
 	cl.mu = new(sync.Mutex)
+	cl.deadChan = make(chan struct{}, 1)
+	cl.state = newClientState()
+	cl.demand = &onDemand{idle: idle}
+	cl.named = map[string]*namedListener{}
+	cl.namedMu = new(sync.Mutex)
 	cl.initted = true
 	return nil
 }
 
-// UnmarshalJSON will unmmarshal the individual client configuration
-// and initialize the fields on it so that it is ready to use
+// UnmarshalJSON will unmmarshal the individual client configuration, the
+// fields are initialized when connecting as the keys may be copied from the
+// default client after unmarshalling.  A client with a list of servers is
+// named after the first one if it has no address
 func (cl *Client) UnmarshalJSON(data []byte) error {
-	if err := json.Unmarshal(data, cl); err != nil {
+	type client Client
+	if err := json.Unmarshal(data, (*client)(cl)); err != nil {
 		return err
 	}
-	return cl.init()
+
+	if cl.Address == "" && len(cl.Addresses) > 0 {
+		cl.Address = cl.Addresses[0]
+	}
+	if cl.Address == "" && cl.SRV != "" {
+		cl.Address = cl.SRV
+	}
+
+	acl, err := newAccessList(cl.Allow, cl.Deny)
+	if err != nil {
+		return fmt.Errorf("%s: %s", cl.Address, err)
+	}
+	cl.acl = acl
+
+	bw, q, err := newBandwidth(cl.Bandwidth)
+	if err != nil {
+		return fmt.Errorf("%s: %s", cl.Address, err)
+	}
+	if q != nil {
+		return fmt.Errorf("%s: quotas can only be set on tunnels", cl.Address)
+	}
+	cl.bw = bw
+
+	lim, err := newConnLimiter(cl.MaxConnections, cl.QueueSize, cl.QueueTimeout, cl.AcceptRate)
+	if err != nil {
+		return fmt.Errorf("%s: %s", cl.Address, err)
+	}
+	cl.limits = lim
+
+	return nil
 }
 
 // HasTunnels will return true if the client has any tunnels that are enabled
@@ -89,12 +178,27 @@ func (cl *Client) HasTunnels() bool {
 
 // Dial will dial a port on the remote server
 func (cl *Client) Dial(n, a string) (net.Conn, error) {
+	if cl.ssh == nil {
+		return nil, fmt.Errorf("%s is not connected", cl.Address)
+	}
 	return cl.ssh.Dial(n, a)
 }
 
-// Listen will open a listener to a port on the remote server
+// Listen will open a listener to a port on the remote server, if the host is a
+// name instead of an IP then the server is asked to forward connections for that
+// name, which moled uses for virtual hosts
 func (cl *Client) Listen(n, a string) (net.Listener, error) {
-	return cl.ssh.Listen(n, a)
+	host, port, err := net.SplitHostPort(a)
+	if err != nil || !isNamedHost(host) {
+		return cl.ssh.Listen(n, a)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s: %s", a, err)
+	}
+
+	return cl.listenNamed(host, p)
 }
 
 // WaitForConnect will block until the client is connected
@@ -109,18 +213,25 @@ func (cl *Client) WaitForConnect() {
 
 // Close will close the client connections
 func (cl *Client) Close() (err error) {
+	if cl.ssh == nil {
+		return nil
+	}
 	return cl.ssh.Close()
 }
 
 // ConnectWithContext will connect using the given context to signal when to disconnect or stop
 // trying to connect.  This will loop to continuously attempt to connect to the tunnel
 func (cl *Client) ConnectWithContext(ctx context.Context, events event.Dispatcher) {
-	cl.init()
+	if err := cl.init(); err != nil {
+		events.Go("error", err)
+		return
+	}
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
 	if cl.connected {
 		return
 	}
+	cl.events = events
 
 	t := time.NewTicker(time.Second * 5)
 
@@ -130,17 +241,33 @@ func (cl *Client) ConnectWithContext(ctx context.Context, events event.Dispatche
 			if !cl.connected {
 				if err := cl.Connect(); err != nil {
 					events.Go("error", fmt.Errorf("failed to connect to %s: %s", cl.Address, err))
+					cl.state.update(func(st *clientState) { st.lastError = err.Error() })
 					continue
 				}
 
 				cl.connected = true
+				cl.state.update(func(st *clientState) {
+					st.connected = true
+					st.lastConnect = time.Now()
+					st.lastError = ""
+				})
 
-				go func() {
-					if err := cl.ssh.Wait(); err != nil {
+				go cl.measureRTT(cl.ssh)
+				go func(conn *ssh.Client) {
+					err := conn.Wait()
+					if err != nil {
 						events.Go("error", fmt.Errorf("client %s disconnected: %s", cl.Address, err))
 					}
+
+					cl.state.update(func(st *clientState) {
+						st.connected = false
+						st.lastDisconnect = time.Now()
+						if err != nil {
+							st.lastError = err.Error()
+						}
+					})
 					cl.deadChan <- struct{}{}
-				}()
+				}(cl.ssh)
 
 				events.Go("log", "client "+cl.Address+" was connected")
 				events.Go("client.connected", cl)
@@ -158,16 +285,90 @@ func (cl *Client) ConnectWithContext(ctx context.Context, events event.Dispatche
 }
 
 // Connect will connect to the server returning an error
-// if the connect failed
+// if the connect failed.  When the client has more than one server they
+// are tried in the order given by the policy until one connects
 func (cl *Client) Connect() (err error) {
-	cl.ssh, err = ssh.Dial("tcp", cl.Address, cl.sshcfg)
+	addrs, err := cl.servers()
+	if err != nil {
+		return err
+	}
+
+	for i, addr := range addrs {
+		if err = cl.connectTo(addr); err == nil {
+			cl.setActiveServer(addr, addrs)
+			return nil
+		}
+
+		if len(addrs) > 1 && cl.events != nil {
+			cl.events.Go("error", fmt.Errorf("failed to connect to server %s for %s: %s", addr, cl.Address, err))
+		}
+
+		if i == len(addrs)-1 && len(addrs) > 1 {
+			err = fmt.Errorf("all %d servers failed, the last with: %s", len(addrs), err)
+		}
+	}
+
+	return err
+}
+
+// connectTo will connect to the given server
+func (cl *Client) connectTo(addr string) error {
+	c, chans, reqs, err := cl.handshake(addr)
 	if err != nil {
 		return err
 	}
 
+	cl.ssh = ssh.NewClient(c, cl.handleNamedForwards(chans), cl.handleNotices(reqs))
 	return nil
 }
 
+// setActiveServer will record which server the client connected to and watch
+// for the preferred one to recover if it should go back to it
+func (cl *Client) setActiveServer(addr string, addrs []string) {
+	if len(addrs) == 1 {
+		cl.state.update(func(st *clientState) { st.server = addr })
+		return
+	}
+
+	if prev := cl.activeServer(); prev != addr && cl.events != nil {
+		cl.events.Go("log", fmt.Sprintf("client %s is using server %s", cl.Address, addr))
+	}
+	cl.state.update(func(st *clientState) { st.server = addr })
+
+	if cl.Failback && cl.Policy != PolicyRandom && cl.Policy != PolicyLatency && addr != addrs[0] {
+		go cl.failback(cl.ssh, addrs[0])
+	}
+}
+
+// handleNotices will emit the notices sent by the server, like warnings that
+// the session is about to be disconnected.  Any other global requests are
+// passed on to the SSH client
+func (cl *Client) handleNotices(in <-chan *ssh.Request) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		for req := range in {
+			if req.Type != sshutil.NoticeRequestType {
+				out <- req
+				continue
+			}
+
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+
+			n := sshutil.Notice{}
+			if err := ssh.Unmarshal(req.Payload, &n); err != nil || cl.events == nil {
+				continue
+			}
+
+			cl.events.Go("log", fmt.Sprintf("notice from %s: %s", cl.Address, n.Message))
+			cl.events.Go("client.notice", cl, n.Message)
+		}
+	}()
+	return out
+}
+
 // OpenTunnels will connect the client and open any enabled tunnels the client
 // has.  If all the client has no tunnels or they are all disabled, this method
 // is a no op
@@ -176,7 +377,17 @@ func (cl *Client) OpenTunnels(ctx context.Context, ev event.Dispatcher) {
 		return
 	}
 
-	go cl.ConnectWithContext(ctx, ev)
+	if cl.OnDemand {
+		for _, tun := range cl.Tunnels {
+			if !tun.Disabled {
+				cl.openOnDemand(ctx, tun, ev)
+			}
+		}
+		ev.Go("log", fmt.Sprintf("waiting for connections to %s", cl.Address))
+		return
+	}
+
+	cl.Start(ctx, ev)
 	ev.Go("log", fmt.Sprintf("waiting for %s to connect", cl.Address))
 	cl.WaitForConnect()
 
@@ -185,8 +396,51 @@ func (cl *Client) OpenTunnels(ctx context.Context, ev event.Dispatcher) {
 			continue
 		}
 
-		tun.addr = cl.Address // addr only used for logging purpose
+		cl.adopt(tun)
+		tun.startTargets(ctx, ev)
 		go tun.KeepOpen(ctx, cl, ev)
 	}
 	ev.Go("log", fmt.Sprintf("forked off all tunnel managers for %s", cl.Address))
 }
+
+// adopt will give the tunnel the settings it takes from the client
+func (cl *Client) adopt(tun *Tunnel) {
+	tun.addr = cl.Address // addr only used for logging purpose
+	tun.clientACL = cl.acl
+	tun.clientBW = cl.bw
+	tun.clientLim = cl.limits
+}
+
+// Start will start connecting the client in the background, unless it has
+// already been started
+func (cl *Client) Start(ctx context.Context, ev event.Dispatcher) {
+	if !atomic.CompareAndSwapInt32(&cl.started, 0, 1) {
+		return
+	}
+
+	// the SSH connection should stay up while the tunnels are draining
+	go cl.ConnectWithContext(connContext(ctx), ev)
+}
+
+// OpenTunnel will keep the given tunnel open once the client is connected,
+// starting the client if needed
+func (cl *Client) OpenTunnel(ctx context.Context, tun *Tunnel, ev event.Dispatcher) {
+	if cl.OnDemand {
+		cl.openOnDemand(ctx, tun, ev)
+		return
+	}
+
+	cl.Start(ctx, ev)
+	go func() {
+		cl.WaitForConnect()
+		cl.adopt(tun)
+		tun.startTargets(ctx, ev)
+		tun.KeepOpen(ctx, cl, ev)
+	}()
+}
+
+// Reconnect will drop the SSH connection so that it is connected again, along
+// with the tunnels going through it
+func (cl *Client) Reconnect() error {
+	return cl.Close()
+}
@@ -26,7 +26,46 @@ func (cfg *Config) UnmarshalJSON(data []byte) error {
 
 	cfg.copyDefaultKeys()
 
-	return nil
+	return cfg.linkTargets()
+}
+
+// MarshalJSON will marshal the clients as an array so that it matches
+// the format the config file is read in with.  Keys that were copied
+// from the default client are not repeated
+func (cfg Config) MarshalJSON() ([]byte, error) {
+	def := cfg.ClientWithAddress("*")
+	if def == nil {
+		return json.Marshal(cfg.Clients)
+	}
+
+	clients := []*Client{}
+	for _, cl := range cfg.Clients {
+		if cl != def && (cl.Private == def.Private || cl.Public == def.Public) {
+			c := *cl
+			if c.Private == def.Private {
+				c.Private = ""
+			}
+			if c.Public == def.Public {
+				c.Public = ""
+			}
+			cl = &c
+		}
+		clients = append(clients, cl)
+	}
+
+	return json.Marshal(clients)
+}
+
+// SetClient will add the client to the config, replacing any
+// existing client with the same address
+func (cfg *Config) SetClient(cl *Client) {
+	for i, c := range cfg.Clients {
+		if c.Address == cl.Address {
+			cfg.Clients[i] = cl
+			return
+		}
+	}
+	cfg.Clients = append(cfg.Clients, cl)
 }
 
 func (cfg Config) copyDefaultKeys() {
@@ -0,0 +1,268 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrConnNotFound is returned when there is no connection with the given ID
+var ErrConnNotFound = errors.New("connection not found")
+
+// contextKeyConns holds the tracker that a tunnels connections are counted with
+var contextKeyConns = contextKey("conns")
+
+// connIDs gives each connection an ID that is unique to the process
+var connIDs uint64
+
+// ConnInfo describes a connection going through a tunnel.  The bytes are counted
+// on the local side, so sent is what went through the tunnel to the other end
+type ConnInfo struct {
+	ID            string    `json:"id"`
+	Source        string    `json:"source"`
+	Destination   string    `json:"destination"`
+	Started       time.Time `json:"started"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// TunnelStats are the totals for the connections that went through a tunnel
+type TunnelStats struct {
+	Accepted       int64 `json:"accepted"`
+	Active         int64 `json:"active"`
+	FailedDials    int64 `json:"failed_dials"`
+	Rejected       int64 `json:"rejected"`
+	Queued         int64 `json:"queued"`
+	ClosedIdle     int64 `json:"closed_idle"`
+	ClosedLifetime int64 `json:"closed_lifetime"`
+	BytesSent      int64 `json:"bytes_sent"`
+	BytesReceived  int64 `json:"bytes_received"`
+}
+
+// connTracker keeps the stats and the active connections of a tunnel
+type connTracker struct {
+	stats         TunnelStats
+	conns         map[string]*trackedConn
+	lastDialError string
+	mu            *sync.Mutex
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: map[string]*trackedConn{}, mu: new(sync.Mutex)}
+}
+
+// withConnTracker will return a context that makes the strategies count
+// their connections with the given tracker
+func withConnTracker(ctx context.Context, t *connTracker) context.Context {
+	return context.WithValue(ctx, contextKeyConns, t)
+}
+
+// connTrackerOf will return the tracker in the context, or nil if there isn't one
+func connTrackerOf(ctx context.Context) *connTracker {
+	t, _ := ctx.Value(contextKeyConns).(*connTracker)
+	return t
+}
+
+// accepted will count a connection that was accepted by the tunnel
+func (t *connTracker) accepted() {
+	if t != nil {
+		atomic.AddInt64(&t.stats.Accepted, 1)
+	}
+}
+
+// dialFailed will count a connection that couldn't be made to the other end
+// and keep the reason why
+func (t *connTracker) dialFailed(err error) {
+	if t == nil {
+		return
+	}
+
+	atomic.AddInt64(&t.stats.FailedDials, 1)
+	t.mu.Lock()
+	t.lastDialError = err.Error()
+	t.mu.Unlock()
+}
+
+// LastDialError will return why the last connection couldn't be made to the other end
+func (t *connTracker) LastDialError() string {
+	if t == nil {
+		return ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastDialError
+}
+
+// rejected will count a connection that wasn't allowed to use the tunnel
+func (t *connTracker) rejected() {
+	if t != nil {
+		atomic.AddInt64(&t.stats.Rejected, 1)
+	}
+}
+
+// closedIdle will count a connection that was closed for being idle
+func (t *connTracker) closedIdle() {
+	if t != nil {
+		atomic.AddInt64(&t.stats.ClosedIdle, 1)
+	}
+}
+
+// closedLifetime will count a connection that was closed for being open too long
+func (t *connTracker) closedLifetime() {
+	if t != nil {
+		atomic.AddInt64(&t.stats.ClosedLifetime, 1)
+	}
+}
+
+// track will start tracking the bridged connections, returning the local side
+// wrapped so that its bytes are counted and a func to call when they are done
+func (t *connTracker) track(upstream, downstream net.Conn, source, dest string) (net.Conn, func()) {
+	tc := &trackedConn{
+		Conn:    downstream,
+		tracker: t,
+		info: ConnInfo{
+			ID:          strconv.FormatUint(atomic.AddUint64(&connIDs, 1), 10),
+			Source:      source,
+			Destination: dest,
+			Started:     time.Now(),
+		},
+		kill: func() {
+			upstream.Close()
+			downstream.Close()
+		},
+	}
+
+	t.mu.Lock()
+	t.conns[tc.info.ID] = tc
+	t.mu.Unlock()
+	atomic.AddInt64(&t.stats.Active, 1)
+
+	return tc, func() {
+		t.mu.Lock()
+		delete(t.conns, tc.info.ID)
+		t.mu.Unlock()
+		atomic.AddInt64(&t.stats.Active, -1)
+	}
+}
+
+// Stats will return the totals for the tunnel
+func (t *connTracker) Stats() TunnelStats {
+	if t == nil {
+		return TunnelStats{}
+	}
+
+	return TunnelStats{
+		Accepted:       atomic.LoadInt64(&t.stats.Accepted),
+		Active:         atomic.LoadInt64(&t.stats.Active),
+		FailedDials:    atomic.LoadInt64(&t.stats.FailedDials),
+		Rejected:       atomic.LoadInt64(&t.stats.Rejected),
+		ClosedIdle:     atomic.LoadInt64(&t.stats.ClosedIdle),
+		ClosedLifetime: atomic.LoadInt64(&t.stats.ClosedLifetime),
+		BytesSent:      atomic.LoadInt64(&t.stats.BytesSent),
+		BytesReceived:  atomic.LoadInt64(&t.stats.BytesReceived),
+	}
+}
+
+// Conns will return the active connections, oldest first
+func (t *connTracker) Conns() []ConnInfo {
+	conns := []ConnInfo{}
+	if t == nil {
+		return conns
+	}
+
+	t.mu.Lock()
+	for _, tc := range t.conns {
+		conns = append(conns, tc.Info())
+	}
+	t.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Started.Before(conns[j].Started) })
+	return conns
+}
+
+// kill will close the connection with the given ID, returning false if there isn't one
+func (t *connTracker) kill(id string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	tc, found := t.conns[id]
+	t.mu.Unlock()
+
+	if found {
+		tc.kill()
+	}
+	return found
+}
+
+// trackedConn is the local side of a bridged connection, counting the bytes through it
+type trackedConn struct {
+	sent, received int64 // first so they are aligned for atomic access
+
+	net.Conn
+	tracker *connTracker
+	info    ConnInfo
+	kill    func()
+}
+
+func (tc *trackedConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	atomic.AddInt64(&tc.sent, int64(n))
+	atomic.AddInt64(&tc.tracker.stats.BytesSent, int64(n))
+	return n, err
+}
+
+func (tc *trackedConn) Write(b []byte) (int, error) {
+	n, err := tc.Conn.Write(b)
+	atomic.AddInt64(&tc.received, int64(n))
+	atomic.AddInt64(&tc.tracker.stats.BytesReceived, int64(n))
+	return n, err
+}
+
+// CloseWrite will half close the connection if it can be
+func (tc *trackedConn) CloseWrite() error {
+	return closeWrite(tc.Conn)
+}
+
+// Info will return the details of the connection
+func (tc *trackedConn) Info() ConnInfo {
+	info := tc.info
+	info.BytesSent = atomic.LoadInt64(&tc.sent)
+	info.BytesReceived = atomic.LoadInt64(&tc.received)
+	return info
+}
+
+// Stats will return the totals for the connections that went through the tunnel
+func (tun *Tunnel) Stats() TunnelStats {
+	st := tun.conns.Stats()
+	st.Queued = tun.limits.queued()
+	return st
+}
+
+// Conns will return the connections going through the tunnel
+func (tun *Tunnel) Conns() []ConnInfo {
+	return tun.conns.Conns()
+}
+
+// Kill will close the connection with the given ID, returning false if
+// it isn't going through this tunnel
+func (tun *Tunnel) Kill(id string) bool {
+	return tun.conns.kill(id)
+}
+
+// KillConn will close the connection with the given ID in any of the tunnels
+func (cfg Config) KillConn(id string) error {
+	for _, tun := range cfg.Tunnels() {
+		if tun.Kill(id) {
+			return nil
+		}
+	}
+	return ErrConnNotFound
+}
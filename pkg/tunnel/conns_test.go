@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerCountsAndKills(t *testing.T) {
+	tr := newConnTracker()
+	ctx := withConnTracker(context.Background(), tr)
+
+	up1, up2 := net.Pipe()
+	down1, down2 := net.Pipe()
+	tr.accepted()
+
+	done := make(chan struct{})
+	go func() {
+		bridge(ctx, up1, down1, "127.0.0.1:5000", "localhost:80")
+		close(done)
+	}()
+
+	go down2.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := up2.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	go up2.Write([]byte("hi"))
+	if _, err := down2.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bytes are counted after the pipe has passed them on
+	var conns []ConnInfo
+	for i := 0; i < 100; i++ {
+		if conns = tr.Conns(); len(conns) == 1 && conns[0].BytesReceived == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection but got %d", len(conns))
+	}
+
+	c := conns[0]
+	if c.Source != "127.0.0.1:5000" || c.Destination != "localhost:80" || c.BytesSent != 5 || c.BytesReceived != 2 {
+		t.Errorf("unexpected connection info %+v", c)
+	}
+
+	if tr.kill("nope") {
+		t.Error("expected no connection to be killed for an unknown ID")
+	}
+
+	if !tr.kill(c.ID) {
+		t.Fatal("expected the connection to be killed")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the bridge to stop when the connection was killed")
+	}
+
+	st := tr.Stats()
+	if st.Accepted != 1 || st.Active != 0 || st.BytesSent != 5 || st.BytesReceived != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestKillCommandFailsForUnknownConns(t *testing.T) {
+	cfg := Config{}
+
+	res := cfg.HandleControlRequest(ControlRequest{Command: "kill", Args: []string{"nope"}})
+	if res.OK || res.Message != "" {
+		t.Errorf("expected the kill to fail without saying it killed anything but got %+v", res)
+	}
+}
@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/penguinpowernz/mole/internal/util"
+)
+
+// DefaultControlSocket will return the unix socket used to manage a running
+// client when none is given, which is unique to the user
+func DefaultControlSocket() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("mole-%d.sock", os.Getuid()))
+}
+
+// ControlRequest is a command sent to the client over the control socket
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// ControlResponse is the clients reply to a ControlRequest
+type ControlResponse struct {
+	OK      bool           `json:"ok"`
+	Error   string         `json:"error,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Tunnels []TunnelStatus `json:"tunnels,omitempty"`
+}
+
+// TunnelStatus is the status of a tunnel and the connections going through it
+type TunnelStatus struct {
+	Name      string      `json:"name"`
+	Local     string      `json:"local"`
+	Remote    string      `json:"remote"`
+	Direction string      `json:"direction"`
+	Open      bool        `json:"open"`
+	Disabled  bool        `json:"disabled"`
+	Stats     TunnelStats `json:"stats"`
+	Conns     []ConnInfo  `json:"conns"`
+
+	Targets []TargetStatus `json:"targets,omitempty"`
+	Health  *HealthStatus  `json:"health,omitempty"`
+	Quota   *QuotaStatus   `json:"quota,omitempty"`
+
+	LastDialError string `json:"last_dial_error,omitempty"`
+}
+
+// Status will return the status of the tunnel
+func (tun *Tunnel) Status() TunnelStatus {
+	st := TunnelStatus{
+		Name:      tun.Name(),
+		Local:     tun.Local,
+		Remote:    tun.remote(),
+		Direction: "local",
+		Open:      tun.Opened(),
+		Disabled:  tun.Disabled,
+		Stats:     tun.Stats(),
+		Conns:     tun.Conns(),
+
+		LastDialError: tun.conns.LastDialError(),
+	}
+
+	if tun.Reverse {
+		st.Direction = "reverse"
+	}
+
+	if tun.balancer != nil {
+		st.Targets = tun.balancer.status()
+	}
+
+	if tun.health != nil {
+		st.Health = tun.health.status()
+	}
+
+	if tun.quota != nil {
+		st.Quota = tun.quota.status()
+	}
+
+	return st
+}
+
+// SendControlRequest will send the given command to a running client listening
+// on the given unix socket and return its response
+func SendControlRequest(socket, cmd string, args ...string) (*ControlResponse, error) {
+	res := new(ControlResponse)
+	if err := util.SendControl(socket, ControlRequest{Command: cmd, Args: args}, res); err != nil {
+		return nil, err
+	}
+
+	if !res.OK {
+		return res, errors.New(res.Error)
+	}
+
+	return res, nil
+}
+
+// ListenAndServeControl will listen on the control socket for management
+// commands until the context is done.  The socket is only accessible by
+// the user running the client
+func (cfg *Config) ListenAndServeControl(ctx context.Context, fn string) error {
+	return util.ServeControl(ctx, fn, func(line []byte) interface{} {
+		req := ControlRequest{}
+		if err := json.Unmarshal(line, &req); err != nil {
+			return &ControlResponse{Error: fmt.Sprintf("bad request: %s", err)}
+		}
+		return cfg.HandleControlRequest(req)
+	})
+}
+
+// HandleControlRequest will run the given control command and return the result
+func (cfg *Config) HandleControlRequest(req ControlRequest) *ControlResponse {
+	res := &ControlResponse{OK: true}
+
+	var err error
+	switch req.Command {
+	case "conns":
+		for _, tun := range cfg.Tunnels().Open() {
+			res.Tunnels = append(res.Tunnels, tun.Status())
+		}
+	case "kill":
+		if len(req.Args) == 0 {
+			err = errors.New("no arguments given")
+		}
+		for _, id := range req.Args {
+			if err = cfg.KillConn(id); err != nil {
+				err = fmt.Errorf("%s: %s", id, err)
+				break
+			}
+		}
+		if err == nil {
+			res.Message = fmt.Sprintf("%d killed", len(req.Args))
+		}
+	default:
+		err = fmt.Errorf("unknown command: %s", req.Command)
+	}
+
+	if err != nil {
+		res.OK = false
+		res.Error = err.Error()
+	}
+
+	return res
+}
@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// contextKeyDial holds how the tunnel handles failed dials
+var contextKeyDial = contextKey("dial")
+
+// dialRetryBackoff is how long to wait before the first retry of a failed
+// dial, which doubles for each one after that
+const dialRetryBackoff = 100 * time.Millisecond
+
+// dialFailedLogEvery is how often failed dials are logged for each tunnel
+const dialFailedLogEvery = 10 * time.Second
+
+// dialPolicy says how long to keep retrying failed dials for, and who to tell
+// when they fail
+type dialPolicy struct {
+	retry  time.Duration
+	failed func(addr string, err error)
+}
+
+// parseDialRetry will parse how long to retry failed dials for
+func parseDialRetry(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dial retry: %s", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid dial retry: must be more than 0")
+	}
+	return d, nil
+}
+
+func withDialPolicy(ctx context.Context, retry time.Duration, failed func(string, error)) context.Context {
+	return context.WithValue(ctx, contextKeyDial, dialPolicy{retry, failed})
+}
+
+// dialWithRetry will dial using the given func, retrying it until the retry
+// time of the tunnel in the context has passed
+func dialWithRetry(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	c, err := dial()
+	p, _ := ctx.Value(contextKeyDial).(dialPolicy)
+	if err == nil || p.retry == 0 {
+		return c, err
+	}
+
+	deadline := time.Now().Add(p.retry)
+	backoff := dialRetryBackoff
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+
+		if c, err = dial(); err == nil {
+			return c, nil
+		}
+		backoff *= 2
+	}
+}
+
+// reject will close a connection that was accepted but can't be used, with a
+// reset for TCP so that the app sees it failed instead of waiting for a reply
+func reject(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// failDial will reject the accepted connection as the other end couldn't be
+// dialed, closing what was dialed if anything was.  The failure is counted and
+// passed on to the tunnel in the context
+func failDial(ctx context.Context, accepted, dialed net.Conn, addr string, err error) {
+	if dialed != nil {
+		dialed.Close()
+	}
+
+	connTrackerOf(ctx).dialFailed(err)
+	reject(accepted)
+
+	if p, _ := ctx.Value(contextKeyDial).(dialPolicy); p.failed != nil {
+		p.failed(addr, err)
+	}
+}
+
+// dialFailed will let everyone know that a connection through the tunnel
+// couldn't be made.  The event is fired for every one, but they are only
+// logged every so often so that a service that is down doesn't flood the log
+func (tun *Tunnel) dialFailed(addr string, err error) {
+	tun.mu.Lock()
+	ev := tun.events
+	tun.dialFailures++
+	failures := tun.dialFailures
+	logIt := time.Since(tun.dialLoggedAt) >= dialFailedLogEvery
+	if logIt {
+		tun.dialFailures = 0
+		tun.dialLoggedAt = time.Now()
+	}
+	tun.mu.Unlock()
+
+	if ev == nil {
+		return
+	}
+
+	if logIt {
+		msg := fmt.Sprintf("failed to dial %s for %s: %s", addr, tun.Name(), err)
+		if failures > 1 {
+			msg += fmt.Sprintf(" (%d failed since the last one was logged)", failures)
+		}
+		ev.Go("log", msg)
+	}
+	ev.Go("tunnel.dial_failed", tun, err)
+}
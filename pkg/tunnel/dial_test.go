@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+)
+
+func TestDialWithRetry(t *testing.T) {
+	attempts := 0
+	dial := func() (net.Conn, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	if _, err := dialWithRetry(context.Background(), dial); err == nil || attempts != 1 {
+		t.Errorf("expected a single failed attempt without a retry but got %d", attempts)
+	}
+
+	attempts = 0
+	ctx := withDialPolicy(context.Background(), time.Second, nil)
+	if _, err := dialWithRetry(ctx, dial); err != nil || attempts != 3 {
+		t.Errorf("expected the third attempt to work but got %d attempts and %v", attempts, err)
+	}
+
+	// gives up once the retry time is used
+	attempts = -100
+	ctx = withDialPolicy(context.Background(), 250*time.Millisecond, nil)
+	start := time.Now()
+	if _, err := dialWithRetry(ctx, dial); err == nil {
+		t.Error("expected the dial to fail")
+	}
+	if d := time.Since(start); d < 250*time.Millisecond || d > time.Second {
+		t.Errorf("expected it to retry for 250ms but it took %s", d)
+	}
+}
+
+func TestLocalStrategyRejectsWhenDialFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tun, err := NewTunnelFromOpts(Local(addr), Remote("remote:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := make(chan error, 10)
+	logs := make(chan string, 10)
+	ev := event.New()
+	ev.On("tunnel.dial_failed", func(tun *Tunnel, err error) error {
+		failed <- err
+		return nil
+	})
+	ev.On("log", func(msg string) error {
+		if strings.Contains(msg, "failed to dial") {
+			logs <- msg
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tun.KeepOpen(ctx, &switchConn{}, ev)
+
+	for i := 0; i < 2; i++ {
+		var conn net.Conn
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("tcp", addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the connection is closed straight away instead of hanging
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+			t.Fatalf("expected the connection to be closed but got %v", err)
+		}
+
+		select {
+		case err := <-failed:
+			if err.Error() != "connection refused" {
+				t.Errorf("expected the dial to be refused but got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the tunnel.dial_failed event to be fired")
+		}
+	}
+
+	if st := tun.Stats(); st.FailedDials != 2 {
+		t.Errorf("expected the failed dials to be counted but got %+v", st)
+	}
+
+	if tun.conns.LastDialError() != "connection refused" {
+		t.Errorf("expected the reason to be kept but got %q", tun.conns.LastDialError())
+	}
+
+	// only the first failure is logged so a service that is down doesn't flood the log
+	time.Sleep(50 * time.Millisecond)
+	if len(logs) != 1 {
+		t.Errorf("expected the failed dials to be logged once but they were logged %d times", len(logs))
+	}
+}
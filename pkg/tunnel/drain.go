@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+type contextKey string
+
+// contextKeyDrainer holds the drainer that bridged connections are tracked with
+var contextKeyDrainer = contextKey("drainer")
+
+// Drainer keeps track of the connections being bridged by the tunnels so that
+// when shutting down they can be given time to finish instead of being cut off
+type Drainer struct {
+	ctx  context.Context
+	kill context.CancelFunc
+
+	active  int
+	changed chan struct{}
+	mu      *sync.Mutex
+}
+
+// NewDrainer will create a new drainer
+func NewDrainer() *Drainer {
+	ctx, kill := context.WithCancel(context.Background())
+	return &Drainer{ctx: ctx, kill: kill, changed: make(chan struct{}, 1), mu: new(sync.Mutex)}
+}
+
+// WithDrainer will return a context that makes the tunnels opened with it track
+// their connections with the given drainer.  When the context is done the tunnels
+// stop accepting new connections, but the existing ones and the SSH connections
+// they go through are kept open until the drainer kills them
+func WithDrainer(ctx context.Context, d *Drainer) context.Context {
+	return context.WithValue(ctx, contextKeyDrainer, d)
+}
+
+// connContext will return the context that should be used for connections that
+// need to outlive the given context while draining
+func connContext(ctx context.Context) context.Context {
+	if d, ok := ctx.Value(contextKeyDrainer).(*Drainer); ok {
+		return d.ctx
+	}
+	return ctx
+}
+
+// bridge will bridge the connections, tracking them with the drainer and
+// counting them with the tunnels tracker in the context if there are any,
+// limiting them to the tunnels bandwidth and closing them at its timeouts
+func bridge(ctx context.Context, upstream, downstream net.Conn, source, dest string) {
+	if t := connTrackerOf(ctx); t != nil {
+		var done func()
+		downstream, done = t.track(upstream, downstream, source, dest)
+		defer done()
+	}
+	downstream = shape(ctx, downstream)
+
+	downstream, stop := enforceTimeouts(ctx, upstream, downstream, source, dest)
+	defer stop()
+
+	d, ok := ctx.Value(contextKeyDrainer).(*Drainer)
+	if !ok {
+		Bridge(ctx, upstream, downstream)
+		return
+	}
+
+	d.Bridge(upstream, downstream)
+}
+
+// Bridge will bridge the two connections until they are done or killed by the drainer
+func (d *Drainer) Bridge(upstream, downstream net.Conn) {
+	d.mu.Lock()
+	d.active++
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.active--
+		d.mu.Unlock()
+
+		select {
+		case d.changed <- struct{}{}:
+		default:
+		}
+	}()
+
+	Bridge(d.ctx, upstream, downstream)
+}
+
+// Active will return the number of connections being bridged
+func (d *Drainer) Active() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// Drain will wait for the connections to finish until the context is done,
+// when any that are left are killed.  It returns how many connections finished
+// and how many were killed
+func (d *Drainer) Drain(ctx context.Context) (drained, killed int) {
+	start := d.Active()
+	defer d.kill()
+
+	for {
+		n := d.Active()
+		if n == 0 {
+			return start, 0
+		}
+
+		select {
+		case <-ctx.Done():
+			if drained = start - n; drained < 0 {
+				drained = 0
+			}
+			return drained, n
+		case <-d.changed:
+		}
+	}
+}
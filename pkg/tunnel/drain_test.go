@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainerLetsConnectionsFinish(t *testing.T) {
+	d := NewDrainer()
+	ctx, cancel := context.WithCancel(WithDrainer(context.Background(), d))
+
+	up1, up2 := net.Pipe()
+	down1, down2 := net.Pipe()
+	go bridge(ctx, up1, down1, "", "")
+
+	for d.Active() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the tunnels context being done shouldn't cut the connection
+	cancel()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		down2.Write([]byte("bye"))
+		down2.Close()
+	}()
+
+	buf := make([]byte, 3)
+	if _, err := up2.Read(buf); err != nil || string(buf) != "bye" {
+		t.Fatalf("expected the connection to still work while draining, got %q, %v", buf, err)
+	}
+
+	drainCtx, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+
+	drained, killed := d.Drain(drainCtx)
+	if drained != 1 || killed != 0 {
+		t.Errorf("expected 1 drained and 0 killed but got %d and %d", drained, killed)
+	}
+}
+
+func TestDrainerKillsConnectionsAfterDeadline(t *testing.T) {
+	d := NewDrainer()
+	ctx := WithDrainer(context.Background(), d)
+
+	up1, up2 := net.Pipe()
+	down1, _ := net.Pipe()
+	go bridge(ctx, up1, down1, "", "")
+
+	for d.Active() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	drainCtx, stop := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer stop()
+
+	drained, killed := d.Drain(drainCtx)
+	if drained != 0 || killed != 1 {
+		t.Errorf("expected 0 drained and 1 killed but got %d and %d", drained, killed)
+	}
+
+	up2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := up2.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("expected the connection to be closed but got %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/penguinpowernz/mole/pkg/sshutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// Enroll will connect to the mole server at the given address and use the
+// enrollment token to have the public key for the given private key authorized.
+// It returns a client for the server with the servers host key set, and any
+// tunnels the server included with the token
+func Enroll(addr, token, private string) (*Client, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(private))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %s", err)
+	}
+	pub := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	var hostKey ssh.PublicKey
+	sshcfg := &ssh.ClientConfig{
+		User: os.Getenv("USER"),
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+		Auth: []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i, q := range questions {
+					if q == sshutil.EnrollQuestion {
+						answers[i] = token
+					}
+				}
+				return answers, nil
+			}),
+		},
+	}
+
+	conn, err := ssh.Dial("tcp", addr, sshcfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ch, reqs, err := conn.OpenChannel(sshutil.EnrollChannelType, ssh.Marshal(sshutil.EnrollRequest{PublicKey: pub}))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+
+	data, err := ioutil.ReadAll(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	res := sshutil.EnrollResponse{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("bad enrollment response: %s", err)
+	}
+
+	if res.HostKey != "" {
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(res.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("bad host key in enrollment response: %s", err)
+		}
+		if hostKey == nil || string(k.Marshal()) != string(hostKey.Marshal()) {
+			return nil, errors.New("host key in enrollment response does not match the connection")
+		}
+	}
+
+	cl := &Client{}
+	if len(res.Config) > 0 {
+		if err := json.Unmarshal(res.Config, cl); err != nil {
+			return nil, fmt.Errorf("bad client config in enrollment response: %s", err)
+		}
+	}
+
+	cl.Address = addr
+	cl.Private = private
+	cl.Public = pub
+	cl.Host = res.HostKey
+	return cl, nil
+}
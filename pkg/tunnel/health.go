@@ -0,0 +1,358 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the kinds of health checks a tunnel can have
+const (
+	HealthTCP    = "tcp"
+	HealthHTTP   = "http"
+	HealthBanner = "banner"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+)
+
+// maxBannerSize is how much of the response is read when looking for the expected text
+const maxBannerSize = 4096
+
+// HealthCheck checks that the service a tunnel goes to is working, which is
+// the remote address for local tunnels and the local address for reverse ones
+type HealthCheck struct {
+	Type     string `json:"type,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+
+	// Path and Status are used by HTTP checks, any status below 400 is
+	// healthy if none is given
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status,omitempty"`
+
+	// Send is written and then Expect must be in what is read back for banner checks
+	Send   string `json:"send,omitempty"`
+	Expect string `json:"expect,omitempty"`
+
+	// Gate will only open the tunnel while it is healthy
+	Gate bool `json:"gate,omitempty"`
+}
+
+// HealthStatus is the result of the last health check of a tunnel
+type HealthStatus struct {
+	Healthy   bool       `json:"healthy"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// healthChecker runs the health check of a tunnel and keeps the result
+type healthChecker struct {
+	check    *HealthCheck
+	interval time.Duration
+	timeout  time.Duration
+
+	healthy   bool
+	lastCheck time.Time
+	lastError string
+	changed   chan struct{}
+	mu        *sync.Mutex
+}
+
+func newHealthChecker(hc *HealthCheck) (*healthChecker, error) {
+	switch hc.Type {
+	case "":
+		hc.Type = HealthTCP
+	case HealthTCP, HealthHTTP:
+	case HealthBanner:
+		if hc.Expect == "" {
+			return nil, errors.New("banner health checks need the text to expect")
+		}
+	default:
+		return nil, fmt.Errorf("unknown health check type: %s", hc.Type)
+	}
+
+	h := &healthChecker{
+		check:    hc,
+		interval: defaultHealthInterval,
+		timeout:  defaultHealthTimeout,
+		changed:  make(chan struct{}, 1),
+		mu:       new(sync.Mutex),
+	}
+
+	for _, d := range []struct {
+		s   string
+		dur *time.Duration
+	}{{hc.Interval, &h.interval}, {hc.Timeout, &h.timeout}} {
+		if d.s == "" {
+			continue
+		}
+
+		var err error
+		if *d.dur, err = time.ParseDuration(d.s); err != nil {
+			return nil, fmt.Errorf("invalid health check duration: %s", err)
+		}
+		if *d.dur <= 0 {
+			return nil, errors.New("health check durations must be more than 0")
+		}
+	}
+
+	return h, nil
+}
+
+// status will return the result of the last check
+func (h *healthChecker) status() *HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := &HealthStatus{Healthy: h.healthy, LastError: h.lastError}
+	if !h.lastCheck.IsZero() {
+		t := h.lastCheck
+		st.LastCheck = &t
+	}
+	return st
+}
+
+// isHealthy will return if the last check passed
+func (h *healthChecker) isHealthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy
+}
+
+// record will store the result of a check, returning true if the health changed
+func (h *healthChecker) record(err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	first := h.lastCheck.IsZero()
+	was := h.healthy
+	h.lastCheck = time.Now()
+	h.healthy = err == nil
+	h.lastError = ""
+	if err != nil {
+		h.lastError = err.Error()
+	}
+
+	if first || was != h.healthy {
+		select {
+		case h.changed <- struct{}{}:
+		default:
+		}
+		return true
+	}
+	return false
+}
+
+// waitHealthy will block until the last check passed, returning false if the
+// context was done first
+func (h *healthChecker) waitHealthy(ctx context.Context) bool {
+	for !h.isHealthy() {
+		select {
+		case <-h.changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// waitUnhealthy will return a channel that is closed once a check fails
+func (h *healthChecker) waitUnhealthy(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		for h.isHealthy() {
+			select {
+			case <-h.changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// runHealthCheck will check the health of the tunnel every interval until the
+// context is done
+func (tun *Tunnel) runHealthCheck(ctx context.Context, conn SSHConn) {
+	// checks shouldn't keep an on demand client connected
+	oc, onDemand := conn.(onDemandConn)
+
+	t := time.NewTicker(tun.health.interval)
+	defer t.Stop()
+
+	for {
+		check, ok := conn, true
+		if onDemand {
+			check, ok = oc.connection()
+		}
+
+		if ok {
+			tun.recordHealth(tun.checkHealth(check))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// recordHealth will store the result of a check, letting everyone know if it changed
+func (tun *Tunnel) recordHealth(err error) {
+	ev := tun.dispatcher()
+	if !tun.health.record(err) || ev == nil {
+		return
+	}
+
+	if err != nil {
+		ev.Go("log", fmt.Sprintf("tunnel %s is unhealthy: %s", tun.Name(), err))
+		ev.Go("tunnel.unhealthy", tun, err)
+		return
+	}
+
+	ev.Go("log", fmt.Sprintf("tunnel %s is healthy", tun.Name()))
+	ev.Go("tunnel.healthy", tun)
+}
+
+// checkHealth will run the health check once.  Balanced tunnels are healthy
+// if any of their targets are, and the ones that aren't are marked as down
+func (tun *Tunnel) checkHealth(conn SSHConn) error {
+	switch {
+	case tun.Reverse:
+		return tun.health.run(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", tun.Local, tun.health.timeout)
+		}, tun.Local)
+
+	case tun.balancer != nil:
+		var err error
+		healthy := false
+		for _, t := range tun.balancer.targets {
+			c := conn
+			if t.via != nil {
+				c = t.via
+			}
+
+			terr := tun.health.run(func() (net.Conn, error) { return c.Dial("tcp", t.Remote) }, t.Remote)
+			tun.balancer.setDown(t, terr != nil)
+			if terr != nil {
+				err = fmt.Errorf("%s: %s", t.Remote, terr)
+				continue
+			}
+			healthy = true
+		}
+
+		if healthy {
+			return nil
+		}
+		return err
+
+	default:
+		return tun.health.run(func() (net.Conn, error) { return conn.Dial("tcp", tun.Remote) }, tun.Remote)
+	}
+}
+
+// run will dial using the given func and check the service, giving up after
+// the timeout as connections through SSH don't support deadlines
+func (h *healthChecker) run(dial func() (net.Conn, error), addr string) error {
+	res := make(chan error, 1)
+	var mu sync.Mutex
+	var conn net.Conn
+	timedOut := false
+
+	go func() {
+		c, err := dial()
+		if err != nil {
+			res <- err
+			return
+		}
+
+		mu.Lock()
+		conn = c
+		if timedOut {
+			c.Close()
+		}
+		mu.Unlock()
+
+		defer c.Close()
+		res <- h.probe(c, addr)
+	}()
+
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(h.timeout):
+		mu.Lock()
+		timedOut = true
+		if conn != nil {
+			conn.Close()
+		}
+		mu.Unlock()
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+}
+
+// probe will check the service on the connection
+func (h *healthChecker) probe(c net.Conn, addr string) error {
+	switch h.check.Type {
+	case HealthHTTP:
+		path := h.check.Path
+		if path == "" {
+			path = "/"
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "mole-health-check")
+		req.Close = true
+
+		if err := req.Write(c); err != nil {
+			return err
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		if (h.check.Status != 0 && res.StatusCode != h.check.Status) || (h.check.Status == 0 && res.StatusCode >= 400) {
+			return fmt.Errorf("unexpected status %s", res.Status)
+		}
+		return nil
+
+	case HealthBanner:
+		if h.check.Send != "" {
+			if _, err := c.Write([]byte(h.check.Send)); err != nil {
+				return err
+			}
+		}
+
+		buf := make([]byte, 0, maxBannerSize)
+		for len(buf) < maxBannerSize {
+			n, err := c.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if bytes.Contains(buf, []byte(h.check.Expect)) {
+				return nil
+			}
+			if err != nil {
+				break
+			}
+		}
+		return fmt.Errorf("expected %q but got %q", h.check.Expect, buf)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+)
+
+func TestHealthChecks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("SSH-2.0-test\r\n"))
+			c.Close()
+		}
+	}()
+
+	tests := []struct {
+		local   string
+		check   HealthCheck
+		healthy bool
+	}{
+		{addr, HealthCheck{}, true},
+		{addr, HealthCheck{Type: HealthHTTP, Path: "/healthz"}, true},
+		{addr, HealthCheck{Type: HealthHTTP}, false},
+		{addr, HealthCheck{Type: HealthHTTP, Status: 404}, true},
+		{l.Addr().String(), HealthCheck{Type: HealthBanner, Expect: "SSH-2.0"}, true},
+		{l.Addr().String(), HealthCheck{Type: HealthBanner, Expect: "220 "}, false},
+		{"127.0.0.1:1", HealthCheck{}, false},
+	}
+
+	for i, tc := range tests {
+		check := tc.check
+		tun, err := NewTunnelFromOpts(Local(tc.local), Remote("0"), Reverse(), func(tun *Tunnel) error {
+			tun.Health = &check
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tun.recordHealth(tun.checkHealth(nil))
+		if st := tun.Status().Health; st.Healthy != tc.healthy {
+			t.Errorf("%d: expected healthy to be %v but got %+v", i, tc.healthy, st)
+		}
+	}
+
+	if _, err := newHealthChecker(&HealthCheck{Type: HealthBanner}); err == nil {
+		t.Error("expected a banner check without the text to expect to be invalid")
+	}
+}
+
+// switchConn dials a pipe while the service it goes to is up
+type switchConn struct {
+	up int32
+}
+
+func (c *switchConn) Dial(n, a string) (net.Conn, error) {
+	if atomic.LoadInt32(&c.up) == 0 {
+		return nil, errors.New("connection refused")
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (c *switchConn) Listen(n, a string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestKeepOpenGatedByHealth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tun, err := NewTunnelFromOpts(Local(addr), Remote("service:80"), func(tun *Tunnel) error {
+		tun.Health = &HealthCheck{Interval: "50ms", Gate: true}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := &switchConn{}
+	go tun.KeepOpen(ctx, conn, event.New())
+
+	listening := func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+
+	waitFor := func(want bool, msg string) {
+		deadline := time.Now().Add(3 * time.Second)
+		for listening() != want {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if listening() {
+		t.Fatal("expected the tunnel not to be opened while the service is down")
+	}
+
+	atomic.StoreInt32(&conn.up, 1)
+	waitFor(true, "expected the tunnel to be opened once the service is healthy")
+
+	atomic.StoreInt32(&conn.up, 0)
+	waitFor(false, "expected the tunnel to be closed once the service is unhealthy")
+
+	atomic.StoreInt32(&conn.up, 1)
+	waitFor(true, "expected the tunnel to be opened again once the service recovers")
+}
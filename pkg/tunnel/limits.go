@@ -0,0 +1,165 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// contextKeyLimits holds the connection limits of the tunnel and its client
+var contextKeyLimits = contextKey("limits")
+
+// defaultQueueTimeout is how long a connection waits in the queue when no timeout is given
+const defaultQueueTimeout = 10 * time.Second
+
+var (
+	errTooManyConns = errors.New("too many connections")
+	errQueueTimeout = errors.New("timed out waiting for a free connection")
+)
+
+// connLimiter limits how many connections can go through a tunnel or client at
+// once, with the ones over the limit waiting in a queue for a free slot, and
+// how fast new connections are accepted
+type connLimiter struct {
+	slots   chan struct{}
+	queue   int64
+	timeout time.Duration
+	waiting int64
+	accepts *bucket
+}
+
+// newConnLimiter will parse the limits, returning nil if there aren't any
+func newConnLimiter(max, queue int, timeout string, acceptRate float64) (*connLimiter, error) {
+	if max < 0 || queue < 0 || acceptRate < 0 {
+		return nil, errors.New("connection limits can't be negative")
+	}
+
+	if queue > 0 && max == 0 {
+		return nil, errors.New("a connection queue needs max_connections")
+	}
+
+	if max == 0 && acceptRate == 0 {
+		return nil, nil
+	}
+
+	l := &connLimiter{queue: int64(queue), timeout: defaultQueueTimeout, accepts: newBucket(acceptRate, 0)}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid queue timeout: %s", err)
+		}
+		if d <= 0 {
+			return nil, errors.New("invalid queue timeout: must be more than 0")
+		}
+		l.timeout = d
+	}
+
+	return l, nil
+}
+
+// acquire will take a slot for a connection, waiting in the queue for one to
+// be released if they are all taken and there is room in it
+func (l *connLimiter) acquire(ctx context.Context) error {
+	if l == nil || l.slots == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt64(&l.waiting, 1) > l.queue {
+		atomic.AddInt64(&l.waiting, -1)
+		return errTooManyConns
+	}
+	defer atomic.AddInt64(&l.waiting, -1)
+
+	t := time.NewTimer(l.timeout)
+	defer t.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		return errQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release will free the slot of a connection that is done
+func (l *connLimiter) release() {
+	if l != nil && l.slots != nil {
+		<-l.slots
+	}
+}
+
+// queued will return how many connections are waiting for a slot
+func (l *connLimiter) queued() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.waiting)
+}
+
+// connLimits are the limiters that apply to the connections of a tunnel
+type connLimits []*connLimiter
+
+// withConnLimits will return a context that makes the strategies limit their
+// connections with the limits of the tunnel and of its client
+func withConnLimits(ctx context.Context, tun, client *connLimiter) context.Context {
+	if tun == nil && client == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyLimits, connLimits{tun, client})
+}
+
+// throttleAccepts will wait until another connection can be accepted by the
+// tunnel in the context without going over the accept rate
+func throttleAccepts(ctx context.Context) {
+	limits, _ := ctx.Value(contextKeyLimits).(connLimits)
+
+	buckets := []*bucket{}
+	for _, l := range limits {
+		if l != nil && l.accepts != nil {
+			buckets = append(buckets, l.accepts)
+		}
+	}
+	wait(buckets, 1)
+}
+
+// admit will wait for the connection to get a slot in the tunnel in the
+// context and in its client, returning a func to release them once it is done.
+// If it can't get them the connection is closed and counted as rejected
+func admit(ctx context.Context, conn net.Conn, peer net.Addr, to string) (func(), bool) {
+	limits, _ := ctx.Value(contextKeyLimits).(connLimits)
+
+	for i, l := range limits {
+		if err := l.acquire(ctx); err != nil {
+			for _, held := range limits[:i] {
+				held.release()
+			}
+
+			reject(conn)
+			connTrackerOf(ctx).rejected()
+			log.Printf("rejected connection from %s to %s: %s", peer, to, err)
+			return nil, false
+		}
+	}
+
+	return func() {
+		for _, l := range limits {
+			l.release()
+		}
+	}, true
+}
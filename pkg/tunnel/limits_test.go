@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterQueue(t *testing.T) {
+	l, err := newConnLimiter(1, 1, "100ms", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := l.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second one waits in the queue and the third is rejected
+	got := make(chan error)
+	go func() { got <- l.acquire(ctx) }()
+
+	time.Sleep(20 * time.Millisecond)
+	if q := l.queued(); q != 1 {
+		t.Errorf("expected 1 connection to be queued but got %d", q)
+	}
+
+	if err := l.acquire(ctx); err != errTooManyConns {
+		t.Errorf("expected the queue to be full but got %v", err)
+	}
+
+	l.release()
+	if err := <-got; err != nil {
+		t.Errorf("expected the queued connection to get the slot but got %v", err)
+	}
+
+	if err := l.acquire(ctx); err != errQueueTimeout {
+		t.Errorf("expected the queued connection to time out but got %v", err)
+	}
+
+	if q := l.queued(); q != 0 {
+		t.Errorf("expected the queue to be empty but got %d", q)
+	}
+
+	if _, err := newConnLimiter(0, 5, "", 0); err == nil {
+		t.Error("expected a queue without a max to fail")
+	}
+}
+
+func TestAdmitReleasesTunnelSlotWhenClientIsFull(t *testing.T) {
+	tun, _ := newConnLimiter(2, 0, "", 0)
+	client, _ := newConnLimiter(1, 0, "", 0)
+
+	tr := newConnTracker()
+	ctx := withConnLimits(withConnTracker(context.Background(), tr), tun, client)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	release, ok := admit(ctx, c1, &net.TCPAddr{}, "localhost:80")
+	if !ok {
+		t.Fatal("expected the first connection to be admitted")
+	}
+
+	if _, ok := admit(ctx, c1, &net.TCPAddr{}, "localhost:80"); ok {
+		t.Fatal("expected the second connection to be rejected by the client")
+	}
+
+	if n := len(tun.slots); n != 1 {
+		t.Errorf("expected the tunnel slot of the rejected connection to be released but %d are held", n)
+	}
+
+	if st := tr.Stats(); st.Rejected != 1 {
+		t.Errorf("expected the rejection to be counted but got %+v", st)
+	}
+
+	release()
+	if len(tun.slots) != 0 || len(client.slots) != 0 {
+		t.Error("expected all the slots to be released")
+	}
+}
+
+func TestThrottleAccepts(t *testing.T) {
+	l, err := newConnLimiter(0, 0, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := withConnLimits(context.Background(), l, nil)
+
+	// the first 10 go straight away and the next 5 take half a second
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		throttleAccepts(ctx)
+	}
+
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("expected 15 accepts to take about 500ms but they took %s", d)
+	}
+}
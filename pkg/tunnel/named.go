@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardedTCPPayload is the extra data for a forwarded-tcpip channel as specified in RFC4254, Section 7.2
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// forwardRequest is the payload of a tcpip-forward request as specified in RFC4254, Section 7.1
+type forwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// isNamedHost will return true if the host is a name instead of an IP, which
+// the SSH library can't do reverse forwards for
+func isNamedHost(host string) bool {
+	return host != "" && host != "localhost" && net.ParseIP(host) == nil
+}
+
+// namedAddr is the address of a reverse forward for a name
+type namedAddr struct {
+	host string
+	port uint32
+}
+
+func (a namedAddr) Network() string { return "tcp" }
+func (a namedAddr) String() string  { return net.JoinHostPort(a.host, strconv.Itoa(int(a.port))) }
+
+// namedListener is a reverse forward for a name instead of an IP, like the
+// virtual hosts on moled, the connections to it are sent by the client
+type namedListener struct {
+	cl    *Client
+	addr  namedAddr
+	chans chan ssh.NewChannel
+	done  chan struct{}
+	once  sync.Once
+}
+
+// listenNamed will ask the server to forward connections for the named address
+func (cl *Client) listenNamed(host string, port int) (net.Listener, error) {
+	addr := namedAddr{host: host, port: uint32(port)}
+
+	ok, resp, err := cl.ssh.SendRequest("tcpip-forward", true, ssh.Marshal(&forwardRequest{host, addr.port}))
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		if len(resp) > 0 {
+			return nil, fmt.Errorf("ssh: tcpip-forward request denied by peer: %s", resp)
+		}
+		return nil, errors.New("ssh: tcpip-forward request denied by peer")
+	}
+
+	l := &namedListener{cl: cl, addr: addr, chans: make(chan ssh.NewChannel), done: make(chan struct{})}
+
+	cl.namedMu.Lock()
+	cl.named[addr.String()] = l
+	cl.namedMu.Unlock()
+
+	return l, nil
+}
+
+// handleNamedForwards will pass the forwarded channels for named addresses to
+// their listeners, any other channels are passed on to the SSH client
+func (cl *Client) handleNamedForwards(in <-chan ssh.NewChannel) <-chan ssh.NewChannel {
+	out := make(chan ssh.NewChannel)
+	go func() {
+		defer close(out)
+		for ch := range in {
+			p := forwardedTCPPayload{}
+			if ch.ChannelType() != "forwarded-tcpip" || ssh.Unmarshal(ch.ExtraData(), &p) != nil || !isNamedHost(p.Addr) {
+				out <- ch
+				continue
+			}
+
+			cl.namedMu.Lock()
+			l, found := cl.named[namedAddr{p.Addr, p.Port}.String()]
+			cl.namedMu.Unlock()
+
+			if !found {
+				ch.Reject(ssh.ConnectionFailed, "no forward for "+p.Addr)
+				continue
+			}
+
+			select {
+			case l.chans <- ch:
+			case <-l.done:
+				ch.Reject(ssh.ConnectionFailed, "the forward was closed")
+			}
+		}
+	}()
+	return out
+}
+
+// Accept will wait for and return the next connection to the forward
+func (l *namedListener) Accept() (net.Conn, error) {
+	var newCh ssh.NewChannel
+	select {
+	case newCh = <-l.chans:
+	case <-l.done:
+		return nil, io.EOF
+	}
+
+	p := forwardedTCPPayload{}
+	ssh.Unmarshal(newCh.ExtraData(), &p)
+
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+
+	var origin net.Addr = namedAddr{p.OriginAddr, p.OriginPort}
+	if ip := net.ParseIP(p.OriginAddr); ip != nil {
+		origin = &net.TCPAddr{IP: ip, Port: int(p.OriginPort)}
+	}
+
+	return &chanConn{Channel: ch, laddr: l.addr, raddr: origin}, nil
+}
+
+// Close will cancel the forward on the server
+func (l *namedListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+
+		l.cl.namedMu.Lock()
+		delete(l.cl.named, l.addr.String())
+		l.cl.namedMu.Unlock()
+
+		var ok bool
+		ok, _, err = l.cl.ssh.SendRequest("cancel-tcpip-forward", true, ssh.Marshal(&forwardRequest{l.addr.host, l.addr.port}))
+		if err == nil && !ok {
+			err = errors.New("ssh: cancel-tcpip-forward failed")
+		}
+	})
+	return err
+}
+
+// Addr will return the named address of the forward
+func (l *namedListener) Addr() net.Addr {
+	return l.addr
+}
+
+// chanConn is a connection over an SSH channel
+type chanConn struct {
+	ssh.Channel
+	laddr, raddr net.Addr
+}
+
+func (c *chanConn) LocalAddr() net.Addr                { return c.laddr }
+func (c *chanConn) RemoteAddr() net.Addr               { return c.raddr }
+func (c *chanConn) SetDeadline(t time.Time) error      { return nil }
+func (c *chanConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *chanConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,208 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultIdleTimeout is how long an on demand client stays connected without
+// any connections going through its tunnels
+const DefaultIdleTimeout = 5 * time.Minute
+
+// onDemandConnectTimeout is how long a connection waits for an on demand
+// client to connect when no timeout is set for the client
+const onDemandConnectTimeout = 30 * time.Second
+
+var errReverseOnDemand = errors.New("reverse tunnels can't be opened on demand")
+
+// onDemand holds the state of a client that only connects when its tunnels are
+// used, which is guarded by the client lock along with the connection
+type onDemand struct {
+	idle     time.Duration
+	lastUsed time.Time
+}
+
+// onDemandConn will connect the client when a tunnel dials through it, unless
+// the client couldn't be setup
+type onDemandConn struct {
+	ctx context.Context
+	cl  *Client
+	ev  event.Dispatcher
+	err error
+}
+
+// Dial will connect the client if it isn't already connected and dial the remote
+// address through it, so connections are queued until the client has connected
+func (c onDemandConn) Dial(n, a string) (net.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	conn, err := c.cl.connectOnDemand(c.ctx, c.ev)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Dial(n, a)
+}
+
+// connection will return the SSH connection without connecting it, returning
+// false if the client isn't connected
+func (c onDemandConn) connection() (SSHConn, bool) {
+	if c.err != nil {
+		return nil, false
+	}
+
+	c.cl.mu.Lock()
+	defer c.cl.mu.Unlock()
+	return c.cl.ssh, c.cl.connected
+}
+
+// Listen will always fail as the client is only connected when something is dialed
+func (c onDemandConn) Listen(n, a string) (net.Listener, error) {
+	return nil, errReverseOnDemand
+}
+
+// parseIdleTimeout will parse the idle timeout, returning the default if it is empty
+func parseIdleTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultIdleTimeout, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("must be more than 0")
+	}
+	return d, err
+}
+
+// openOnDemand will open the tunnel without connecting the client, which is
+// connected when the first connection comes in to the tunnel.  The client is
+// setup before the tunnel listens so that the connections never race to do it,
+// and if that fails the tunnel still listens but the connections are dropped
+func (cl *Client) openOnDemand(ctx context.Context, tun *Tunnel, ev event.Dispatcher) {
+	if tun.Reverse {
+		ev.Go("error", fmt.Errorf("can't open %s: %s", tun.Name(), errReverseOnDemand))
+		return
+	}
+
+	err := cl.init()
+	if err != nil {
+		ev.Go("error", err)
+	}
+
+	cl.adopt(tun)
+	tun.startTargets(ctx, ev)
+	go tun.KeepOpen(ctx, onDemandConn{ctx, cl, ev, err}, ev)
+}
+
+// connectOnDemand will return the SSH connection, connecting it first if needed
+func (cl *Client) connectOnDemand(ctx context.Context, ev event.Dispatcher) (*ssh.Client, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.demand.lastUsed = time.Now()
+
+	if cl.connected {
+		return cl.ssh, nil
+	}
+
+	if cl.sshcfg.Timeout == 0 {
+		cl.sshcfg.Timeout = onDemandConnectTimeout
+	}
+
+	cl.events = ev
+	ev.Go("log", fmt.Sprintf("connecting to %s on demand", cl.Address))
+	if err := cl.Connect(); err != nil {
+		cl.state.update(func(st *clientState) { st.lastError = err.Error() })
+		err = fmt.Errorf("failed to connect to %s: %s", cl.Address, err)
+		ev.Go("error", err)
+		return nil, err
+	}
+
+	conn := cl.ssh
+	cl.connected = true
+	cl.state.update(func(st *clientState) {
+		st.connected = true
+		st.lastConnect = time.Now()
+		st.lastError = ""
+	})
+
+	done := make(chan struct{})
+	go cl.measureRTT(conn)
+	go cl.closeWhenIdle(connContext(ctx), conn, done)
+	go func() {
+		err := conn.Wait()
+		close(done)
+
+		// it was already marked as disconnected if it was closed for being idle
+		cl.mu.Lock()
+		dropped := cl.ssh == conn && cl.connected
+		if dropped {
+			cl.connected = false
+		}
+		cl.mu.Unlock()
+
+		cl.state.update(func(st *clientState) {
+			st.connected = false
+			st.lastDisconnect = time.Now()
+			if dropped && err != nil {
+				st.lastError = err.Error()
+			}
+		})
+		if dropped && err != nil {
+			ev.Go("error", fmt.Errorf("client %s disconnected: %s", cl.Address, err))
+		}
+		ev.Go("client.disconnected", cl)
+	}()
+
+	ev.Go("log", "client "+cl.Address+" was connected")
+	ev.Go("client.connected", cl)
+	return conn, nil
+}
+
+// closeWhenIdle will close the SSH connection once none of the tunnels have had
+// connections going through them for the idle timeout, or the context is done
+func (cl *Client) closeWhenIdle(ctx context.Context, conn *ssh.Client, done chan struct{}) {
+	interval := cl.demand.idle / 4
+	if interval > 5*time.Second {
+		interval = 5 * time.Second
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			conn.Close()
+			return
+		case <-t.C:
+		}
+
+		var active int64
+		for _, tun := range cl.Tunnels {
+			active += tun.Stats().Active
+		}
+
+		cl.mu.Lock()
+		if active > 0 {
+			cl.demand.lastUsed = time.Now()
+		}
+
+		if time.Since(cl.demand.lastUsed) >= cl.demand.idle {
+			cl.events.Go("log", fmt.Sprintf("disconnecting from %s after being idle for %s", cl.Address, cl.demand.idle))
+			cl.connected = false
+			conn.Close()
+			cl.mu.Unlock()
+			return
+		}
+		cl.mu.Unlock()
+	}
+}
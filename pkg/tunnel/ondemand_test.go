@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+)
+
+func TestOnDemandListensBeforeConnecting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tun, _ := NewTunnelFromOpts(Local(addr), Remote("localhost:80"))
+	rev, _ := NewTunnelFromOpts(Local("3000"), Remote("0"), Reverse())
+	cl := &Client{Address: "127.0.0.1:1", OnDemand: true, Tunnels: []*Tunnel{tun, rev}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 10)
+	ev := event.New()
+	ev.On("error", func(err error) error {
+		errs <- err
+		return nil
+	})
+	cl.OpenTunnels(ctx, ev)
+
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("expected the reverse tunnel not to be opened")
+	}
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the tunnel to listen without connecting: %s", err)
+	}
+	defer conn.Close()
+
+	// the client has no key so it fails to connect and drops the connection
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+
+	if st := tun.Stats(); st.Accepted != 1 || st.FailedDials != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	if cl.Status().Connected {
+		t.Error("expected the client not to be connected")
+	}
+}
+
+func TestOnDemandConnectsOnceAndDisconnectsWhenIdle(t *testing.T) {
+	svr := startTestServer(t)
+	echo := startEchoServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tun, _ := NewTunnelFromOpts(Local(addr), Remote(echo.Addr().String()))
+	cl := &Client{Address: svr.Addr().String(), Private: newTestKey(t), OnDemand: true, IdleTimeout: "200ms", Tunnels: []*Tunnel{tun}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl.OpenTunnels(ctx, event.New())
+
+	dial := func() net.Conn {
+		var conn net.Conn
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("tcp", addr); err == nil {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("failed to connect to the tunnel: %s", err)
+		return nil
+	}
+
+	// the connections are queued while the client connects, which it only does once
+	conns := make([]net.Conn, 5)
+	for i := range conns {
+		conns[i] = dial()
+	}
+
+	for i, conn := range conns {
+		msg := []byte{byte('a' + i)}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(msg)
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != msg[0] {
+			t.Fatalf("expected %q to be echoed back but got %q and %v", msg, buf, err)
+		}
+		conn.Close()
+	}
+
+	if n := svr.Handshakes(); n != 1 {
+		t.Fatalf("expected the client to connect once but it connected %d times", n)
+	}
+
+	connected := func() (yes bool) {
+		cl.state.update(func(st *clientState) { yes = st.connected })
+		return
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client to disconnect after being idle")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// and it connects again for the next connection
+	conn := dial()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("z"))
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatalf("expected the connection to be echoed after reconnecting: %s", err)
+	}
+
+	if n := svr.Handshakes(); n != 2 {
+		t.Errorf("expected the client to connect again but it connected %d times", n)
+	}
+}
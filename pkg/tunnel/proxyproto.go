@@ -0,0 +1,30 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+
+	"github.com/penguinpowernz/mole/pkg/proxyproto"
+)
+
+// contextKeyProxyProtocol holds the PROXY protocol version the tunnel sends
+var contextKeyProxyProtocol = contextKey("proxy_protocol")
+
+func withProxyProtocol(ctx context.Context, version string) context.Context {
+	if version == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyProxyProtocol, version)
+}
+
+// sendProxyHeader will write a PROXY protocol header to the connection going to
+// the service, with the address of the peer that connected to the tunnel, if the
+// tunnel in the context has it turned on
+func sendProxyHeader(ctx context.Context, conn net.Conn, peer, dest net.Addr) error {
+	version, _ := ctx.Value(contextKeyProxyProtocol).(string)
+	if version == "" {
+		return nil
+	}
+
+	return proxyproto.Header{Version: version, Source: peer, Destination: dest}.Write(conn)
+}
@@ -0,0 +1,262 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+)
+
+// QuotaStatus is how much of its quotas a tunnel has used
+type QuotaStatus struct {
+	Daily       int64      `json:"daily,omitempty"`
+	Monthly     int64      `json:"monthly,omitempty"`
+	DailyUsed   int64      `json:"daily_used"`
+	MonthlyUsed int64      `json:"monthly_used"`
+	Exceeded    bool       `json:"exceeded"`
+	ResetsAt    *time.Time `json:"resets_at,omitempty"`
+}
+
+// quotaUsage is what is kept on disk for each tunnel
+type quotaUsage struct {
+	Day        string `json:"day"`
+	Month      string `json:"month"`
+	DayBytes   int64  `json:"day_bytes"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// quota counts the bytes going through a tunnel against its daily and monthly
+// quotas, which start again at midnight and on the first of the month
+type quota struct {
+	daily   int64
+	monthly int64
+	usage   quotaUsage
+
+	// hit is closed when the quota is used up, and replaced when it resets
+	hit    chan struct{}
+	closed bool
+	now    func() time.Time
+	mu     *sync.Mutex
+}
+
+func newQuota(daily, monthly int64) *quota {
+	return &quota{daily: daily, monthly: monthly, hit: make(chan struct{}), now: time.Now, mu: new(sync.Mutex)}
+}
+
+// update will start the counts again if the day or month changed, and close
+// or replace the hit channel if the quota was used up or reset.  It must be
+// called with the lock held
+func (q *quota) update() {
+	now := q.now()
+	if day := now.Format("2006-01-02"); q.usage.Day != day {
+		q.usage.Day, q.usage.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); q.usage.Month != month {
+		q.usage.Month, q.usage.MonthBytes = month, 0
+	}
+
+	over := q.over()
+	switch {
+	case over && !q.closed:
+		close(q.hit)
+		q.closed = true
+	case !over && q.closed:
+		q.hit = make(chan struct{})
+		q.closed = false
+	}
+}
+
+func (q *quota) over() bool {
+	return (q.daily > 0 && q.usage.DayBytes >= q.daily) || (q.monthly > 0 && q.usage.MonthBytes >= q.monthly)
+}
+
+// add will count the bytes against the quota
+func (q *quota) add(n int) {
+	if q == nil || n <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.update()
+	q.usage.DayBytes += int64(n)
+	q.usage.MonthBytes += int64(n)
+	q.update()
+}
+
+// exceeded will return true if the quota is used up
+func (q *quota) exceeded() bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.update()
+	return q.closed
+}
+
+// hitChan will return a channel that is closed once the quota is used up
+func (q *quota) hitChan() <-chan struct{} {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.update()
+	return q.hit
+}
+
+// resetAt will return when the quota that is used up starts again
+func (q *quota) resetAt() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.resetTime()
+}
+
+func (q *quota) resetTime() time.Time {
+	now := q.now()
+	y, m, d := now.Date()
+	if q.monthly > 0 && q.usage.MonthBytes >= q.monthly {
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
+// status will return how much of the quota has been used
+func (q *quota) status() *QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.update()
+
+	st := &QuotaStatus{
+		Daily:       q.daily,
+		Monthly:     q.monthly,
+		DailyUsed:   q.usage.DayBytes,
+		MonthlyUsed: q.usage.MonthBytes,
+		Exceeded:    q.closed,
+	}
+	if q.closed {
+		t := q.resetTime()
+		st.ResetsAt = &t
+	}
+	return st
+}
+
+// load will set the usage from what was kept on disk
+func (q *quota) load(u quotaUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage = u
+	q.update()
+}
+
+// snapshot will return the usage to keep on disk
+func (q *quota) snapshot() quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.update()
+	return q.usage
+}
+
+// QuotaFile will return the file that the usage of the tunnel quotas is kept
+// in, which is next to the config file
+func (cfg *Config) QuotaFile() string {
+	if cfg.Filename == "" {
+		return ""
+	}
+	return cfg.Filename + ".quota"
+}
+
+// quotas will return the quotas of the tunnels by a key that stays the same
+// across restarts
+func (cfg *Config) quotas() map[string]*quota {
+	qs := map[string]*quota{}
+	for _, cl := range cfg.Clients {
+		for _, tun := range cl.Tunnels {
+			if tun.quota == nil {
+				continue
+			}
+
+			dir := "L"
+			if tun.Reverse {
+				dir = "R"
+			}
+			qs[strings.Join([]string{cl.Address, dir, tun.Local, tun.configuredRemote()}, " ")] = tun.quota
+		}
+	}
+	return qs
+}
+
+// LoadQuotas will load how much of their quotas the tunnels have used from
+// the quota file, if there is one
+func (cfg *Config) LoadQuotas() error {
+	qs := cfg.quotas()
+	if len(qs) == 0 || cfg.QuotaFile() == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.QuotaFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	usage := map[string]quotaUsage{}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return err
+	}
+
+	for k, q := range qs {
+		if u, ok := usage[k]; ok {
+			q.load(u)
+		}
+	}
+	return nil
+}
+
+// SaveQuotas will save how much of their quotas the tunnels have used to the
+// quota file
+func (cfg *Config) SaveQuotas() error {
+	qs := cfg.quotas()
+	if len(qs) == 0 || cfg.QuotaFile() == "" {
+		return nil
+	}
+
+	usage := map[string]quotaUsage{}
+	for k, q := range qs {
+		usage[k] = q.snapshot()
+	}
+
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg.QuotaFile(), data)
+}
+
+// SaveQuotasEvery will save the quotas every interval until the context is done
+func (cfg *Config) SaveQuotasEvery(ctx context.Context, interval time.Duration, ev event.Dispatcher) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := cfg.SaveQuotas(); err != nil {
+				ev.Go("error", fmt.Errorf("failed to save the quotas: %s", err))
+			}
+		}
+	}
+}
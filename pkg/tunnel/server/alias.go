@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// errAliasNotAllowed is returned when a key isn't allowed to connect to an alias
+var errAliasNotAllowed = errors.New("not allowed to connect to that alias")
+
+// AliasConfig is the config for an alias, a name that one client can forward
+// from so that other clients can connect to it with a local port forward, without
+// a port being opened on the server
+type AliasConfig struct {
+	// Owners are the fingerprints of the keys that can forward from the alias
+	Owners []string `json:"owners"`
+
+	// Allow are the fingerprints of the keys that can connect to the alias,
+	// with "*" allowing any authorized key
+	Allow []string `json:"allow"`
+}
+
+// alias will return the config of the alias with the given name
+func (cfg Config) alias(name string) (AliasConfig, bool) {
+	for n, ac := range cfg.Aliases {
+		if strings.EqualFold(n, name) {
+			return ac, true
+		}
+	}
+	return AliasConfig{}, false
+}
+
+// canServe will return true if the key with the given fingerprint can forward from the alias
+func (ac AliasConfig) canServe(fp string) bool {
+	return fp != "" && hasName(ac.Owners, fp)
+}
+
+// canConnect will return true if the key with the given fingerprint can connect to the alias
+func (ac AliasConfig) canConnect(fp string) bool {
+	return fp != "" && (hasName(ac.Allow, fp) || hasName(ac.Allow, "*"))
+}
+
+// validateAliases will return an error if an alias is also a host used by the fronts
+func (cfg Config) validateAliases() error {
+	for name := range cfg.Aliases {
+		if _, ok := cfg.HTTP.nameOf(name); ok || cfg.SNI.known(name) {
+			return fmt.Errorf("the alias %s is also used by the HTTP or TLS front", name)
+		}
+
+		if net.ParseIP(name) != nil || strings.EqualFold(name, "localhost") {
+			return fmt.Errorf("the alias %s must be a name, not an address", name)
+		}
+	}
+	return nil
+}
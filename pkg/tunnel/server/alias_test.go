@@ -0,0 +1,43 @@
+package server
+
+import "testing"
+
+func TestAliasConfig(t *testing.T) {
+	cfg := Config{
+		Aliases: map[string]AliasConfig{
+			"db": {Owners: []string{"SHA256:alice"}, Allow: []string{"SHA256:bob"}},
+			"ci": {Owners: []string{"SHA256:bob"}, Allow: []string{"*"}},
+		},
+	}
+
+	db, ok := cfg.alias("DB")
+	if !ok {
+		t.Fatal("expected to find the alias db")
+	}
+
+	if !db.canServe("SHA256:alice") || db.canServe("SHA256:bob") {
+		t.Error("expected only alice to be able to serve db")
+	}
+
+	if !db.canConnect("SHA256:bob") || db.canConnect("SHA256:carol") {
+		t.Error("expected only bob to be able to connect to db")
+	}
+
+	ci, _ := cfg.alias("ci")
+	if !ci.canConnect("SHA256:carol") || ci.canConnect("") {
+		t.Error("expected any key to be able to connect to ci")
+	}
+
+	if _, ok := cfg.alias("web"); ok {
+		t.Error("expected web not to be an alias")
+	}
+
+	if err := cfg.validateAliases(); err != nil {
+		t.Error(err)
+	}
+
+	cfg.Aliases["127.0.0.1"] = AliasConfig{}
+	if err := cfg.validateAliases(); err == nil {
+		t.Error("expected an alias that is an IP to be invalid")
+	}
+}
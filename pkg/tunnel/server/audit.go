@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditAuthSuccess   = "auth.success"
+	AuditAuthFailure   = "auth.failure"
+	AuditSessionStart  = "session.start"
+	AuditSessionEnd    = "session.end"
+	AuditDirectTCPIP   = "channel.direct_tcpip"
+	AuditForwardBind   = "forward.bind"
+	AuditForwardCancel = "forward.cancel"
+)
+
+// AuditConfig is the config for the audit log, if neither a file or
+// syslog is enabled then the audit events are only logged
+type AuditConfig struct {
+	File          string `json:"file,omitempty"`
+	MaxSizeMB     int    `json:"max_size_mb,omitempty"`
+	MaxBackups    int    `json:"max_backups,omitempty"`
+	Syslog        bool   `json:"syslog,omitempty"`
+	SyslogTag     string `json:"syslog_tag,omitempty"`
+	SyslogNetwork string `json:"syslog_network,omitempty"`
+	SyslogAddress string `json:"syslog_address,omitempty"`
+}
+
+// AuditEvent is a single entry in the audit log
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Session     string    `json:"session,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Origin      string    `json:"origin,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Bind        string    `json:"bind,omitempty"`
+	DurationMS  int64     `json:"duration_ms,omitempty"`
+	BytesIn     int64     `json:"bytes_in,omitempty"`
+	BytesOut    int64     `json:"bytes_out,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// String will return the event as a human readable log line
+func (ev AuditEvent) String() string {
+	bits := []string{ev.Event}
+	add := func(k, v string) {
+		if v != "" {
+			bits = append(bits, k+"="+v)
+		}
+	}
+
+	add("user", ev.User)
+	add("source", ev.Source)
+	add("key", ev.Fingerprint)
+	add("method", ev.Method)
+	add("origin", ev.Origin)
+	add("dest", ev.Destination)
+	add("bind", ev.Bind)
+	if ev.DurationMS > 0 {
+		add("duration", (time.Duration(ev.DurationMS) * time.Millisecond).String())
+	}
+	if ev.BytesIn > 0 || ev.BytesOut > 0 {
+		add("bytes", fmt.Sprintf("%d/%d", ev.BytesIn, ev.BytesOut))
+	}
+	add("error", ev.Error)
+
+	return strings.Join(bits, " ")
+}
+
+// AuditSink is somewhere that audit events are written to
+type AuditSink interface {
+	Audit(AuditEvent) error
+	Close() error
+}
+
+// NewAuditSink will create the audit sink for the given config, which may
+// write to multiple places.  It returns nil if there is nowhere to write to
+func NewAuditSink(cfg AuditConfig) (AuditSink, error) {
+	sinks := MultiAuditSink{}
+
+	if cfg.File != "" {
+		fs, err := NewFileAuditSink(cfg.File, cfg.MaxSizeMB, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, fs)
+	}
+
+	if cfg.Syslog {
+		ss, err := NewSyslogAuditSink(cfg.SyslogNetwork, cfg.SyslogAddress, cfg.SyslogTag)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, ss)
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	return sinks, nil
+}
+
+// MultiAuditSink will write audit events to multiple sinks
+type MultiAuditSink []AuditSink
+
+// Audit will write the event to every sink, returning the first error
+func (ms MultiAuditSink) Audit(ev AuditEvent) error {
+	var firstErr error
+	for _, s := range ms {
+		if err := s.Audit(ev); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close will close every sink, returning the first error
+func (ms MultiAuditSink) Close() error {
+	var firstErr error
+	for _, s := range ms {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// FileAuditSink writes audit events as JSON lines to a file, rotating it when
+// it gets too big
+type FileAuditSink struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+	mu   *sync.Mutex
+}
+
+// NewFileAuditSink will open the given file for appending audit events to.  If
+// maxSizeMB is more than zero the file is rotated when it gets bigger than that,
+// keeping up to maxBackups old files named with .1, .2 etc
+func NewFileAuditSink(filename string, maxSizeMB, maxBackups int) (*FileAuditSink, error) {
+	fs := &FileAuditSink{
+		filename:   filename,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		mu:         new(sync.Mutex),
+	}
+	return fs, fs.open()
+}
+
+func (fs *FileAuditSink) open() error {
+	f, err := os.OpenFile(fs.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	fs.f = f
+	fs.size = info.Size()
+	return nil
+}
+
+// Audit will write the event as a JSON line
+func (fs *FileAuditSink) Audit(ev AuditEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.maxSize > 0 && fs.size+int64(len(data)) > fs.maxSize && fs.size > 0 {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := fs.f.Write(data)
+	fs.size += int64(n)
+	return err
+}
+
+// rotate will shift the old files along, dropping the oldest one, and start a new file
+func (fs *FileAuditSink) rotate() error {
+	fs.f.Close()
+
+	if fs.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", fs.filename, fs.maxBackups))
+		for i := fs.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", fs.filename, i), fmt.Sprintf("%s.%d", fs.filename, i+1))
+		}
+		if err := os.Rename(fs.filename, fs.filename+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(fs.filename); err != nil {
+		return err
+	}
+
+	return fs.open()
+}
+
+// Close will close the file
+func (fs *FileAuditSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f.Close()
+}
+
+// SyslogAuditSink writes audit events as JSON to syslog
+type SyslogAuditSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogAuditSink will connect to syslog, if the network and address are empty
+// then the local syslog server is used
+func NewSyslogAuditSink(network, addr, tag string) (*SyslogAuditSink, error) {
+	if tag == "" {
+		tag = "moled"
+	}
+
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogAuditSink{w: w}, nil
+}
+
+// Audit will write the event to syslog, failures are sent as warnings
+func (ss *SyslogAuditSink) Audit(ev AuditEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	if ev.Event == AuditAuthFailure || ev.Error != "" {
+		return ss.w.Warning(string(data))
+	}
+	return ss.w.Info(string(data))
+}
+
+// Close will close the connection to syslog
+func (ss *SyslogAuditSink) Close() error {
+	return ss.w.Close()
+}
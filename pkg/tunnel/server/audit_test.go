@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestFileAuditSinkRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "audit.log")
+	fs, err := NewFileAuditSink(fn, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	// one event per file
+	fs.maxSize = 10
+
+	for _, user := range []string{"a", "b", "c", "d"} {
+		if err := fs.Audit(AuditEvent{Event: AuditAuthSuccess, User: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{fn: "d", fn + ".1": "c", fn + ".2": "b"}
+	for name, user := range expected {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ev := AuditEvent{}
+		if err := json.Unmarshal(bytes.TrimSpace(data), &ev); err != nil {
+			t.Fatalf("expected a single JSON event in %s: %s", name, err)
+		}
+
+		if ev.User != user {
+			t.Errorf("expected %s to have the event for %q but got %q", name, user, ev.User)
+		}
+	}
+
+	if _, err := os.Stat(fn + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only 2 backups to be kept")
+	}
+}
+
+func TestAuditOnlyAfterSigning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "audit.log")
+	signer := newTestSigner(t)
+	svr, addr := startTestServer(t, &Config{
+		AuthorizedKeys: []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))},
+		Audit:          AuditConfig{File: fn},
+	})
+
+	// a client that only knows the public key is told it would be accepted
+	unsigned := &unsignedSigner{Signer: signer, accepted: make(chan struct{}), release: make(chan struct{})}
+	close(unsigned.release)
+	if _, err := dialTestServer(addr, unsigned); err == nil {
+		t.Fatal("expected the client without the private key to fail")
+	}
+	waitForClosed(svr)
+
+	client, err := dialTestServer(addr, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	waitForClosed(svr)
+
+	// the session end is written just after the connection is let go of
+	counts := auditCounts(t, fn)
+	for i := 0; i < 100 && counts[AuditSessionEnd] == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		counts = auditCounts(t, fn)
+	}
+
+	if counts[AuditAuthSuccess] != 1 || counts[AuditSessionStart] != 1 || counts[AuditSessionEnd] != 1 {
+		t.Errorf("expected only the client that signed to be audited but got %v", counts)
+	}
+}
+
+// auditCounts will count each type of event in the audit log
+func auditCounts(t *testing.T, fn string) map[string]int {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		ev := AuditEvent{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatal(err)
+		}
+		counts[ev.Event]++
+	}
+	return counts
+}
+
+func TestAuditEnrollment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "audit.log")
+	svr, addr := startTestServer(t, &Config{Audit: AuditConfig{File: fn}})
+
+	token, _, err := svr.tokens.Create(TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User: "bob",
+		Auth: []gossh.AuthMethod{gossh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{token}, nil
+		})},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if counts := auditCounts(t, fn); counts[AuditAuthSuccess] != 1 || counts[AuditSessionStart] != 1 {
+		t.Errorf("expected the enrollment to be audited but got %v", counts)
+	}
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/gliderlabs/ssh"
@@ -12,14 +15,89 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 )
 
+// DefaultControlSocket is the unix socket used to manage a running
+// server when none is given in the config
+const DefaultControlSocket = "/var/run/moled.sock"
+
+// ErrKeyNotFound is returned when a key with the given fingerprint could not be found
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyExists is returned when adding a key that is already authorized
+var ErrKeyExists = errors.New("key is already authorized")
+
+// ErrExternalKey is returned when trying to revoke a key that comes from the
+// authorized keys file or directory rather than the config
+var ErrExternalKey = errors.New("key comes from an external key store, remove it from there")
+
 // Config is a server config
 type Config struct {
-	Filename       string   `json:"-"`
-	AuthorizedKeys []string `json:"authorized_keys"`
-	RunServer      bool     `json:"run_server"`
-	ListenPort     string   `json:"listen_port"`
-	HostKey        string   `json:"host_key"`
-	InteractiveUDS bool     `json:"interactive_uds"`
+	Filename         string   `json:"-"`
+	AuthorizedKeys   []string `json:"authorized_keys"`
+	RunServer        bool     `json:"run_server"`
+	ListenPort       string   `json:"listen_port"`
+	HostKey          string   `json:"host_key"`
+	QueueUnknownKeys bool     `json:"queue_unknown_keys"`
+	PendingKeysFile  string   `json:"pending_keys_file"`
+	TokensFile       string   `json:"tokens_file"`
+	ControlSocket    string   `json:"control_socket"`
+	DrainTimeout     string   `json:"drain_timeout,omitempty"`
+	ReversePorts     string   `json:"reverse_ports,omitempty"`
+
+	AuthorizedKeysFile string `json:"authorized_keys_file,omitempty"`
+	AuthorizedKeysDir  string `json:"authorized_keys_dir,omitempty"`
+	AuthorizedKeysURL  string `json:"authorized_keys_url,omitempty"`
+	AuthorizedKeysTTL  string `json:"authorized_keys_ttl,omitempty"`
+
+	Limits      LimitsConfig              `json:"limits"`
+	Audit       AuditConfig               `json:"audit"`
+	Timeouts    TimeoutsConfig            `json:"timeouts"`
+	KeyTimeouts map[string]TimeoutsConfig `json:"key_timeouts,omitempty"`
+	HTTP        HTTPConfig                `json:"http"`
+	SNI         SNIConfig                 `json:"sni"`
+	Aliases     map[string]AliasConfig    `json:"aliases,omitempty"`
+
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol"`
+}
+
+// KeyInfo describes an authorized key
+type KeyInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Comment     string `json:"comment"`
+	Key         string `json:"key"`
+}
+
+// ControlSocketFilename will return the filename of the unix socket
+// used to control the server
+func (cfg Config) ControlSocketFilename() string {
+	if cfg.ControlSocket == "" {
+		return DefaultControlSocket
+	}
+	return cfg.ControlSocket
+}
+
+// PendingKeysFilename will return the filename that the pending keys
+// queue is saved to, defaulting to alongside the config file
+func (cfg Config) PendingKeysFilename() string {
+	if cfg.PendingKeysFile != "" || cfg.Filename == "" {
+		return cfg.PendingKeysFile
+	}
+	return cfg.Filename + ".pending"
+}
+
+// TokensFilename will return the filename that the enrollment tokens
+// are saved to, defaulting to alongside the config file
+func (cfg Config) TokensFilename() string {
+	if cfg.TokensFile != "" || cfg.Filename == "" {
+		return cfg.TokensFile
+	}
+	return cfg.Filename + ".tokens"
+}
+
+// DrainTimeoutDuration will return how long to wait for connections
+// to finish when shutting down
+func (cfg Config) DrainTimeoutDuration() (time.Duration, error) {
+	return parseDuration(cfg.DrainTimeout, DefaultDrainTimeout)
 }
 
 // AuthorizedKeyBytes will return the authorized keys as a byte array
@@ -56,6 +134,43 @@ func (cfg *Config) AddAuthorizedKey(key interface{}) {
 	}
 }
 
+// RemoveAuthorizedKey will remove the authorized key with the given fingerprint
+// returning ErrKeyNotFound if there was no key with that fingerprint
+func (cfg *Config) RemoveAuthorizedKey(fp string) error {
+	for i, k := range cfg.AuthorizedKeys {
+		pk, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			continue
+		}
+
+		if gossh.FingerprintSHA256(pk) == fp {
+			cfg.AuthorizedKeys = append(cfg.AuthorizedKeys[:i], cfg.AuthorizedKeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrKeyNotFound
+}
+
+// AuthorizedKeyInfo will return information about each of the authorized keys
+func (cfg Config) AuthorizedKeyInfo() []KeyInfo {
+	keys := []KeyInfo{}
+	for _, k := range cfg.AuthorizedKeys {
+		pk, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, KeyInfo{
+			Fingerprint: gossh.FingerprintSHA256(pk),
+			Type:        pk.Type(),
+			Comment:     comment,
+			Key:         strings.TrimSpace(k),
+		})
+	}
+	return keys
+}
+
 // Save will save the config file
 func (cfg Config) Save() error {
 	data, err := yaml.Marshal(cfg)
@@ -80,6 +195,13 @@ func LoadConfig(fn string) (cfg *Config, err error) {
 // GenerateConfig will generate a config with the host key preset
 func GenerateConfig() Config {
 	cfg := Config{ListenPort: ":8022", RunServer: true}
+	cfg.Limits = LimitsConfig{
+		MaxConnectionsPerIP: 20,
+		MaxHandshakesPerMin: 30,
+		MaxAuthFailures:     10,
+		BanDuration:         "1m",
+		MaxBanDuration:      "24h",
+	}
 
 	var err error
 	_, cfg.HostKey, err = util.MakeSSHKeyPair()
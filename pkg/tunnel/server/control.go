@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/penguinpowernz/mole/internal/util"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ControlRequest is a command sent to the server over the control socket
+type ControlRequest struct {
+	Command string        `json:"command"`
+	Args    []string      `json:"args"`
+	Token   *TokenOptions `json:"token,omitempty"`
+}
+
+// ControlResponse is the servers reply to a ControlRequest
+type ControlResponse struct {
+	OK      bool           `json:"ok"`
+	Error   string         `json:"error,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Keys    []KeyInfo      `json:"keys,omitempty"`
+	Pending []*PendingKey  `json:"pending,omitempty"`
+	Token   string         `json:"token,omitempty"`
+	Tokens  []*EnrollToken `json:"tokens,omitempty"`
+	Limits  *LimitStatus   `json:"limits,omitempty"`
+}
+
+// SendControlRequest will send the given command to a running server listening
+// on the given unix socket and return its response
+func SendControlRequest(socket, cmd string, args ...string) (*ControlResponse, error) {
+	return SendControl(socket, ControlRequest{Command: cmd, Args: args})
+}
+
+// SendControl will send the given request to a running server listening on
+// the given unix socket and return its response
+func SendControl(socket string, req ControlRequest) (*ControlResponse, error) {
+	res := new(ControlResponse)
+	if err := util.SendControl(socket, req, res); err != nil {
+		return nil, err
+	}
+
+	if !res.OK {
+		return res, errors.New(res.Error)
+	}
+
+	return res, nil
+}
+
+// ListenAndServeControl will listen on the control socket for management
+// commands until the context is done.  The socket is only accessible by
+// the user running the server
+func (svr *Server) ListenAndServeControl(ctx context.Context) error {
+	return util.ServeControl(ctx, svr.cfg.ControlSocketFilename(), func(line []byte) interface{} {
+		req := ControlRequest{}
+		if err := json.Unmarshal(line, &req); err != nil {
+			return &ControlResponse{Error: fmt.Sprintf("bad request: %s", err)}
+		}
+		return svr.HandleControlRequest(req)
+	})
+}
+
+// HandleControlRequest will run the given control command and return the result
+func (svr *Server) HandleControlRequest(req ControlRequest) *ControlResponse {
+	res := &ControlResponse{OK: true}
+
+	var err error
+	switch req.Command {
+	case "list":
+		svr.mu.Lock()
+		res.Keys = svr.cfg.AuthorizedKeyInfo()
+		svr.mu.Unlock()
+	case "pending":
+		res.Pending = svr.pending.Pending()
+	case "approve":
+		res.Message, err = svr.eachArg(req.Args, svr.ApproveKey)
+	case "deny":
+		res.Message, err = svr.eachArg(req.Args, svr.DenyKey)
+	case "revoke":
+		res.Message, err = svr.eachArg(req.Args, svr.RevokeKey)
+	case "add":
+		if err = svr.AddKey(strings.Join(req.Args, " ")); err == nil {
+			res.Message = "key added"
+		}
+	case "token-create":
+		opts := TokenOptions{}
+		if req.Token != nil {
+			opts = *req.Token
+		}
+		var tok *EnrollToken
+		res.Token, tok, err = svr.tokens.Create(opts)
+		if err == nil {
+			res.Tokens = []*EnrollToken{tok}
+			svr.events.Go("log", fmt.Sprintf("created enrollment token %s", tok.ID))
+		}
+	case "token-list":
+		res.Tokens = svr.tokens.List()
+	case "token-revoke":
+		res.Message, err = svr.eachArg(req.Args, svr.tokens.Revoke)
+	case "status":
+		st := svr.limits.Status()
+		res.Limits = &st
+	case "unban":
+		res.Message, err = svr.eachArg(req.Args, svr.limits.Unban)
+	default:
+		err = fmt.Errorf("unknown command: %s", req.Command)
+	}
+
+	if err != nil {
+		res.OK = false
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+func (svr *Server) eachArg(args []string, fn func(string) error) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("no arguments given")
+	}
+
+	for _, arg := range args {
+		if err := fn(arg); err != nil {
+			return "", fmt.Errorf("%s: %s", arg, err)
+		}
+	}
+
+	return fmt.Sprintf("%d updated", len(args)), nil
+}
+
+// ApproveKey will move the pending key with the given fingerprint into the
+// authorized keys and save the config
+func (svr *Server) ApproveKey(fp string) error {
+	pk, found := svr.pending.Get(fp)
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	if err := svr.AddKey(pk.Key); err != nil && err != ErrKeyExists {
+		return err
+	}
+
+	_, err := svr.pending.Remove(fp)
+	svr.events.Go("log", fmt.Sprintf("approved key %s for %s from %s", fp, pk.User, pk.Address))
+	return err
+}
+
+// DenyKey will deny the pending key with the given fingerprint
+func (svr *Server) DenyKey(fp string) error {
+	pk, err := svr.pending.Deny(fp)
+	if err != nil {
+		return err
+	}
+
+	svr.events.Go("log", fmt.Sprintf("denied key %s for %s from %s", fp, pk.User, pk.Address))
+	return nil
+}
+
+// RevokeKey will remove the authorized key with the given fingerprint and save
+// the config.  Keys from the authorized keys file or directory can't be removed
+// here so ErrExternalKey is returned for them, even if they were also in the
+// config.  Keys from the authorized keys URL can't be checked so they have to
+// be revoked wherever that gets them from
+func (svr *Server) RevokeKey(fp string) error {
+	removed, err := svr.removeKey(fp)
+	if err != nil {
+		return err
+	}
+
+	for _, ks := range svr.cfg.externalKeyStores() {
+		if _, ok := ks.(*HTTPKeyStore); ok {
+			continue
+		}
+
+		keys, _ := ks.AuthorizedKeys("")
+		for _, k := range keys {
+			if gossh.FingerprintSHA256(k) == fp {
+				return ErrExternalKey
+			}
+		}
+	}
+
+	if !removed {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// removeKey will remove the key from the config, returning false if it wasn't in there
+func (svr *Server) removeKey(fp string) (bool, error) {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+
+	err := svr.cfg.RemoveAuthorizedKey(fp)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	svr.keys.Flush()
+	svr.events.Go("log", fmt.Sprintf("revoked key %s", fp))
+	return true, svr.cfg.Save()
+}
+
+// AddKey will add the given public key in authorized_keys format to the
+// authorized keys and save the config, returning ErrKeyExists if it was
+// already authorized
+func (svr *Server) AddKey(key string) error {
+	pk, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+
+	fp := gossh.FingerprintSHA256(pk)
+	for _, k := range svr.cfg.AuthorizedKeyInfo() {
+		if k.Fingerprint == fp {
+			return ErrKeyExists
+		}
+	}
+
+	svr.cfg.AddAuthorizedKey(strings.TrimSpace(key))
+	svr.keys.Flush()
+	return svr.cfg.Save()
+}
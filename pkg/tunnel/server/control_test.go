@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexanderGrom/go-event"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{Filename: filepath.Join(dir, "moled.yml"), ControlSocket: filepath.Join(dir, "moled.sock")}
+	svr := NewServer(cfg, event.New())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svr.ListenAndServeControl(ctx)
+
+	var fi os.FileInfo
+	for i := 0; i < 100; i++ {
+		if fi, err = os.Stat(cfg.ControlSocket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected only the owner to access the socket but it has %s", fi.Mode().Perm())
+	}
+
+	key := string(gossh.MarshalAuthorizedKey(newTestKey(t)))
+	res, err := SendControlRequest(cfg.ControlSocket, "add", key)
+	if err != nil || res.Message != "key added" {
+		t.Fatalf("expected the key to be added but got %+v and %v", res, err)
+	}
+
+	res, err = SendControlRequest(cfg.ControlSocket, "add", key)
+	if err == nil || err.Error() != ErrKeyExists.Error() {
+		t.Errorf("expected adding the key again to fail but got %v", err)
+	}
+	if res != nil && res.Message != "" {
+		t.Errorf("expected no message when the key wasn't added but got %q", res.Message)
+	}
+}
+
+func TestRevokeExternalKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inline, external := newTestKey(t), newTestKey(t)
+	fn := filepath.Join(dir, "authorized_keys")
+	ioutil.WriteFile(fn, gossh.MarshalAuthorizedKey(external), 0644)
+
+	cfg := &Config{
+		Filename:           filepath.Join(dir, "moled.yml"),
+		AuthorizedKeys:     []string{string(gossh.MarshalAuthorizedKey(inline))},
+		AuthorizedKeysFile: fn,
+	}
+	svr := NewServer(cfg, event.New())
+
+	if err := svr.RevokeKey(gossh.FingerprintSHA256(external)); err != ErrExternalKey {
+		t.Errorf("expected the key from the file not to be revoked but got %v", err)
+	}
+
+	if err := svr.RevokeKey(gossh.FingerprintSHA256(inline)); err != nil {
+		t.Errorf("expected the key in the config to be revoked but got %v", err)
+	}
+
+	if err := svr.RevokeKey(gossh.FingerprintSHA256(newTestKey(t))); err != ErrKeyNotFound {
+		t.Errorf("expected an unknown key not to be found but got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// directTCPIPData is the extra data for a direct-tcpip channel as specified in RFC4254, Section 7.2
+type directTCPIPData struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// handleDirectTCPIP will handle a local port forward from the client by dialing
+// the destination and copying data between it and the channel until both sides
+// are done
+func (svr *Server) handleDirectTCPIP(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	d := directTCPIPData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	if srv.LocalPortForwardingCallback == nil || !srv.LocalPortForwardingCallback(ctx, d.DestAddr, d.DestPort) {
+		newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	dest := net.JoinHostPort(d.DestAddr, strconv.FormatInt(int64(d.DestPort), 10))
+	start := time.Now()
+
+	ev := svr.auditEvent(ctx, AuditDirectTCPIP)
+	ev.Destination = dest
+	ev.Origin = net.JoinHostPort(d.OriginAddr, strconv.FormatInt(int64(d.OriginPort), 10))
+	defer func() {
+		ev.DurationMS = int64(time.Since(start) / time.Millisecond)
+		svr.audit(ev)
+	}()
+
+	if svr.isDraining() {
+		newChan.Reject(gossh.ResourceShortage, "server is shutting down")
+		ev.Error = "draining"
+		return
+	}
+
+	closeChannel, reason := svr.limits.OpenChannel(ctx)
+	if reason != "" {
+		svr.rejected(ctx.RemoteAddr(), reason)
+		newChan.Reject(gossh.ResourceShortage, "too many open channels")
+		ev.Error = reason
+		return
+	}
+	defer closeChannel()
+
+	nc, err := svr.dialDestination(ctx, d.DestAddr, dest)
+	if err != nil {
+		reason := gossh.ConnectionFailed
+		if err == errAliasNotAllowed {
+			reason = gossh.Prohibited
+		}
+		newChan.Reject(reason, err.Error())
+		ev.Error = err.Error()
+		return
+	}
+	// aliases are other clients which see the origin in the channel already
+	if _, virtual := nc.(*channelConn); !virtual && svr.cfg.ProxyProtocol.sendsTo(dest) {
+		if err := svr.sendProxyHeader(ctx, nc); err != nil {
+			nc.Close()
+			newChan.Reject(gossh.ConnectionFailed, "failed to send the PROXY header: "+err.Error())
+			ev.Error = err.Error()
+			return
+		}
+	}
+
+	session, _ := ctx.Value(contextKeyConn).(*trackedConn)
+	dconn := newForwardedConn(nc, session)
+	defer dconn.Close()
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		ev.Error = err.Error()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	defer ch.Close()
+
+	// connections to aliases are already counted by dialVirtual
+	if _, virtual := nc.(*channelConn); !virtual {
+		defer svr.bridges.add()()
+	}
+
+	if idle := svr.timeoutsFor(fingerprintOf(ctx)).channelIdle; idle > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			if waitForIdle(dconn, idle, done) {
+				dconn.reason.Store(DisconnectIdle)
+				ch.Close()
+				dconn.Close()
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, dconn)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(dconn, ch)
+		if cw, ok := nc.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	wg.Wait()
+
+	ev.BytesIn = atomic.LoadInt64(&dconn.out)
+	ev.BytesOut = atomic.LoadInt64(&dconn.in)
+	ev.Error = dconn.CloseReason()
+}
+
+// dialDestination will connect to the destination of a local port forward, which
+// is either an alias served by another client or an address the server can reach
+func (svr *Server) dialDestination(ctx ssh.Context, host, dest string) (net.Conn, error) {
+	ac, ok := svr.cfg.alias(host)
+	if !ok {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", dest)
+	}
+
+	if !ac.canConnect(fingerprintOf(ctx)) {
+		return nil, errAliasNotAllowed
+	}
+
+	conn, err := svr.dialVirtual(VirtualAlias, host, ctx.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// rejected will emit an event and log that something from the given address was rejected
+func (svr *Server) rejected(addr net.Addr, reason string) {
+	svr.events.Go("log", fmt.Sprintf("rejected %s: %s", addr.String(), reason))
+	svr.events.Go("limit.rejected", hostOf(addr), reason)
+}
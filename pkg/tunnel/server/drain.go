@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDrainTimeout is how long the server waits for connections to finish
+// when shutting down, if none is given in the config
+const DefaultDrainTimeout = 30 * time.Second
+
+// bridgeCounter counts the connections being forwarded through the server
+// so that they can be waited on when draining
+type bridgeCounter struct {
+	active  int
+	changed chan struct{}
+	mu      *sync.Mutex
+}
+
+func newBridgeCounter() *bridgeCounter {
+	return &bridgeCounter{changed: make(chan struct{}, 1), mu: new(sync.Mutex)}
+}
+
+// add will count a new connection, the returned func must be called when it is done
+func (bc *bridgeCounter) add() func() {
+	bc.mu.Lock()
+	bc.active++
+	bc.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			bc.mu.Lock()
+			bc.active--
+			bc.mu.Unlock()
+
+			select {
+			case bc.changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+}
+
+// Active will return the number of connections
+func (bc *bridgeCounter) Active() int {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.active
+}
+
+// wait will wait for all the connections to finish, returning early with the
+// number still active if the context is done first
+func (bc *bridgeCounter) wait(ctx context.Context) int {
+	for {
+		n := bc.Active()
+		if n == 0 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return n
+		case <-bc.changed:
+		}
+	}
+}
+
+func (svr *Server) isDraining() bool {
+	return atomic.LoadInt32(&svr.draining) == 1
+}
+
+// Drain will stop the server accepting new connections, reverse forwards and
+// channels, then wait for the connections already going through it to finish.
+// Once the context is done the server is closed, killing any that are left.
+// It returns how many connections finished and how many were killed
+func (svr *Server) Drain(ctx context.Context) (drained, killed int) {
+	atomic.StoreInt32(&svr.draining, 1)
+	svr.forwards.closeAll()
+
+	// closes the listener, then waits for the clients to disconnect which
+	// they won't do by themselves, so this only returns when ctx is done
+	go svr.Server.Shutdown(ctx)
+
+	start := svr.bridges.Active()
+	killed = svr.bridges.wait(ctx)
+	svr.Close()
+
+	// give the killed connections a moment to be audited
+	closed, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	svr.bridges.wait(closed)
+
+	if drained = start - killed; drained < 0 {
+		drained = 0
+	}
+	return drained, killed
+}
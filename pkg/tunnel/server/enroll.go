@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/penguinpowernz/mole/pkg/sshutil"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type contextKey string
+
+// contextKeyEnrollToken holds the enrollment token a connection authenticated with
+var contextKeyEnrollToken = contextKey("enroll-token")
+
+// TokenTunnel is a tunnel that will be added to the client config of clients that
+// enroll with a token, using the SSH port forward definition format
+type TokenTunnel struct {
+	L string `json:"L,omitempty"`
+	R string `json:"R,omitempty"`
+}
+
+// isEnrollment will return true if the connection authenticated with an
+// enrollment token instead of a public key
+func isEnrollment(ctx ssh.Context) bool {
+	return ctx.Value(contextKeyEnrollToken) != nil
+}
+
+// requireKeyAuth will wrap the channel handler so that it rejects any
+// connections that authenticated with an enrollment token
+func requireKeyAuth(handler ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		if isEnrollment(ctx) {
+			newChan.Reject(gossh.Prohibited, "only enrollment is allowed")
+			return
+		}
+		handler(srv, conn, newChan, ctx)
+	}
+}
+
+// EnrollmentAuth is a keyboard interactive handler that will ask the client
+// for an enrollment token, authenticating the connection if it is valid.  The
+// connection is only allowed to open the enrollment channel
+func (svr *Server) EnrollmentAuth(ctx ssh.Context, challenge gossh.KeyboardInteractiveChallenge) bool {
+	if svr.limits.IsBanned(hostOf(ctx.RemoteAddr())) {
+		return false
+	}
+
+	answers, err := challenge(ctx.User(), "", []string{sshutil.EnrollQuestion}, []bool{false})
+	if err != nil || len(answers) != 1 {
+		return false
+	}
+
+	if _, err := svr.tokens.Validate(answers[0]); err != nil {
+		ev := svr.auditEvent(ctx, AuditAuthFailure)
+		ev.Method, ev.Error = "enroll-token", err.Error()
+		svr.audit(ev)
+		markAuthFailed(ctx)
+		return false
+	}
+
+	ctx.SetValue(contextKeyEnrollToken, answers[0])
+	return true
+}
+
+// handleEnroll will authorize the public key sent by a client that authenticated
+// with an enrollment token, replying with the host key and client config
+func (svr *Server) handleEnroll(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	text, ok := ctx.Value(contextKeyEnrollToken).(string)
+	if !ok {
+		newChan.Reject(gossh.Prohibited, "not authenticated with an enrollment token")
+		return
+	}
+
+	req := sshutil.EnrollRequest{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &req); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing enrollment request: "+err.Error())
+		return
+	}
+
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "invalid public key: "+err.Error())
+		return
+	}
+
+	tok, err := svr.tokens.Use(text)
+	if err != nil {
+		newChan.Reject(gossh.Prohibited, err.Error())
+		return
+	}
+
+	if err := svr.AddKey(req.PublicKey); err != nil && err != ErrKeyExists {
+		svr.events.Go("error", fmt.Errorf("failed to save enrolled key: %s", err))
+		if err := svr.tokens.Release(tok); err != nil {
+			svr.events.Go("error", fmt.Errorf("failed to give back the use of token %s: %s", tok.ID, err))
+		}
+		newChan.Reject(gossh.ConnectionFailed, "failed to save the public key")
+		return
+	}
+
+	fp := gossh.FingerprintSHA256(key)
+	svr.pending.Remove(fp)
+
+	res := sshutil.EnrollResponse{Fingerprint: fp}
+	if len(srv.HostSigners) > 0 {
+		res.HostKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(srv.HostSigners[0].PublicKey())))
+	}
+
+	if len(tok.Tunnels) > 0 {
+		res.Config, _ = json.Marshal(map[string]interface{}{"tunnels": tok.Tunnels})
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	defer ch.Close()
+
+	data, _ := json.Marshal(res)
+	ch.Write(data)
+
+	svr.events.Go("log", fmt.Sprintf("enrolled key %s for %s from %s with token %s", fp, ctx.User(), ctx.RemoteAddr().String(), tok.ID))
+	svr.events.Go("key.enrolled", fp)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// forwardedTCPChannelType is the channel opened back to the client for each
+// connection to one of its reverse forwards
+const forwardedTCPChannelType = "forwarded-tcpip"
+
+// forwardedTCPData is the extra data for a forwarded-tcpip channel as specified in RFC4254, Section 7.2
+type forwardedTCPData struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// reverseForwards handles the tcpip-forward requests from clients, listening on
+// the requested address and opening a forwarded-tcpip channel back to the client
+// for each connection to it.  Listeners are kept per session so that one client
+// can't cancel another clients forward
+type reverseForwards struct {
+	svr       *Server
+	listeners map[string]net.Listener
+	virtual   *virtualForwards
+	mu        *sync.Mutex
+}
+
+func newReverseForwards(svr *Server) *reverseForwards {
+	return &reverseForwards{
+		svr:       svr,
+		listeners: map[string]net.Listener{},
+		virtual:   newVirtualForwards(),
+		mu:        new(sync.Mutex),
+	}
+}
+
+// HandleSSHRequest will handle the tcpip-forward and cancel-tcpip-forward requests
+func (rf *reverseForwards) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	fwd := remoteForwardRequest{}
+	if err := gossh.Unmarshal(req.Payload, &fwd); err != nil {
+		return false, []byte("error parsing forward request: " + err.Error())
+	}
+
+	addr := net.JoinHostPort(fwd.BindAddr, strconv.Itoa(int(fwd.BindPort)))
+
+	if req.Type == "cancel-tcpip-forward" {
+		if !rf.close(sessionID(ctx), addr) && !rf.virtual.remove(sessionID(ctx), fwd.BindAddr) {
+			return false, []byte("no forward for " + addr)
+		}
+		return true, nil
+	}
+
+	if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, fwd.BindAddr, fwd.BindPort) {
+		return false, []byte("port forwarding is disabled")
+	}
+
+	if rf.svr.isDraining() {
+		return false, []byte("server is shutting down")
+	}
+
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return false, []byte("no connection for the session")
+	}
+
+	if kind, err := rf.svr.virtualHost(ctx, fwd.BindAddr); kind != "" {
+		if err != nil {
+			return false, []byte(err.Error())
+		}
+
+		if !rf.virtual.add(ctx, conn, kind, fwd.BindAddr, fwd.BindPort) {
+			return false, []byte(fwd.BindAddr + " is already in use")
+		}
+
+		return true, gossh.Marshal(&remoteForwardSuccess{BindPort: fwd.BindPort})
+	}
+
+	ln, err := rf.listen(fwd.BindAddr, fwd.BindPort)
+	if err != nil {
+		return false, []byte(err.Error())
+	}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	bindPort, _ := strconv.Atoi(port)
+	addr = net.JoinHostPort(fwd.BindAddr, port)
+
+	key := sessionID(ctx) + " " + addr
+	rf.mu.Lock()
+	rf.listeners[key] = ln
+	rf.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		rf.close(sessionID(ctx), addr)
+	}()
+
+	session, _ := ctx.Value(contextKeyConn).(*trackedConn)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go rf.forward(conn, newForwardedConn(c, session), fwd.BindAddr, uint32(bindPort))
+		}
+	}()
+
+	return true, gossh.Marshal(&remoteForwardSuccess{BindPort: uint32(bindPort)})
+}
+
+// forward will open a forwarded-tcpip channel to the client for the connection
+// and copy data between them until both sides are done
+func (rf *reverseForwards) forward(conn *gossh.ServerConn, c *trackedConn, bindAddr string, bindPort uint32) {
+	defer c.Close()
+	defer rf.svr.bridges.add()()
+
+	origin, port, _ := net.SplitHostPort(c.RemoteAddr().String())
+	originPort, _ := strconv.Atoi(port)
+
+	ch, reqs, err := conn.OpenChannel(forwardedTCPChannelType, gossh.Marshal(&forwardedTCPData{
+		DestAddr:   bindAddr,
+		DestPort:   bindPort,
+		OriginAddr: origin,
+		OriginPort: uint32(originPort),
+	}))
+	if err != nil {
+		rf.svr.events.Go("error", fmt.Errorf("failed to open forwarded channel to %s: %s", conn.RemoteAddr(), err))
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	defer ch.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(c, ch)
+		if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	wg.Wait()
+}
+
+// close will close the sessions listener for the given address, returning
+// false if there was no listener
+func (rf *reverseForwards) close(session, addr string) bool {
+	key := session + " " + addr
+
+	rf.mu.Lock()
+	ln, found := rf.listeners[key]
+	delete(rf.listeners, key)
+	rf.mu.Unlock()
+
+	if found {
+		ln.Close()
+	}
+	return found
+}
+
+// closeAll will close every listener and remove the virtual forwards
+// so that no new connections come in
+func (rf *reverseForwards) closeAll() {
+	rf.virtual.removeAll()
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for key, ln := range rf.listeners {
+		ln.Close()
+		delete(rf.listeners, key)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// contextKeyHTTPOrigin holds the address of the client that made the HTTP request
+var contextKeyHTTPOrigin = contextKey("http-origin")
+
+// HTTPConfig is the config for the HTTP front, which routes requests to the
+// reverse forwards of clients by the Host header so that each of them doesn't
+// need a public port of its own.  Clients ask for a name by forwarding from
+// name.domain, which they can only do if the name is reserved for their key
+type HTTPConfig struct {
+	Listen    string `json:"listen,omitempty"`
+	ListenTLS string `json:"listen_tls,omitempty"`
+	TLSCert   string `json:"tls_cert,omitempty"`
+	TLSKey    string `json:"tls_key,omitempty"`
+	Domain    string `json:"domain,omitempty"`
+
+	// Names are the names reserved for each key fingerprint, a key with the
+	// name "*" can use any name that isn't reserved for another key
+	Names map[string][]string `json:"names,omitempty"`
+}
+
+func (hc HTTPConfig) enabled() bool {
+	return hc.Domain != "" && (hc.Listen != "" || hc.ListenTLS != "")
+}
+
+// nameOf will return the name for the host, if it is a subdomain of the domain
+func (hc HTTPConfig) nameOf(host string) (string, bool) {
+	if !hc.enabled() {
+		return "", false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	suffix := "." + strings.ToLower(strings.TrimSuffix(hc.Domain, "."))
+	if !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+
+	name := strings.TrimSuffix(host, suffix)
+	return name, name != "" && !strings.Contains(name, ".")
+}
+
+// allowed will return true if the key with the given fingerprint can use the name
+func (hc HTTPConfig) allowed(fp, name string) bool {
+	if fp == "" {
+		return false
+	}
+
+	if hasName(hc.Names[fp], name) {
+		return true
+	}
+
+	if !hasName(hc.Names[fp], "*") {
+		return false
+	}
+
+	for other, names := range hc.Names {
+		if other != fp && hasName(names, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAndServeHTTP will run the HTTP front, if it is configured, until the
+// context is done.  Then it stops accepting requests but lets the ones in
+// progress finish
+func (svr *Server) ListenAndServeHTTP(ctx context.Context) error {
+	hc := svr.cfg.HTTP
+	if !hc.enabled() {
+		return nil
+	}
+
+	transport := svr.httpTransport()
+	handler := svr.httpHandler(transport)
+	servers := []*http.Server{}
+	errs := make(chan error, 2)
+
+	if hc.Listen != "" {
+		s := &http.Server{Addr: hc.Listen, Handler: handler}
+		servers = append(servers, s)
+		go func() { errs <- s.ListenAndServe() }()
+	}
+
+	if hc.ListenTLS != "" {
+		s := &http.Server{Addr: hc.ListenTLS, Handler: handler}
+		servers = append(servers, s)
+		go func() { errs <- s.ListenAndServeTLS(hc.TLSCert, hc.TLSKey) }()
+	}
+
+	select {
+	case err := <-errs:
+		for _, s := range servers {
+			s.Close()
+		}
+		return err
+
+	case <-ctx.Done():
+		for _, s := range servers {
+			go func(s *http.Server) {
+				s.Shutdown(context.Background())
+				transport.CloseIdleConnections()
+			}(s)
+		}
+		return nil
+	}
+}
+
+// httpTransport will dial the virtual forward for the host of each request.  The
+// connections are made for the origin of the request so they are never reused
+// for requests from anyone else
+func (svr *Server) httpTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			origin, ok := ctx.Value(contextKeyHTTPOrigin).(net.Addr)
+			if !ok {
+				return nil, fmt.Errorf("no origin for the request to %s", host)
+			}
+
+			conn, err := svr.dialVirtual(VirtualHTTP, host, origin)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+		DisableKeepAlives: true,
+	}
+}
+
+// httpHandler will proxy requests to the virtual forward for the host, adding
+// the X-Forwarded headers.  WebSockets and other upgrades are passed through
+func (svr *Server) httpHandler(transport http.RoundTripper) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			proto := "http"
+			if req.TLS != nil {
+				proto = "https"
+			}
+
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+			req.Header.Set("X-Forwarded-Host", req.Host)
+			req.Header.Set("X-Forwarded-Proto", proto)
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			svr.events.Go("error", fmt.Errorf("failed to proxy HTTP request for %s from %s: %s", r.Host, r.RemoteAddr, err))
+			http.Error(w, "the tunnel is not available", http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if _, ok := svr.cfg.HTTP.nameOf(host); !ok {
+			http.Error(w, "unknown host "+host, http.StatusNotFound)
+			return
+		}
+
+		if _, found := svr.forwards.virtual.get(VirtualHTTP, host); !found {
+			http.Error(w, "no tunnel for "+host, http.StatusNotFound)
+			return
+		}
+
+		if svr.isDraining() {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		origin, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "invalid remote address", http.StatusBadRequest)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyHTTPOrigin, origin)
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestHTTPConfigNames(t *testing.T) {
+	hc := HTTPConfig{
+		Listen: ":80",
+		Domain: "tunnels.example.com",
+		Names: map[string][]string{
+			"SHA256:alice": {"alice", "shop"},
+			"SHA256:bob":   {"*"},
+		},
+	}
+
+	names := map[string]string{
+		"demo.tunnels.example.com":  "demo",
+		"Demo.Tunnels.Example.com.": "demo",
+		"tunnels.example.com":       "",
+		"a.b.tunnels.example.com":   "",
+		"demo.example.com":          "",
+	}
+
+	for host, expected := range names {
+		name, ok := hc.nameOf(host)
+		if ok != (expected != "") || (ok && name != expected) {
+			t.Errorf("expected %s to have the name %q but got %q, %v", host, expected, name, ok)
+		}
+	}
+
+	allowed := []struct {
+		fp, name string
+		allowed  bool
+	}{
+		{"SHA256:alice", "shop", true},
+		{"SHA256:alice", "demo", false},
+		{"SHA256:bob", "demo", true},
+		{"SHA256:bob", "shop", false},
+		{"SHA256:carol", "demo", false},
+		{"", "demo", false},
+	}
+
+	for _, a := range allowed {
+		if hc.allowed(a.fp, a.name) != a.allowed {
+			t.Errorf("expected %s being allowed to use %s to be %v", a.fp, a.name, a.allowed)
+		}
+	}
+}
+
+func TestHTTPProxyDialsForEachOrigin(t *testing.T) {
+	signer := newTestSigner(t)
+	fp := gossh.FingerprintSHA256(signer.PublicKey())
+	svr, addr := startTestServer(t, &Config{
+		AuthorizedKeys: []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))},
+		HTTP:           HTTPConfig{Listen: ":0", Domain: "tunnels.test", Names: map[string][]string{fp: {"demo"}}},
+	})
+
+	// the app answers every request on a connection with who it was for
+	forwardTestClient(t, addr, signer, "demo.tunnels.test", 80, func(ch gossh.Channel, data forwardedTCPData) {
+		defer ch.Close()
+		rd := bufio.NewReader(ch)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			res := &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, Close: req.Close}
+			res.Body = ioutil.NopCloser(strings.NewReader(strconv.Itoa(int(data.OriginPort))))
+			res.ContentLength = int64(len(strconv.Itoa(int(data.OriginPort))))
+			res.Write(ch)
+		}
+	})
+
+	front := httptest.NewServer(svr.httpHandler(svr.httpTransport()))
+	defer front.Close()
+
+	// each visitor has their own connection to the front
+	get := func() (string, string) {
+		var local string
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := net.Dial(network, addr)
+				if err == nil {
+					_, local, _ = net.SplitHostPort(conn.LocalAddr().String())
+				}
+				return conn, err
+			},
+		}}
+
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		req.Host = "demo.tunnels.test"
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 200 {
+			t.Fatalf("unexpected response %d: %s", res.StatusCode, body)
+		}
+		return local, string(body)
+	}
+
+	for i := 0; i < 3; i++ {
+		if local, origin := get(); local != origin {
+			t.Errorf("expected the request from port %s to come from it but it came from %s", local, origin)
+		}
+	}
+}
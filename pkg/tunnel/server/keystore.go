@@ -0,0 +1,432 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// KeyStore is a source of public keys that are authorized to connect
+type KeyStore interface {
+	// AuthorizedKeys will return the keys that are allowed to connect as the given user
+	AuthorizedKeys(user string) ([]gossh.PublicKey, error)
+}
+
+// ParseAuthorizedKeys will parse every key in the given authorized_keys
+// formatted data, skipping comments and lines that can't be parsed.  Keys
+// with a from= option are only allowed to connect from those addresses, and
+// lines with any other options that restrict the key (or make it a
+// cert-authority) are skipped, as the server can't enforce them
+func ParseAuthorizedKeys(data []byte) []gossh.PublicKey {
+	keys := []gossh.PublicKey{}
+	for len(data) > 0 {
+		key, _, opts, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+
+		from, ok := parseKeyOptions(opts)
+		if !ok {
+			continue
+		}
+
+		if len(from) > 0 {
+			key = restrictedKey{key, from}
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ignoredKeyOptions are the authorized_keys options that don't apply to a
+// server that only forwards ports
+var ignoredKeyOptions = map[string]bool{
+	"no-pty":              true,
+	"no-x11-forwarding":   true,
+	"no-agent-forwarding": true,
+	"no-user-rc":          true,
+}
+
+// parseKeyOptions will return the patterns from any from= option, and false
+// if there are options that aren't supported
+func parseKeyOptions(opts []string) (from []string, ok bool) {
+	for _, opt := range opts {
+		name, value := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			name, value = opt[:i], strings.Trim(opt[i+1:], `"`)
+		}
+
+		switch name = strings.ToLower(name); {
+		case name == "from":
+			from = append(from, strings.Split(value, ",")...)
+		case ignoredKeyOptions[name]:
+		default:
+			return nil, false
+		}
+	}
+
+	return from, true
+}
+
+// restrictedKey is a key that can only connect from the addresses matching
+// the patterns from its from= option
+type restrictedKey struct {
+	gossh.PublicKey
+	from []string
+}
+
+// allows will return true if the given IP matches the patterns, patterns
+// starting with ! deny the IP even if another pattern matches.  Only IPs,
+// CIDRs and wildcards are supported, hostnames never match
+func (rk restrictedKey) allows(host string) bool {
+	ip := net.ParseIP(host)
+	allowed := false
+	for _, p := range rk.from {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		var match bool
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			match = ip != nil && cidr.Contains(ip)
+		} else {
+			match, _ = path.Match(p, host)
+		}
+
+		if match && negated {
+			return false
+		}
+		allowed = allowed || match
+	}
+	return allowed
+}
+
+// keyAllowedFrom will return true if the key can connect from the given host
+func keyAllowedFrom(key gossh.PublicKey, host string) bool {
+	rk, ok := key.(restrictedKey)
+	return !ok || rk.allows(host)
+}
+
+// NewKeyStore will create the key store for the given config, using the inline
+// keys from the config and any other sources that are configured.  Each source
+// is cached separately for the configured TTL.  The lock is held while reading
+// the inline keys from the config
+func NewKeyStore(cfg *Config, mu sync.Locker) (MultiKeyStore, error) {
+	ttl := time.Minute
+	if cfg.AuthorizedKeysTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(cfg.AuthorizedKeysTTL); err != nil {
+			return nil, fmt.Errorf("invalid authorized_keys_ttl: %s", err)
+		}
+	}
+
+	stores := MultiKeyStore{NewCachedKeyStore(&InlineKeyStore{cfg: cfg, mu: mu}, ttl)}
+	for _, ks := range cfg.externalKeyStores() {
+		stores = append(stores, NewCachedKeyStore(ks, ttl))
+	}
+
+	return stores, nil
+}
+
+// externalKeyStores will return the key stores for the keys that don't come
+// from the config file
+func (cfg Config) externalKeyStores() MultiKeyStore {
+	stores := MultiKeyStore{}
+
+	if cfg.AuthorizedKeysFile != "" {
+		stores = append(stores, FileKeyStore(cfg.AuthorizedKeysFile))
+	}
+
+	if cfg.AuthorizedKeysDir != "" {
+		stores = append(stores, DirKeyStore(cfg.AuthorizedKeysDir))
+	}
+
+	if cfg.AuthorizedKeysURL != "" {
+		stores = append(stores, NewHTTPKeyStore(cfg.AuthorizedKeysURL))
+	}
+
+	return stores
+}
+
+// InlineKeyStore is a key store using the authorized keys in the config file
+type InlineKeyStore struct {
+	cfg *Config
+	mu  sync.Locker
+}
+
+// AuthorizedKeys will return every key from the config, regardless of user
+func (ks *InlineKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ParseAuthorizedKeys(ks.cfg.AuthorizedKeyBytes()), nil
+}
+
+// FileKeyStore is a key store using an OpenSSH authorized_keys file
+type FileKeyStore string
+
+// AuthorizedKeys will return every key from the file, regardless of user
+func (ks FileKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	data, err := ioutil.ReadFile(string(ks))
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuthorizedKeys(data), nil
+}
+
+// DirKeyStore is a key store using a directory of .pub files, one for each client
+type DirKeyStore string
+
+// AuthorizedKeys will return every key from the .pub files in the directory, regardless of user
+func (ks DirKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(string(ks), "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []gossh.PublicKey{}
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return keys, err
+		}
+		keys = append(keys, ParseAuthorizedKeys(data)...)
+	}
+
+	return keys, nil
+}
+
+// HTTPKeyStore is a key store that requests the keys for a user from an HTTP
+// endpoint, which should return them in the authorized_keys format, much like
+// the AuthorizedKeysCommand in OpenSSH
+type HTTPKeyStore struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPKeyStore will create a new HTTP key store for the given URL.  Any
+// occurrence of {user} in the URL is replaced with the user, otherwise the
+// user is added as a query parameter
+func NewHTTPKeyStore(u string) *HTTPKeyStore {
+	return &HTTPKeyStore{URL: u, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// AuthorizedKeys will request the keys for the given user
+func (ks *HTTPKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	u := ks.URL
+	if strings.Contains(u, "{user}") {
+		u = strings.Replace(u, "{user}", url.PathEscape(user), -1)
+	} else {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "user=" + url.QueryEscape(user)
+	}
+
+	res, err := ks.Client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %s", ks.URL, res.Status)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseAuthorizedKeys(data), nil
+}
+
+// keysVaryByUser will return true as each user has their own keys
+func (ks *HTTPKeyStore) keysVaryByUser() bool {
+	return true
+}
+
+// MultiKeyStore will combine the keys from multiple key stores
+type MultiKeyStore []KeyStore
+
+// AuthorizedKeys will return the keys from all the key stores, along with the
+// first error encountered.  Keys are still returned from the stores that worked
+func (ms MultiKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	var firstErr error
+	keys := []gossh.PublicKey{}
+	for _, ks := range ms {
+		k, err := ks.AuthorizedKeys(user)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		keys = append(keys, k...)
+	}
+	return keys, firstErr
+}
+
+// Flush will flush the cache of any of the stores that are cached
+func (ms MultiKeyStore) Flush() {
+	for _, ks := range ms {
+		if cs, ok := ks.(*CachedKeyStore); ok {
+			cs.Flush()
+		}
+	}
+}
+
+// userKeyStore is a key store that returns different keys for each user
+type userKeyStore interface {
+	keysVaryByUser() bool
+}
+
+const (
+	// keyStoreRetryAfter is how long a failure to get the keys for a user is
+	// cached for, so that every login doesn't hit a store that is down
+	keyStoreRetryAfter = 5 * time.Second
+
+	// keyStoreMaxStale is how long after they were last loaded that the keys
+	// are still used while the store is down
+	keyStoreMaxStale = 10 * time.Minute
+
+	// maxCachedUsers is how many users the keys are cached for
+	maxCachedUsers = 1000
+)
+
+type cachedKeys struct {
+	keys    []gossh.PublicKey // the keys to use until it expires
+	err     error             // the error if the store failed
+	good    []gossh.PublicKey // the keys from the last time the store worked
+	loaded  time.Time         // when the store last worked
+	expires time.Time
+}
+
+// keyLoad is a request to the store that other requests for the same user can wait on
+type keyLoad struct {
+	done chan struct{}
+	keys []gossh.PublicKey
+	err  error
+}
+
+// CachedKeyStore will cache the keys from another key store, for each user if
+// the store has different keys for each user
+type CachedKeyStore struct {
+	store   KeyStore
+	ttl     time.Duration
+	perUser bool
+	cache   map[string]cachedKeys
+	loading map[string]*keyLoad
+	mu      *sync.Mutex
+}
+
+// NewCachedKeyStore will cache the keys from the given store for the given TTL
+func NewCachedKeyStore(store KeyStore, ttl time.Duration) *CachedKeyStore {
+	us, ok := store.(userKeyStore)
+	return &CachedKeyStore{
+		store:   store,
+		ttl:     ttl,
+		perUser: ok && us.keysVaryByUser(),
+		cache:   map[string]cachedKeys{},
+		loading: map[string]*keyLoad{},
+		mu:      new(sync.Mutex),
+	}
+}
+
+// AuthorizedKeys will return the cached keys for the user, or get them from the
+// underlying store if they aren't cached or have expired.  Only one request for
+// each user is made to the store at a time.  If the store fails the keys that
+// were cached before are used for a while, and it isn't asked again for a few
+// seconds
+func (cs *CachedKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	if !cs.perUser {
+		user = ""
+	}
+
+	cs.mu.Lock()
+	c, found := cs.cache[user]
+	if found && time.Now().Before(c.expires) {
+		cs.mu.Unlock()
+		return c.keys, c.err
+	}
+
+	if l, loading := cs.loading[user]; loading {
+		cs.mu.Unlock()
+		<-l.done
+		return l.keys, l.err
+	}
+
+	l := &keyLoad{done: make(chan struct{})}
+	cs.loading[user] = l
+	cs.mu.Unlock()
+
+	keys, err := cs.store.AuthorizedKeys(user)
+	now := time.Now()
+
+	if err == nil {
+		c = cachedKeys{keys: keys, good: keys, loaded: now, expires: now.Add(cs.ttl)}
+	} else {
+		// only the keys from when the store last worked are trusted, as it
+		// may have only returned some of them
+		if found && !c.loaded.IsZero() && now.Sub(c.loaded) < keyStoreMaxStale {
+			keys = c.good
+		}
+		c = cachedKeys{keys: keys, err: err, good: c.good, loaded: c.loaded, expires: now.Add(keyStoreRetryAfter)}
+	}
+
+	cs.mu.Lock()
+	cs.put(user, c)
+	delete(cs.loading, user)
+	cs.mu.Unlock()
+
+	l.keys, l.err = keys, err
+	close(l.done)
+
+	return keys, err
+}
+
+// put will cache the keys for the user, making room for them by removing the
+// expired users or the one that expires first.  The lock must be held
+func (cs *CachedKeyStore) put(user string, c cachedKeys) {
+	if _, found := cs.cache[user]; !found && len(cs.cache) >= maxCachedUsers {
+		now := time.Now()
+		var oldest string
+		var oldestExpires time.Time
+		for u, cc := range cs.cache {
+			if now.After(cc.expires) {
+				delete(cs.cache, u)
+				continue
+			}
+			if oldestExpires.IsZero() || cc.expires.Before(oldestExpires) {
+				oldest, oldestExpires = u, cc.expires
+			}
+		}
+
+		if len(cs.cache) >= maxCachedUsers {
+			delete(cs.cache, oldest)
+		}
+	}
+
+	cs.cache[user] = c
+}
+
+// Flush will clear the cache so the keys are loaded again on the next request
+func (cs *CachedKeyStore) Flush() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.cache = map[string]cachedKeys{}
+}
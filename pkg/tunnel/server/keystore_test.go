@@ -0,0 +1,301 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func authorizedLine(key gossh.PublicKey) string {
+	return string(gossh.MarshalAuthorizedKey(key))
+}
+
+func hasKey(keys []gossh.PublicKey, key gossh.PublicKey) bool {
+	for _, k := range keys {
+		if string(k.Marshal()) == string(key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInlineKeyStoreMatchesAllKeys(t *testing.T) {
+	k1, k2, k3 := newTestKey(t), newTestKey(t), newTestKey(t)
+	cfg := &Config{AuthorizedKeys: []string{authorizedLine(k1), "# a comment", authorizedLine(k2)}}
+	ks := &InlineKeyStore{cfg: cfg, mu: new(sync.Mutex)}
+
+	keys, err := ks.AuthorizedKeys("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || !hasKey(keys, k1) || !hasKey(keys, k2) {
+		t.Errorf("expected both keys to be found but got %d keys", len(keys))
+	}
+
+	if hasKey(keys, k3) {
+		t.Error("did not expect the third key to be found")
+	}
+}
+
+func TestFileAndDirKeyStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k1, k2, k3 := newTestKey(t), newTestKey(t), newTestKey(t)
+	fn := filepath.Join(dir, "authorized_keys")
+	ioutil.WriteFile(fn, []byte(authorizedLine(k1)+authorizedLine(k2)), 0644)
+
+	keys, err := FileKeyStore(fn).AuthorizedKeys("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !hasKey(keys, k2) {
+		t.Errorf("expected both keys from the file but got %d keys", len(keys))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "client1.pub"), []byte(authorizedLine(k3)), 0644)
+	keys, err = DirKeyStore(dir).AuthorizedKeys("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !hasKey(keys, k3) {
+		t.Errorf("expected only the key from the .pub file but got %d keys", len(keys))
+	}
+}
+
+func TestHTTPKeyStore(t *testing.T) {
+	k1, k2 := newTestKey(t), newTestKey(t)
+	requests := 0
+
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Query().Get("user") {
+		case "bob":
+			w.Write([]byte(authorizedLine(k1) + authorizedLine(k2)))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stub.Close()
+
+	ks := NewCachedKeyStore(NewHTTPKeyStore(stub.URL+"/keys"), time.Minute)
+
+	keys, err := ks.AuthorizedKeys("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !hasKey(keys, k2) {
+		t.Errorf("expected both keys for bob but got %d keys", len(keys))
+	}
+
+	keys, err = ks.AuthorizedKeys("alice")
+	if err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys and no error for alice but got %d keys and %v", len(keys), err)
+	}
+
+	if _, err := ks.AuthorizedKeys("broken"); err == nil {
+		t.Error("expected an error for a bad status")
+	}
+
+	ks.AuthorizedKeys("bob")
+	if requests != 3 {
+		t.Errorf("expected the keys for bob to be cached but there were %d requests", requests)
+	}
+
+	ks.Flush()
+	ks.AuthorizedKeys("bob")
+	if requests != 4 {
+		t.Errorf("expected the cache to be flushed but there were %d requests", requests)
+	}
+}
+
+// flakyKeyStore fails when it is down
+type flakyKeyStore struct {
+	keys  []gossh.PublicKey
+	down  bool
+	calls int
+	mu    sync.Mutex
+}
+
+func (ks *flakyKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.calls++
+	if ks.down {
+		return nil, errors.New("store is down")
+	}
+	return ks.keys, nil
+}
+
+func TestCachedKeyStoreWhenDown(t *testing.T) {
+	key := newTestKey(t)
+	store := &flakyKeyStore{keys: []gossh.PublicKey{key}}
+	ks := NewCachedKeyStore(store, 10*time.Millisecond)
+
+	if keys, _ := ks.AuthorizedKeys("bob"); !hasKey(keys, key) {
+		t.Fatal("expected the key to be found")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	store.down = true
+
+	// the keys that expired are still used while the store is down
+	keys, err := ks.AuthorizedKeys("bob")
+	if err == nil || !hasKey(keys, key) {
+		t.Errorf("expected the stale key along with the error but got %d keys and %v", len(keys), err)
+	}
+
+	// and the failure is cached so the store isn't asked on every login
+	keys, err = ks.AuthorizedKeys("bob")
+	if err == nil || !hasKey(keys, key) || store.calls != 2 {
+		t.Errorf("expected the stale key from the cache but got %d keys, %v and %d calls", len(keys), err, store.calls)
+	}
+
+	// but only for so long
+	ks.mu.Lock()
+	c := ks.cache[""]
+	c.loaded = time.Now().Add(-keyStoreMaxStale)
+	c.expires = time.Now()
+	ks.cache[""] = c
+	ks.mu.Unlock()
+
+	if keys, _ := ks.AuthorizedKeys("bob"); len(keys) != 0 {
+		t.Errorf("expected the stale key to stop working but got %d keys", len(keys))
+	}
+}
+
+func TestCachedKeyStoreOnlyServesStaleKeysFromTheSameStore(t *testing.T) {
+	k1, k2 := newTestKey(t), newTestKey(t)
+	working := &flakyKeyStore{keys: []gossh.PublicKey{k1}}
+	flaky := &flakyKeyStore{keys: []gossh.PublicKey{k2}}
+	ks := MultiKeyStore{NewCachedKeyStore(working, 10*time.Millisecond), NewCachedKeyStore(flaky, 10*time.Millisecond)}
+
+	if keys, _ := ks.AuthorizedKeys("bob"); !hasKey(keys, k1) || !hasKey(keys, k2) {
+		t.Fatal("expected both keys to be found")
+	}
+
+	// the key is removed from the store that works while the other is down
+	working.keys = nil
+	flaky.down = true
+	time.Sleep(20 * time.Millisecond)
+
+	keys, err := ks.AuthorizedKeys("bob")
+	if err == nil || hasKey(keys, k1) || !hasKey(keys, k2) {
+		t.Errorf("expected only the stale key from the store that is down but got %d keys and %v", len(keys), err)
+	}
+}
+
+func TestCachedKeyStoreSharedByUsers(t *testing.T) {
+	store := &flakyKeyStore{keys: []gossh.PublicKey{newTestKey(t)}}
+	ks := NewCachedKeyStore(store, time.Minute)
+
+	for _, user := range []string{"bob", "alice", "eve"} {
+		ks.AuthorizedKeys(user)
+	}
+
+	if store.calls != 1 || len(ks.cache) != 1 {
+		t.Errorf("expected the keys to be loaded once for every user but there were %d calls", store.calls)
+	}
+}
+
+// slowKeyStore blocks until it is released
+type slowKeyStore struct {
+	release chan struct{}
+	calls   int32
+}
+
+func (ks *slowKeyStore) AuthorizedKeys(user string) ([]gossh.PublicKey, error) {
+	atomic.AddInt32(&ks.calls, 1)
+	<-ks.release
+	return nil, nil
+}
+
+func (ks *slowKeyStore) keysVaryByUser() bool {
+	return true
+}
+
+func TestCachedKeyStoreLoadsOnce(t *testing.T) {
+	store := &slowKeyStore{release: make(chan struct{})}
+	ks := NewCachedKeyStore(store, time.Minute)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ks.AuthorizedKeys("bob")
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&store.calls); n != 1 {
+		t.Errorf("expected the concurrent requests to share one load but there were %d", n)
+	}
+}
+
+func TestCachedKeyStoreEvictsUsers(t *testing.T) {
+	store := &slowKeyStore{release: make(chan struct{})}
+	close(store.release)
+	ks := NewCachedKeyStore(store, time.Minute)
+
+	for i := 0; i < maxCachedUsers+10; i++ {
+		ks.AuthorizedKeys(strconv.Itoa(i))
+	}
+
+	if len(ks.cache) != maxCachedUsers {
+		t.Errorf("expected %d users to be cached but got %d", maxCachedUsers, len(ks.cache))
+	}
+}
+
+func TestParseAuthorizedKeysOptions(t *testing.T) {
+	k1, k2, k3, k4 := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	data := "no-pty " + authorizedLine(k1) +
+		`from="10.0.0.0/8,!10.0.0.1,192.168.1.*" ` + authorizedLine(k2) +
+		"cert-authority " + authorizedLine(k3) +
+		`permitopen="localhost:80" ` + authorizedLine(k4)
+
+	keys := ParseAuthorizedKeys([]byte(data))
+	if len(keys) != 2 || !hasKey(keys, k1) || !hasKey(keys, k2) {
+		t.Fatalf("expected only the keys without restrictions we can't enforce but got %d keys", len(keys))
+	}
+
+	if !keyAllowedFrom(keys[0], "1.2.3.4") {
+		t.Error("expected the key without from= to connect from anywhere")
+	}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"10.0.0.1", false},
+		{"192.168.1.20", true},
+		{"192.168.2.20", false},
+		{"1.2.3.4", false},
+	}
+
+	for _, tt := range tests {
+		if keyAllowedFrom(keys[1], tt.host) != tt.allowed {
+			t.Errorf("expected the key to be allowed=%v from %s", tt.allowed, tt.host)
+		}
+	}
+}
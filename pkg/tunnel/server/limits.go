@@ -0,0 +1,479 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Reasons that a connection, forward or channel was rejected
+const (
+	RejectBanned         = "banned"
+	RejectHandshakeRate  = "handshake_rate"
+	RejectMaxConns       = "max_connections"
+	RejectMaxConnsPerIP  = "max_connections_per_ip"
+	RejectMaxConnsPerKey = "max_connections_per_key"
+	RejectMaxForwards    = "max_forwards_per_session"
+	RejectMaxChannels    = "max_channels_per_session"
+)
+
+// LimitsConfig is the config for limiting connections to the server, zero
+// values mean there is no limit
+type LimitsConfig struct {
+	MaxConnections        int    `json:"max_connections,omitempty"`
+	MaxConnectionsPerIP   int    `json:"max_connections_per_ip,omitempty"`
+	MaxConnectionsPerKey  int    `json:"max_connections_per_key,omitempty"`
+	MaxHandshakesPerMin   int    `json:"max_handshakes_per_minute,omitempty"`
+	MaxAuthFailures       int    `json:"max_auth_failures,omitempty"`
+	BanDuration           string `json:"ban_duration,omitempty"`
+	MaxBanDuration        string `json:"max_ban_duration,omitempty"`
+	MaxForwardsPerSession int    `json:"max_forwards_per_session,omitempty"`
+	MaxChannelsPerSession int    `json:"max_channels_per_session,omitempty"`
+}
+
+// Ban is a temporary ban on an IP address
+type Ban struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Count  int       `json:"count"`
+	Reason string    `json:"reason"`
+}
+
+// LimitStatus is the current state of the limiter
+type LimitStatus struct {
+	Connections      int            `json:"connections"`
+	ConnectionsPerIP map[string]int `json:"connections_per_ip"`
+	Bans             []Ban          `json:"bans"`
+	Rejections       map[string]int `json:"rejections"`
+}
+
+type sessionCounts struct {
+	forwards int
+	channels int
+}
+
+// Limiter keeps track of connections to the server and enforces the
+// configured limits on them, banning IPs with too many failed logins
+type Limiter struct {
+	cfg         LimitsConfig
+	banDuration time.Duration
+	maxBan      time.Duration
+
+	conns      int
+	perIP      map[string]int
+	perKey     map[string]int
+	handshakes map[string][]time.Time
+	failures   map[string]int
+	bans       map[string]*Ban
+	sessions   map[string]*sessionCounts
+	rejections map[string]int
+	lastPrune  time.Time
+
+	mu *sync.Mutex
+}
+
+// NewLimiter will create a new limiter from the given config
+func NewLimiter(cfg LimitsConfig) (*Limiter, error) {
+	l := &Limiter{
+		cfg:        cfg,
+		perIP:      map[string]int{},
+		perKey:     map[string]int{},
+		handshakes: map[string][]time.Time{},
+		failures:   map[string]int{},
+		bans:       map[string]*Ban{},
+		sessions:   map[string]*sessionCounts{},
+		rejections: map[string]int{},
+		mu:         new(sync.Mutex),
+	}
+
+	l.banDuration, l.maxBan = time.Minute, 24*time.Hour
+
+	d, err := parseDuration(cfg.BanDuration, l.banDuration)
+	if err != nil {
+		return l, fmt.Errorf("invalid ban_duration: %s", err)
+	}
+	l.banDuration = d
+
+	d, err = parseDuration(cfg.MaxBanDuration, l.maxBan)
+	if err != nil {
+		return l, fmt.Errorf("invalid max_ban_duration: %s", err)
+	}
+	l.maxBan = d
+
+	return l, nil
+}
+
+// parseDuration will parse the given duration, returning the default if it is empty
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// hostOf will return the IP from the given address
+func hostOf(addr net.Addr) string {
+	return hostOfAddr(addr.String())
+}
+
+// hostOfAddr will return the host part of the given address
+func hostOfAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Connect will check if a new connection from the given IP is allowed, returning
+// the reason if it isn't.  If it is allowed the returned func must be called
+// when the connection closes
+func (l *Limiter) Connect(ip string) (func(), string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	if l.bannedLocked(ip, now) {
+		return nil, l.reject(RejectBanned)
+	}
+
+	if max := l.cfg.MaxHandshakesPerMin; max > 0 {
+		hs := append(recent(l.handshakes[ip], now.Add(-time.Minute)), now)
+		l.handshakes[ip] = hs
+		if len(hs) > max {
+			return nil, l.reject(RejectHandshakeRate)
+		}
+	}
+
+	if max := l.cfg.MaxConnections; max > 0 && l.conns >= max {
+		return nil, l.reject(RejectMaxConns)
+	}
+
+	if max := l.cfg.MaxConnectionsPerIP; max > 0 && l.perIP[ip] >= max {
+		return nil, l.reject(RejectMaxConnsPerIP)
+	}
+
+	l.conns++
+	l.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.conns--
+			if l.perIP[ip]--; l.perIP[ip] <= 0 {
+				delete(l.perIP, ip)
+			}
+		})
+	}, ""
+}
+
+// KeyConnected will check if another connection is allowed for the key with
+// the given fingerprint, returning the reason if it isn't.  If it is allowed
+// then it is counted until the context is done
+func (l *Limiter) KeyConnected(ctx ssh.Context, fp string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if max := l.cfg.MaxConnectionsPerKey; max > 0 && l.perKey[fp] >= max {
+		return l.reject(RejectMaxConnsPerKey)
+	}
+
+	// the channel is got here as the context changes while the auth finishes
+	done := ctx.Done()
+	l.perKey[fp]++
+	go func() {
+		<-done
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.perKey[fp]--; l.perKey[fp] <= 0 {
+			delete(l.perKey, fp)
+		}
+	}()
+
+	return ""
+}
+
+// IsBanned will return true if the IP is currently banned
+func (l *Limiter) IsBanned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bannedLocked(ip, time.Now())
+}
+
+// AuthFailed will record a failed authentication attempt from the given IP,
+// returning the ban if the IP was banned because of it.  Each time the IP is
+// banned the ban lasts twice as long as the last one
+func (l *Limiter) AuthFailed(ip string) *Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cfg.MaxAuthFailures <= 0 {
+		return nil
+	}
+
+	l.failures[ip]++
+	if l.failures[ip] < l.cfg.MaxAuthFailures {
+		return nil
+	}
+	delete(l.failures, ip)
+
+	ban, found := l.bans[ip]
+	if !found {
+		ban = &Ban{IP: ip}
+		l.bans[ip] = ban
+	}
+
+	dur := l.banDuration
+	for i := 0; i < ban.Count && dur < l.maxBan; i++ {
+		dur *= 2
+	}
+	if dur > l.maxBan {
+		dur = l.maxBan
+	}
+
+	ban.Count++
+	ban.Until = time.Now().Add(dur)
+	ban.Reason = fmt.Sprintf("%d failed authentication attempts", l.cfg.MaxAuthFailures)
+
+	b := *ban
+	return &b
+}
+
+// AuthSucceeded will reset the failed authentication attempts for the given IP
+func (l *Limiter) AuthSucceeded(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, ip)
+}
+
+// Unban will remove the ban for the given IP
+func (l *Limiter) Unban(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.bans[ip]; !found {
+		return fmt.Errorf("%s is not banned", ip)
+	}
+
+	delete(l.bans, ip)
+	return nil
+}
+
+// AddForward will check if the session can add another reverse forward,
+// returning the reason if it can't
+func (l *Limiter) AddForward(ctx ssh.Context) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sess := l.session(ctx)
+	if max := l.cfg.MaxForwardsPerSession; max > 0 && sess.forwards >= max {
+		return l.reject(RejectMaxForwards)
+	}
+
+	sess.forwards++
+	return ""
+}
+
+// RemoveForward will remove a reverse forward from the sessions count
+func (l *Limiter) RemoveForward(ctx ssh.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if sess := l.session(ctx); sess.forwards > 0 {
+		sess.forwards--
+	}
+}
+
+// OpenChannel will check if the session can open another channel, returning the
+// reason if it can't.  If it can, the returned func must be called when the
+// channel closes
+func (l *Limiter) OpenChannel(ctx ssh.Context) (func(), string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sess := l.session(ctx)
+	if max := l.cfg.MaxChannelsPerSession; max > 0 && sess.channels >= max {
+		return nil, l.reject(RejectMaxChannels)
+	}
+
+	sess.channels++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			sess.channels--
+		})
+	}, ""
+}
+
+// Channels will return the number of channels the session with the given ID has open
+func (l *Limiter) Channels(id string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if sess, found := l.sessions[id]; found {
+		return sess.channels
+	}
+	return 0
+}
+
+// Status will return the current state of the limiter
+func (l *Limiter) Status() LimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	st := LimitStatus{
+		Connections:      l.conns,
+		ConnectionsPerIP: map[string]int{},
+		Bans:             []Ban{},
+		Rejections:       map[string]int{},
+	}
+
+	for ip, n := range l.perIP {
+		st.ConnectionsPerIP[ip] = n
+	}
+
+	for _, ban := range l.bans {
+		if ban.Until.After(now) {
+			st.Bans = append(st.Bans, *ban)
+		}
+	}
+	sort.Slice(st.Bans, func(i, j int) bool { return st.Bans[i].Until.Before(st.Bans[j].Until) })
+
+	for r, n := range l.rejections {
+		st.Rejections[r] = n
+	}
+
+	return st
+}
+
+// session will return the counts for the session, creating them if needed
+// and removing them when the session is done
+func (l *Limiter) session(ctx ssh.Context) *sessionCounts {
+	id := ctx.SessionID()
+	sess, found := l.sessions[id]
+	if !found {
+		sess = &sessionCounts{}
+		l.sessions[id] = sess
+		go func() {
+			<-ctx.Done()
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.sessions, id)
+		}()
+	}
+	return sess
+}
+
+func (l *Limiter) reject(reason string) string {
+	l.rejections[reason]++
+	return reason
+}
+
+func (l *Limiter) bannedLocked(ip string, now time.Time) bool {
+	ban, found := l.bans[ip]
+	return found && ban.Until.After(now)
+}
+
+// prune will forget about handshakes that are too old to matter, this
+// is done at most once a minute
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for ip, hs := range l.handshakes {
+		if hs = recent(hs, now.Add(-time.Minute)); len(hs) == 0 {
+			delete(l.handshakes, ip)
+			continue
+		}
+		l.handshakes[ip] = hs
+	}
+
+	// forget about old bans once they wouldn't make the next one any longer
+	for ip, ban := range l.bans {
+		if now.Sub(ban.Until) > l.maxBan {
+			delete(l.bans, ip)
+		}
+	}
+}
+
+// recent will return the times that are after the given time
+func recent(times []time.Time, after time.Time) []time.Time {
+	for i, t := range times {
+		if t.After(after) {
+			return times[i:]
+		}
+	}
+	return times[:0]
+}
+
+// markAuthFailed will mark the connection as having failed to authenticate,
+// which is only counted once it has closed without authenticating
+func markAuthFailed(ctx ssh.Context) {
+	if tc, ok := ctx.Value(contextKeyConn).(*trackedConn); ok {
+		tc.setAuthFailed(true)
+	}
+}
+
+// handshakeEnded will count the connection as one failed authentication if it
+// closed without ever authenticating, no matter how many keys it tried
+func (svr *Server) handshakeEnded(tc *trackedConn) {
+	tc.mu.Lock()
+	failed := tc.authFailed && tc.started.IsZero()
+	tc.mu.Unlock()
+
+	if failed {
+		svr.authFailed(tc.RemoteAddr())
+	}
+}
+
+// authFailed will record the failed authentication attempt and
+// announce if the IP was banned because of it
+func (svr *Server) authFailed(addr net.Addr) {
+	ban := svr.limits.AuthFailed(hostOf(addr))
+	if ban == nil {
+		return
+	}
+
+	svr.events.Go("log", fmt.Sprintf("banned %s until %s after %s", ban.IP, ban.Until.Format(time.RFC3339), ban.Reason))
+	svr.events.Go("limit.banned", ban)
+}
+
+// limitForwards will wrap the tcpip-forward request handler so that the
+// number of reverse forwards in each session is limited
+func (svr *Server) limitForwards(handler ssh.RequestHandler) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		if req.Type != "tcpip-forward" {
+			ok, payload := handler(ctx, srv, req)
+			if ok {
+				svr.limits.RemoveForward(ctx)
+			}
+			return ok, payload
+		}
+
+		if reason := svr.limits.AddForward(ctx); reason != "" {
+			svr.rejected(ctx.RemoteAddr(), reason)
+			return false, []byte("too many forwards")
+		}
+
+		ok, payload := handler(ctx, srv, req)
+		if !ok {
+			svr.limits.RemoveForward(ctx)
+		}
+		return ok, payload
+	}
+}
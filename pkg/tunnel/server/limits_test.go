@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestLimiterBansWithExponentialDuration(t *testing.T) {
+	l, err := NewLimiter(LimitsConfig{MaxAuthFailures: 2, BanDuration: "1m", MaxBanDuration: "3m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute}
+	for i, dur := range expected {
+		if ban := l.AuthFailed("1.2.3.4"); ban != nil {
+			t.Fatalf("ban %d happened too early", i+1)
+		}
+
+		ban := l.AuthFailed("1.2.3.4")
+		if ban == nil {
+			t.Fatalf("expected ban %d", i+1)
+		}
+
+		if left := time.Until(ban.Until); left > dur || left < dur-time.Second {
+			t.Errorf("expected ban %d to last %s but it lasts %s", i+1, dur, left)
+		}
+	}
+
+	if !l.IsBanned("1.2.3.4") || l.IsBanned("1.2.3.5") {
+		t.Error("expected only the first IP to be banned")
+	}
+
+	if _, reason := l.Connect("1.2.3.4"); reason != RejectBanned {
+		t.Errorf("expected the banned IP to be rejected but got %q", reason)
+	}
+
+	l.Unban("1.2.3.4")
+	if l.IsBanned("1.2.3.4") {
+		t.Error("expected the IP to be unbanned")
+	}
+}
+
+func TestLimiterConnections(t *testing.T) {
+	l, _ := NewLimiter(LimitsConfig{MaxConnections: 3, MaxConnectionsPerIP: 2})
+
+	done1, _ := l.Connect("1.2.3.4")
+	l.Connect("1.2.3.4")
+	if _, reason := l.Connect("1.2.3.4"); reason != RejectMaxConnsPerIP {
+		t.Errorf("expected the per IP limit to be hit but got %q", reason)
+	}
+
+	l.Connect("1.2.3.5")
+	if _, reason := l.Connect("1.2.3.6"); reason != RejectMaxConns {
+		t.Errorf("expected the global limit to be hit but got %q", reason)
+	}
+
+	done1()
+	done1()
+	if _, reason := l.Connect("1.2.3.6"); reason != "" {
+		t.Errorf("expected the connection to be allowed after one closed but got %q", reason)
+	}
+
+	st := l.Status()
+	if st.Connections != 3 || st.Rejections[RejectMaxConns] != 1 || st.Rejections[RejectMaxConnsPerIP] != 1 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestLimiterHandshakeRate(t *testing.T) {
+	l, _ := NewLimiter(LimitsConfig{MaxHandshakesPerMin: 2})
+
+	for i := 0; i < 2; i++ {
+		done, reason := l.Connect("1.2.3.4")
+		if reason != "" {
+			t.Fatalf("handshake %d was rejected: %s", i+1, reason)
+		}
+		done()
+	}
+
+	if _, reason := l.Connect("1.2.3.4"); reason != RejectHandshakeRate {
+		t.Errorf("expected the handshake rate to be hit but got %q", reason)
+	}
+}
+
+// authFailures will return how many failed logins were counted for the IP
+func authFailures(svr *Server, ip string) int {
+	svr.limits.mu.Lock()
+	defer svr.limits.mu.Unlock()
+	return svr.limits.failures[ip]
+}
+
+// waitForClosed will wait for the server to finish with all the connections
+func waitForClosed(svr *Server) {
+	for i := 0; i < 100 && svr.limits.Status().Connections > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuthFailuresCountedPerConnection(t *testing.T) {
+	svr, addr := startTestServer(t, &Config{Limits: LimitsConfig{MaxAuthFailures: 2}})
+
+	// an agent offering several keys is only one failure
+	if _, err := dialTestServer(addr, newTestSigner(t), newTestSigner(t), newTestSigner(t)); err == nil {
+		t.Fatal("expected the unknown keys to be refused")
+	}
+
+	waitForClosed(svr)
+	if n := authFailures(svr, "127.0.0.1"); n != 1 {
+		t.Errorf("expected 1 failure for the connection but got %d", n)
+	}
+
+	if svr.limits.IsBanned("127.0.0.1") {
+		t.Error("expected one connection not to be banned")
+	}
+}
+
+func TestAuthFailuresSkipFirstPendingAttempt(t *testing.T) {
+	svr, addr := startTestServer(t, &Config{QueueUnknownKeys: true, Limits: LimitsConfig{MaxAuthFailures: 3}})
+
+	// only the first attempt with a key waiting for approval is free
+	signer := newTestSigner(t)
+	for i := 0; i < 3; i++ {
+		if _, err := dialTestServer(addr, signer); err == nil {
+			t.Fatal("expected the pending key to be refused")
+		}
+		waitForClosed(svr)
+	}
+
+	if n := authFailures(svr, "127.0.0.1"); n != 2 || svr.limits.IsBanned("127.0.0.1") {
+		t.Errorf("expected the retries to count as 2 failures but got %d", n)
+	}
+
+	if len(svr.pending.Pending()) != 1 {
+		t.Error("expected the key to be pending")
+	}
+}
+
+// unsignedSigner has the public key of another signer but can't sign with it,
+// like a client that only knows the public key.  It waits to be released
+// before failing to sign, after the server has said it accepts the key
+type unsignedSigner struct {
+	gossh.Signer
+	accepted chan struct{}
+	release  chan struct{}
+}
+
+func (s *unsignedSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	close(s.accepted)
+	<-s.release
+	return nil, errors.New("no private key")
+}
+
+func TestAcceptedKeyIsOnlyCountedOnceSigned(t *testing.T) {
+	signer := newTestSigner(t)
+	svr, addr := startTestServer(t, &Config{
+		AuthorizedKeys: []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))},
+		Limits:         LimitsConfig{MaxConnectionsPerKey: 1, MaxAuthFailures: 5},
+	})
+
+	// tries an unknown key and then the authorized one it can't sign with
+	unsigned := &unsignedSigner{Signer: signer, accepted: make(chan struct{}), release: make(chan struct{})}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := dialTestServer(addr, newTestSigner(t), unsigned)
+		errc <- err
+	}()
+
+	select {
+	case <-unsigned.accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to accept the key")
+	}
+
+	// the key isn't using a connection yet, so the real client can connect
+	client, err := dialTestServer(addr, signer)
+	if err != nil {
+		t.Fatalf("expected the client with the private key to connect but got %v", err)
+	}
+	client.Close()
+
+	close(unsigned.release)
+	if err := <-errc; err == nil {
+		t.Fatal("expected the client without the private key to fail")
+	}
+
+	// and the failed login isn't reset by the key being accepted
+	waitForClosed(svr)
+	if n := authFailures(svr, "127.0.0.1"); n != 1 {
+		t.Errorf("expected the client that couldn't sign to count as a failure but got %d", n)
+	}
+}
+
+func TestTooManyConnectionsForKey(t *testing.T) {
+	signer := newTestSigner(t)
+	svr, addr := startTestServer(t, &Config{
+		AuthorizedKeys: []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))},
+		Limits:         LimitsConfig{MaxConnectionsPerKey: 1},
+	})
+
+	client, err := dialTestServer(addr, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := dialTestServer(addr, signer); err == nil {
+		t.Error("expected the second connection for the key to be closed")
+	}
+
+	if n := svr.limits.Status().Rejections[RejectMaxConnsPerKey]; n != 1 {
+		t.Errorf("expected 1 rejection for the key but got %d", n)
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrPendingQueueFull is returned when there is no room to queue another key
+var ErrPendingQueueFull = errors.New("too many keys are waiting for approval")
+
+// the most keys that can be waiting for approval, in total and from one address
+const (
+	maxPendingKeys       = 100
+	maxPendingPerAddress = 5
+)
+
+// PendingKey is a public key that tried to authenticate but was not
+// authorized, waiting for someone to approve or deny it
+type PendingKey struct {
+	Fingerprint string    `json:"fingerprint"`
+	Type        string    `json:"type"`
+	User        string    `json:"user"`
+	Address     string    `json:"address"`
+	Key         string    `json:"key"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Attempts    int       `json:"attempts"`
+	Denied      bool      `json:"denied"`
+
+	from  string          // the address that first queued the key
+	hosts map[string]bool // the addresses the key has been tried from
+}
+
+// copy will return a copy of the key that can be used after the queue is unlocked
+func (pk *PendingKey) copy() *PendingKey {
+	if pk == nil {
+		return nil
+	}
+	cp := *pk
+	cp.hosts = nil
+	return &cp
+}
+
+// PendingQueue is a persistent queue of keys that are waiting for approval
+type PendingQueue struct {
+	filename   string
+	keys       map[string]*PendingKey
+	maxKeys    int
+	maxPerAddr int
+	mu         *sync.Mutex
+}
+
+// NewPendingQueue will create a new pending queue persisted to the given
+// filename, loading any keys that were already saved in it.  If the filename
+// is empty the queue will only be kept in memory
+func NewPendingQueue(filename string) (*PendingQueue, error) {
+	q := &PendingQueue{
+		filename:   filename,
+		keys:       map[string]*PendingKey{},
+		maxKeys:    maxPendingKeys,
+		maxPerAddr: maxPendingPerAddress,
+		mu:         new(sync.Mutex),
+	}
+	if filename == "" {
+		return q, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return q, err
+	}
+
+	keys := []*PendingKey{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return q, err
+	}
+
+	for _, k := range keys {
+		k.from = hostOfAddr(k.Address)
+		k.hosts = map[string]bool{k.from: true}
+		q.keys[k.Fingerprint] = k
+	}
+
+	return q, nil
+}
+
+// Add will add the key to the queue, or update when it was last seen if it
+// is already in there, returning the pending entry for the key and true if
+// this is the first time the key was tried from the address.  Only new keys
+// are saved to the file, so that a client retrying doesn't keep rewriting it.
+// ErrPendingQueueFull is returned if a new key would take the queue, or the
+// keys queued from the address, over the limit
+func (q *PendingQueue) Add(user, addr string, key gossh.PublicKey) (*PendingKey, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	fp := gossh.FingerprintSHA256(key)
+	host := hostOfAddr(addr)
+	now := time.Now()
+
+	pk, found := q.keys[fp]
+	if found {
+		first := !pk.hosts[host]
+		pk.hosts[host] = true
+		pk.User = user
+		pk.Address = addr
+		pk.LastSeen = now
+		pk.Attempts++
+		return pk.copy(), first, nil
+	}
+
+	if q.full(host) {
+		return nil, false, ErrPendingQueueFull
+	}
+
+	pk = &PendingKey{
+		Fingerprint: fp,
+		Type:        key.Type(),
+		User:        user,
+		Address:     addr,
+		Key:         strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))),
+		FirstSeen:   now,
+		LastSeen:    now,
+		Attempts:    1,
+		from:        host,
+		hosts:       map[string]bool{host: true},
+	}
+	q.keys[fp] = pk
+
+	return pk.copy(), true, q.save()
+}
+
+// full will return true if there is no room for another key from the given
+// host, denied keys don't take up any room
+func (q *PendingQueue) full(host string) bool {
+	total, fromHost := 0, 0
+	for _, pk := range q.keys {
+		if pk.Denied {
+			continue
+		}
+		total++
+		if pk.from == host {
+			fromHost++
+		}
+	}
+
+	return (q.maxKeys > 0 && total >= q.maxKeys) || (q.maxPerAddr > 0 && fromHost >= q.maxPerAddr)
+}
+
+// Get will return the pending key with the given fingerprint
+func (q *PendingQueue) Get(fp string) (*PendingKey, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pk, found := q.keys[fp]
+	return pk.copy(), found
+}
+
+// IsDenied will return true if the key with the given fingerprint was denied
+func (q *PendingQueue) IsDenied(fp string) bool {
+	pk, found := q.Get(fp)
+	return found && pk.Denied
+}
+
+// Deny will mark the key as denied so that it no longer shows as pending
+func (q *PendingQueue) Deny(fp string) (*PendingKey, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pk, found := q.keys[fp]
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+
+	pk.Denied = true
+	return pk.copy(), q.save()
+}
+
+// Remove will remove the key with the given fingerprint from the queue
+func (q *PendingQueue) Remove(fp string) (*PendingKey, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pk, found := q.keys[fp]
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+
+	delete(q.keys, fp)
+	return pk, q.save()
+}
+
+// Pending will return copies of the keys waiting for approval, oldest first
+func (q *PendingQueue) Pending() []*PendingKey {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys := []*PendingKey{}
+	for _, pk := range q.keys {
+		if !pk.Denied {
+			keys = append(keys, pk.copy())
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].FirstSeen.Before(keys[j].FirstSeen) })
+	return keys
+}
+
+func (q *PendingQueue) save() error {
+	if q.filename == "" {
+		return nil
+	}
+
+	keys := []*PendingKey{}
+	for _, pk := range q.keys {
+		keys = append(keys, pk)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].FirstSeen.Before(keys[j].FirstSeen) })
+
+	data, err := yaml.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(q.filename, data, 0600)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestKey(t *testing.T) gossh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestPendingQueuePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "pending")
+
+	q, err := NewPendingQueue(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestKey(t)
+	q.Add("bob", "1.2.3.4:5555", key)
+	pk, first, _ := q.Add("bob", "1.2.3.4:5556", key)
+	if pk.Attempts != 2 || first {
+		t.Errorf("expected 2 attempts from the same address but got %d", pk.Attempts)
+	}
+
+	q, err = NewPendingQueue(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := q.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending key but got %d", len(pending))
+	}
+
+	// repeat attempts aren't saved
+	if pending[0].Fingerprint != gossh.FingerprintSHA256(key) || pending[0].Address != "1.2.3.4:5555" || pending[0].Attempts != 1 {
+		t.Errorf("unexpected pending key: %+v", pending[0])
+	}
+
+	if _, err := q.Deny(pending[0].Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(q.Pending()) != 0 || !q.IsDenied(pending[0].Fingerprint) {
+		t.Error("expected the key to be denied")
+	}
+}
+
+func TestPendingQueueReturnsCopies(t *testing.T) {
+	q, _ := NewPendingQueue("")
+	key := newTestKey(t)
+	q.Add("bob", "1.2.3.4:5555", key)
+
+	pending := q.Pending()
+	q.Add("alice", "1.2.3.4:5556", key)
+
+	if pending[0].Attempts != 1 || pending[0].User != "bob" {
+		t.Errorf("expected the returned key not to change when it is seen again: %+v", pending[0])
+	}
+}
+
+func TestPendingQueueFirstAttemptFromAddress(t *testing.T) {
+	q, _ := NewPendingQueue("")
+	key := newTestKey(t)
+
+	attempts := []struct {
+		addr  string
+		first bool
+	}{
+		{"1.2.3.4:5555", true},
+		{"1.2.3.4:5556", false},
+		{"5.6.7.8:5555", true},
+		{"1.2.3.4:5557", false},
+	}
+
+	for _, a := range attempts {
+		if _, first, _ := q.Add("bob", a.addr, key); first != a.first {
+			t.Errorf("expected the attempt from %s to be first=%v", a.addr, a.first)
+		}
+	}
+}
+
+func TestPendingQueueLimits(t *testing.T) {
+	q, _ := NewPendingQueue("")
+	q.maxKeys = 3
+	q.maxPerAddr = 2
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := q.Add("bob", "1.2.3.4:5555", newTestKey(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := q.Add("bob", "1.2.3.4:5555", newTestKey(t)); err != ErrPendingQueueFull {
+		t.Errorf("expected the address to be limited but got %v", err)
+	}
+
+	if _, _, err := q.Add("bob", "5.6.7.8:5555", newTestKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := q.Add("bob", "9.9.9.9:5555", newTestKey(t)); err != ErrPendingQueueFull {
+		t.Errorf("expected the queue to be full but got %v", err)
+	}
+
+	// denied keys don't take up room
+	q.Deny(q.Pending()[0].Fingerprint)
+	if _, _, err := q.Add("bob", "9.9.9.9:5555", newTestKey(t)); err != nil {
+		t.Errorf("expected room after a key was denied but got %v", err)
+	}
+}
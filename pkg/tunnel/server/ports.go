@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoFreePorts is returned when every port in the reverse port range is being used
+var ErrNoFreePorts = errors.New("no free ports in the reverse port range")
+
+// ReversePortRange will return the range of ports that reverse forwards asking
+// for port 0 are given one from, or zeros if the OS should pick the port
+func (cfg Config) ReversePortRange() (int, int, error) {
+	if cfg.ReversePorts == "" {
+		return 0, 0, nil
+	}
+
+	bits := strings.SplitN(cfg.ReversePorts, "-", 2)
+	if len(bits) != 2 {
+		return 0, 0, fmt.Errorf("invalid reverse_ports %q, should be like 20000-20999", cfg.ReversePorts)
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(bits[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid reverse_ports %q: %s", cfg.ReversePorts, err)
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(bits[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid reverse_ports %q: %s", cfg.ReversePorts, err)
+	}
+
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid reverse_ports %q, should be between 1 and 65535", cfg.ReversePorts)
+	}
+
+	return min, max, nil
+}
+
+// listen will listen for a reverse forward on the given address, when the port
+// is 0 and a port range is configured a free port is picked from the range
+func (rf *reverseForwards) listen(host string, port uint32) (net.Listener, error) {
+	min, max, err := rf.svr.cfg.ReversePortRange()
+	if port != 0 || err != nil || max == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+
+	// start somewhere random so that ports aren't reused straight away
+	n := max - min + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		p := min + (start+i)%n
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p)))
+		if err == nil {
+			return ln, nil
+		}
+	}
+
+	return nil, ErrNoFreePorts
+}
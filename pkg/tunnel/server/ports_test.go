@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestReversePortRange(t *testing.T) {
+	for _, s := range []string{"20000", "b-20", "20-b", "0-10", "30-20", "60000-70000"} {
+		if _, _, err := (Config{ReversePorts: s}).ReversePortRange(); err == nil {
+			t.Errorf("expected the range %q to be invalid", s)
+		}
+	}
+
+	min, max, err := Config{ReversePorts: "20000 - 20999"}.ReversePortRange()
+	if err != nil || min != 20000 || max != 20999 {
+		t.Errorf("expected the range 20000-20999 but got %d-%d: %v", min, max, err)
+	}
+}
+
+func TestListenReverseInRange(t *testing.T) {
+	// find two free ports next to each other
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	svr := &Server{cfg: &Config{ReversePorts: strconv.Itoa(port) + "-" + strconv.Itoa(port+1)}}
+	rf := newReverseForwards(svr)
+
+	seen := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		ln, err := rf.listen("127.0.0.1", 0)
+		if err != nil {
+			t.Skipf("the ports next to %d aren't free: %s", port, err)
+		}
+		defer ln.Close()
+		seen[ln.Addr().(*net.TCPAddr).Port] = true
+	}
+
+	if !seen[port] || !seen[port+1] {
+		t.Errorf("expected both ports in the range to be used but got %v", seen)
+	}
+
+	if _, err := rf.listen("127.0.0.1", 0); err != ErrNoFreePorts {
+		t.Errorf("expected no free ports but got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/penguinpowernz/mole/pkg/proxyproto"
+)
+
+// ProxyProtocolConfig makes the server send a PROXY protocol header to the
+// destinations of local port forwards, so that they can see the address of the
+// client instead of the server.  A destination of * sends it to all of them
+type ProxyProtocolConfig struct {
+	Version      string   `json:"version,omitempty"`
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+// validateProxyProtocol will return an error if the PROXY protocol version is invalid
+func (cfg Config) validateProxyProtocol() error {
+	if len(cfg.ProxyProtocol.Destinations) == 0 {
+		return nil
+	}
+	return proxyproto.Validate(cfg.ProxyProtocol.Version)
+}
+
+// sendsTo will return true if a header should be sent to the destination
+func (pc ProxyProtocolConfig) sendsTo(dest string) bool {
+	for _, d := range pc.Destinations {
+		if d == "*" || d == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// sendProxyHeader will write the PROXY protocol header for the forwarded
+// connection with the address of the client as the source.  The origin in the
+// channel request is ignored as the client can put anything there.  Version 2
+// headers include the fingerprint of the key the client authenticated with
+func (svr *Server) sendProxyHeader(ctx ssh.Context, nc net.Conn) error {
+	h := proxyproto.Header{
+		Version:     svr.cfg.ProxyProtocol.Version,
+		Source:      ctx.RemoteAddr(),
+		Destination: nc.RemoteAddr(),
+	}
+
+	if fp := fingerprintOf(ctx); fp != "" && h.Version == proxyproto.V2 {
+		h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TypeFingerprint, Value: []byte(fp)})
+	}
+
+	return h.Write(nc)
+}
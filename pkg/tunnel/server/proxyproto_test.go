@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestProxyHeaderUsesClientAddress(t *testing.T) {
+	signer := newTestSigner(t)
+	_, addr := startTestServer(t, &Config{
+		AuthorizedKeys: []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))},
+		ProxyProtocol:  ProxyProtocolConfig{Version: "v1", Destinations: []string{"*"}},
+	})
+
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := dest.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- line
+	}()
+
+	client, err := dialTestServer(addr, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the client claims the connection came from somewhere else
+	_, port, _ := net.SplitHostPort(dest.Addr().String())
+	p, _ := strconv.Atoi(port)
+	ch, reqs, err := client.OpenChannel("direct-tcpip", gossh.Marshal(&struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}{"127.0.0.1", uint32(p), "203.0.113.7", 4444}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	go gossh.DiscardRequests(reqs)
+
+	local := client.LocalAddr().(*net.TCPAddr)
+	expected := "PROXY TCP4 127.0.0.1 127.0.0.1 " + strconv.Itoa(local.Port) + " " + port + "\r\n"
+
+	select {
+	case header := <-headers:
+		if header != expected {
+			t.Errorf("expected the header %q but got %q", expected, header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the destination to get a PROXY header")
+	}
+}
@@ -3,38 +3,106 @@ package server
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/AlexanderGrom/go-event"
 	"github.com/gliderlabs/ssh"
-	"github.com/penguinpowernz/mole/internal/app"
+	"github.com/penguinpowernz/mole/pkg/sshutil"
 	gossh "golang.org/x/crypto/ssh"
 )
 
 // Server represents the tunnel server
 type Server struct {
 	*ssh.Server
-	cfg    *Config
-	events event.Dispatcher
+	cfg     *Config
+	events  event.Dispatcher
+	pending *PendingQueue
+	tokens  *TokenStore
+	keys    MultiKeyStore
+	limits  *Limiter
+	audits  AuditSink
+	mu      *sync.Mutex
+
+	forwards *reverseForwards
+	bridges  *bridgeCounter
+	draining int32
 }
 
 // NewServer will create a new tunnel server using the given config
 // events dispatcher
 func NewServer(cfg *Config, events event.Dispatcher) *Server {
-	svr := &Server{cfg: cfg, events: events}
+	svr := &Server{cfg: cfg, events: events, mu: new(sync.Mutex), bridges: newBridgeCounter()}
+	svr.forwards = newReverseForwards(svr)
 	svr.buildSSHServer()
 
+	var err error
+	svr.keys, err = NewKeyStore(cfg, svr.mu)
+	if err != nil {
+		svr.events.Go("error", err)
+		svr.keys = MultiKeyStore{NewCachedKeyStore(&InlineKeyStore{cfg: cfg, mu: svr.mu}, time.Minute)}
+	}
+
+	svr.pending, err = NewPendingQueue(cfg.PendingKeysFilename())
+	if err != nil {
+		svr.events.Go("error", fmt.Errorf("failed to load pending keys from %s: %s", cfg.PendingKeysFilename(), err))
+	}
+
+	svr.tokens, err = NewTokenStore(cfg.TokensFilename())
+	if err != nil {
+		svr.events.Go("error", fmt.Errorf("failed to load enrollment tokens from %s: %s", cfg.TokensFilename(), err))
+	}
+
+	svr.limits, err = NewLimiter(cfg.Limits)
+	if err != nil {
+		svr.events.Go("error", err)
+	}
+
+	if err := cfg.validateTimeouts(); err != nil {
+		svr.events.Go("error", err)
+	}
+
+	if err := cfg.validateAliases(); err != nil {
+		svr.events.Go("error", err)
+	}
+
+	if _, _, err := cfg.ReversePortRange(); err != nil {
+		svr.events.Go("error", err)
+	}
+
+	if err := cfg.validateProxyProtocol(); err != nil {
+		svr.events.Go("error", err)
+	}
+
+	svr.audits, err = NewAuditSink(cfg.Audit)
+	if err != nil {
+		svr.events.Go("error", fmt.Errorf("failed to open the audit log: %s", err))
+	}
+
 	svr.SetOption(ssh.WrapConn(func(ctx ssh.Context, conn net.Conn) net.Conn {
+		done, reason := svr.limits.Connect(hostOf(conn.RemoteAddr()))
+		if reason != "" {
+			svr.rejected(conn.RemoteAddr(), reason)
+			return nil
+		}
+
 		svr.events.Go("log", fmt.Sprintf("New connection from %s", conn.RemoteAddr().String()))
-		return conn
+		tc := newTrackedConn(conn, func(tc *trackedConn) {
+			svr.handshakeEnded(tc)
+			done()
+			svr.sessionEnded(tc)
+		})
+		ctx.SetValue(contextKeyConn, tc)
+		return tc
 	}))
 
 	svr.SetOption(ssh.PublicKeyAuth(svr.IsKeyAuthorized))
+	svr.SetOption(ssh.KeyboardInteractiveAuth(svr.EnrollmentAuth))
 	svr.SetOption(ssh.HostKeyPEM([]byte(cfg.HostKey)))
 	svr.SetOption(ssh.NoPty())
 
@@ -42,91 +110,181 @@ func NewServer(cfg *Config, events event.Dispatcher) *Server {
 }
 
 func (svr *Server) buildSSHServer() {
-	forwardHandler := &ssh.ForwardedTCPHandler{}
-
 	svr.Server = &ssh.Server{
 		Addr: svr.cfg.ListenPort,
+		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
+			return &gossh.ServerConfig{
+				// only called without an error once the client has authenticated
+				AuthLogCallback: func(conn gossh.ConnMetadata, method string, err error) {
+					if err == nil {
+						svr.authenticated(ctx, conn, method)
+					}
+				},
+			}
+		},
 		LocalPortForwardingCallback: ssh.LocalPortForwardingCallback(func(ctx ssh.Context, dhost string, dport uint32) bool {
-			log.Println("Accepted forward", dhost, dport, "from", ctx.RemoteAddr().String())
-			return true
+			return !isEnrollment(ctx)
 		}),
 		Handler: ssh.Handler(func(s ssh.Session) {
-			log.Printf("%+v\n", s.RemoteAddr().String())
 			select {}
 		}),
 		ReversePortForwardingCallback: ssh.ReversePortForwardingCallback(func(ctx ssh.Context, host string, port uint32) bool {
-			log.Println("attempt to bind", host, port, "granted")
-			return true
+			return !isEnrollment(ctx)
 		}),
 		RequestHandlers: map[string]ssh.RequestHandler{
-			"tcpip-forward":        forwardHandler.HandleSSHRequest,
-			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+			"tcpip-forward":        svr.auditForwards(svr.limitForwards(svr.forwards.HandleSSHRequest)),
+			"cancel-tcpip-forward": svr.auditForwards(svr.limitForwards(svr.forwards.HandleSSHRequest)),
 		},
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"direct-tcpip": func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
-				log.Println("directtcp", srv.Addr, conn.LocalAddr(), conn.RemoteAddr())
-				ssh.DirectTCPIPHandler(srv, conn, newChan, ctx)
-				log.Println("directtcp", srv.Addr, conn.LocalAddr(), conn.RemoteAddr())
-			},
-			"session": ssh.DefaultSessionHandler,
-			"iotunnel": func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
-				log.Println("iotunnel", srv.Addr, conn.LocalAddr(), conn.RemoteAddr())
-				log.Println("arbdata", string(newChan.ExtraData()))
+			"direct-tcpip":            svr.handleDirectTCPIP,
+			"session":                 requireKeyAuth(ssh.DefaultSessionHandler),
+			sshutil.EnrollChannelType: svr.handleEnroll,
+			"iotunnel": requireKeyAuth(func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+				svr.events.Go("log", fmt.Sprintf("iotunnel from %s: %s", conn.RemoteAddr(), newChan.ExtraData()))
 				outch, inch, _ := newChan.Accept()
 				r := <-inch
-				log.Println(r.Type, string(r.Payload))
+				svr.events.Go("log", fmt.Sprintf("iotunnel request %s: %s", r.Type, r.Payload))
 				outch.Write([]byte(`see ya later aligator`))
 				outch.Close()
-			},
+			}),
 		},
 	}
 }
 
-// ListenAndServe will run the server until the context is done or
-// the server quits for some reason
+// ListenAndServe will run the server until the context is done or the server
+// quits for some reason.  When the context is done the server is still running
+// so that Drain can be called to let the existing connections finish
 func (svr *Server) ListenAndServe(ctx context.Context) {
 	svrStopped := make(chan struct{})
 	go func() {
 		err := svr.Server.ListenAndServe()
-		svr.events.Go("error", err)
+		if err != ssh.ErrServerClosed {
+			svr.events.Go("error", err)
+		}
 		close(svrStopped)
 	}()
 
-	defer svr.Close()
-
-	for {
-		select {
-		case <-svrStopped:
-			return
-		case <-ctx.Done():
-			return
-		}
+	select {
+	case <-svrStopped:
+		svr.Close()
+	case <-ctx.Done():
 	}
 }
 
 // IsKeyAuthorized is a handler for the server authentication check returning true
-// if the public key is match for the given client
+// if the public key is match for the given client.  The client may only be asking
+// if the key would be accepted, so nothing is recorded for an accepted key until
+// the client proves it has the private key for it, see authenticated
 func (svr *Server) IsKeyAuthorized(ctx ssh.Context, key ssh.PublicKey) bool {
-	svr.events.Go("log", fmt.Sprintf("incoming authentication request for %s from %s", ctx.User(), ctx.RemoteAddr().String()))
-	allowedKeys, _, _, _, err := ssh.ParseAuthorizedKey(svr.cfg.AuthorizedKeyBytes())
-	svr.events.Go("err", fmt.Errorf("failed to parse the authorized keys: %s", err))
+	if svr.limits.IsBanned(hostOf(ctx.RemoteAddr())) {
+		return false
+	}
 
-	allowed := ssh.KeysEqual(key, allowedKeys)
+	// only one key is accepted for each connection so that it is known which
+	// key the client signed with
+	if accepted, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey); ok && !ssh.KeysEqual(key, accepted) {
+		return false
+	}
+
+	fp := gossh.FingerprintSHA256(key)
+	allowed, err := svr.isKeyAuthorized(ctx.User(), ctx.RemoteAddr(), key)
+	if allowed {
+		return true
+	}
+
+	ev := svr.auditEvent(ctx, AuditAuthFailure)
+	ev.Method, ev.Fingerprint = "publickey", fp
+	svr.audit(ev)
+
+	// the first time a key is queued from an address and keys that couldn't be
+	// checked don't count towards a ban, but a client retrying a key that is
+	// still waiting for approval does
+	queued := svr.cfg.QueueUnknownKeys && svr.queueKey(ctx, key)
+	if !queued && err == nil {
+		markAuthFailed(ctx)
+	}
+
+	return false
+}
+
+// authenticated is called once the client has proven it has the private key
+// for the key that was accepted, or has given a valid enrollment token.  Only
+// then is the session started, and a key takes up one of the connections for
+// it, closing the connection if there are too many
+func (svr *Server) authenticated(ctx ssh.Context, conn gossh.ConnMetadata, method string) {
+	if tc, ok := ctx.Value(contextKeyConn).(*trackedConn); ok {
+		tc.sshConn, _ = conn.(gossh.Conn)
+	}
+
+	if method == "keyboard-interactive" && isEnrollment(ctx) {
+		svr.authSucceeded(ctx, "enroll-token", "")
+		return
+	}
+
+	if method != "publickey" {
+		return
+	}
 
-	if !allowed && svr.cfg.InteractiveUDS {
-		allowed, err = app.UDSAuthRequest(ctx)
-		if err != nil {
-			svr.events.Go("log", fmt.Sprintf("ERROR: UDS auth check failed: %s", err))
+	key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if !ok {
+		return
+	}
+
+	fp := gossh.FingerprintSHA256(key)
+	if reason := svr.limits.KeyConnected(ctx, fp); reason != "" {
+		svr.rejected(ctx.RemoteAddr(), reason)
+		// the client did authenticate, so don't count it as a failure
+		if tc, ok := ctx.Value(contextKeyConn).(*trackedConn); ok {
+			tc.setAuthFailed(false)
+			tc.Close()
 		}
+		return
 	}
 
-	if allowed {
-		svr.events.Go("log", fmt.Sprintf("authentication granted for %s from %s", ctx.User(), ctx.RemoteAddr().String()))
-	} else {
-		svr.events.Go("log", fmt.Sprintf("authentication denied for %s from %s", ctx.User(), ctx.RemoteAddr().String()))
+	svr.limits.AuthSucceeded(hostOf(ctx.RemoteAddr()))
+	svr.authSucceeded(ctx, "publickey", fp)
+}
+
+// isKeyAuthorized will return true if the key is one of the users authorized
+// keys and is allowed to connect from the address, along with any error
+// getting them
+func (svr *Server) isKeyAuthorized(user string, addr net.Addr, key ssh.PublicKey) (bool, error) {
+	allowedKeys, err := svr.keys.AuthorizedKeys(user)
+	if err != nil {
+		svr.events.Go("error", fmt.Errorf("failed to get the authorized keys for %s: %s", user, err))
+	}
+
+	for _, k := range allowedKeys {
+		if ssh.KeysEqual(key, k) && keyAllowedFrom(k, hostOf(addr)) {
+			return true, nil
+		}
 	}
 
-	return allowed
+	return false, err
+}
+
+// queueKey will add the key to the pending queue so that it can be approved
+// later on, unless it was already denied.  It returns true if this is the
+// first time the key was queued from the clients address
+func (svr *Server) queueKey(ctx ssh.Context, key ssh.PublicKey) bool {
+	if svr.pending.IsDenied(gossh.FingerprintSHA256(key)) {
+		return false
+	}
+
+	pk, first, err := svr.pending.Add(ctx.User(), ctx.RemoteAddr().String(), key)
+	if err == ErrPendingQueueFull {
+		svr.rejected(ctx.RemoteAddr(), err.Error())
+		return false
+	}
+	if err != nil {
+		svr.events.Go("error", fmt.Errorf("failed to save pending key: %s", err))
+	}
+
+	if pk.Attempts == 1 {
+		svr.events.Go("log", fmt.Sprintf("key %s for %s from %s is waiting for approval", pk.Fingerprint, pk.User, pk.Address))
+	}
+	svr.events.Go("key.pending", pk)
+	return first
 }
 
 // InteractivelyAcceptPublicKeys will change the server auth function so that it
@@ -136,7 +294,7 @@ func InteractivelyAcceptPublicKeys(svr *Server, cfg *Config) {
 	fmt.Println("Waiting for new connections, push CTRL+C to cancel...")
 	svr.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
 		// don't ask about known ones
-		if svr.IsKeyAuthorized(ctx, key) {
+		if ok, _ := svr.isKeyAuthorized(ctx.User(), ctx.RemoteAddr(), key); ok {
 			return true
 		}
 
@@ -148,8 +306,11 @@ func InteractivelyAcceptPublicKeys(svr *Server, cfg *Config) {
 		}, &allow)
 
 		if allow {
-			cfg.AddAuthorizedKey(key)
-			cfg.Save()
+			if err := svr.AddKey(string(gossh.MarshalAuthorizedKey(key))); err != nil && err != ErrKeyExists {
+				fmt.Println("ERROR: failed to save the public key:", err)
+				return allow
+			}
+			svr.pending.Remove(gossh.FingerprintSHA256(key))
 			fmt.Println("New public key was saved to your list of authorized keys")
 		}
 
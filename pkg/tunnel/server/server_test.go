@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/AlexanderGrom/go-event"
+	"github.com/penguinpowernz/mole/internal/util"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startTestServer will serve SSH with the given config on a random port
+func startTestServer(t *testing.T, cfg *Config) (*Server, string) {
+	if cfg.HostKey == "" {
+		_, key, err := util.MakeSSHKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.HostKey = key
+	}
+
+	svr := NewServer(cfg, event.New())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve(l)
+	t.Cleanup(func() { svr.Close() })
+
+	return svr, l.Addr().String()
+}
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// dialTestServer will connect to the test server with the given keys
+func dialTestServer(addr string, signers ...gossh.Signer) (*gossh.Client, error) {
+	return gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "bob",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signers...)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+}
+
+// forwardTestClient will connect to the test server and ask it to forward the
+// given address back, serving each forwarded connection with the handler
+func forwardTestClient(t *testing.T, addr string, signer gossh.Signer, bind string, port uint32, handle func(gossh.Channel, forwardedTCPData)) {
+	tcp, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, chans, reqs, err := gossh.NewClientConn(tcp, addr, &gossh.ClientConfig{
+		User:            "bob",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go gossh.DiscardRequests(reqs)
+
+	go func() {
+		for nc := range chans {
+			data := forwardedTCPData{}
+			gossh.Unmarshal(nc.ExtraData(), &data)
+
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go gossh.DiscardRequests(reqs)
+			go handle(ch, data)
+		}
+	}()
+
+	ok, payload, err := conn.SendRequest("tcpip-forward", true, gossh.Marshal(&remoteForwardRequest{BindAddr: bind, BindPort: port}))
+	if err != nil || !ok {
+		t.Fatalf("failed to forward %s: %s %v", bind, payload, err)
+	}
+}
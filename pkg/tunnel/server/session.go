@@ -0,0 +1,248 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	// contextKeyFingerprint holds the fingerprint of the key a connection authenticated with
+	contextKeyFingerprint = contextKey("fingerprint")
+
+	// contextKeyConn holds the tracked connection underneath the SSH connection
+	contextKeyConn = contextKey("tracked-conn")
+)
+
+// remoteForwardRequest is the payload of a tcpip-forward request as specified in RFC4254, Section 7.1
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// remoteForwardSuccess is the reply to a successful tcpip-forward request
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+// trackedConn counts the bytes going through a connection, remembers when
+// it was last used and calls the given func the first time it is closed.  It
+// also holds how the connection authenticated, as the context can't be read
+// when it closes while the handshake could still be changing it
+type trackedConn struct {
+	net.Conn
+	in, out int64
+	read    int64
+	written int64
+	reason  atomic.Value
+	onClose func(*trackedConn)
+	once    sync.Once
+
+	// forwarded is the last time data went through one of the forwards of
+	// the SSH connection, which the connections for the forwards point to
+	forwarded int64
+	parent    *trackedConn
+
+	mu         *sync.Mutex
+	authFailed bool
+	started    time.Time  // when the session started, zero until it authenticates
+	session    AuditEvent // the details of the session for when it ends
+	sshConn    gossh.Conn // the SSH connection once it has authenticated
+}
+
+func newTrackedConn(conn net.Conn, onClose func(*trackedConn)) *trackedConn {
+	now := time.Now().UnixNano()
+	return &trackedConn{Conn: conn, read: now, written: now, forwarded: now, onClose: onClose, mu: new(sync.Mutex)}
+}
+
+// newForwardedConn will track a connection going through one of the forwards
+// of the given SSH connection, marking the SSH connection as used whenever
+// data goes through it
+func newForwardedConn(conn net.Conn, session *trackedConn) *trackedConn {
+	tc := newTrackedConn(conn, nil)
+	tc.parent = session
+	return tc
+}
+
+// setAuthFailed will set if the connection failed to authenticate in a way
+// that counts towards a ban
+func (c *trackedConn) setAuthFailed(failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.authFailed = failed
+}
+
+// startSession will mark the start of the session with the given details,
+// returning false if it had already started
+func (c *trackedConn) startSession(ev AuditEvent) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started.IsZero() {
+		return false
+	}
+
+	c.started, c.session = time.Now(), ev
+	return true
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.used(&c.read, n)
+	atomic.AddInt64(&c.in, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.used(&c.written, n)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) used(last *int64, n int) {
+	if n <= 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(last, now)
+	if c.parent != nil {
+		atomic.StoreInt64(&c.parent.forwarded, now)
+	}
+}
+
+// LastForwarded will return the last time any data went through one of the
+// forwards of the connection
+func (c *trackedConn) LastForwarded() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.forwarded))
+}
+
+// LastActive will return the last time any data went through the connection
+func (c *trackedConn) LastActive() time.Time {
+	read, written := atomic.LoadInt64(&c.read), atomic.LoadInt64(&c.written)
+	if written > read {
+		return time.Unix(0, written)
+	}
+	return time.Unix(0, read)
+}
+
+// CloseReason will return the reason given when the server closed the connection
+func (c *trackedConn) CloseReason() string {
+	reason, _ := c.reason.Load().(string)
+	return reason
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+	return err
+}
+
+// sessionID will return the session ID from the context, if the handshake has
+// got far enough for it to be known
+func sessionID(ctx ssh.Context) string {
+	id, _ := ctx.Value(ssh.ContextKeySessionID).(string)
+	return id
+}
+
+// fingerprintOf will return the fingerprint of the key the connection
+// authenticated with, if it authenticated with a key
+func fingerprintOf(ctx ssh.Context) string {
+	fp, _ := ctx.Value(contextKeyFingerprint).(string)
+	return fp
+}
+
+// audit will write the event to the audit log and emit it
+func (svr *Server) audit(ev AuditEvent) {
+	ev.Time = time.Now()
+	if svr.audits != nil {
+		if err := svr.audits.Audit(ev); err != nil {
+			svr.events.Go("error", fmt.Errorf("failed to write to the audit log: %s", err))
+		}
+	}
+	svr.events.Go("audit", ev)
+}
+
+// auditEvent will create a new audit event filled in with the details of the connection
+func (svr *Server) auditEvent(ctx ssh.Context, event string) AuditEvent {
+	ev := AuditEvent{Event: event, Session: sessionID(ctx), Source: ctx.RemoteAddr().String()}
+	ev.User, _ = ctx.Value(ssh.ContextKeyUser).(string)
+	ev.Fingerprint = fingerprintOf(ctx)
+	return ev
+}
+
+// authSucceeded will audit the successful login and mark the start of the
+// session, it must only be called once the handshake has authenticated
+func (svr *Server) authSucceeded(ctx ssh.Context, method, fp string) {
+	if fp != "" {
+		ctx.SetValue(contextKeyFingerprint, fp)
+	}
+
+	ev := svr.auditEvent(ctx, AuditAuthSuccess)
+	ev.Method = method
+	svr.audit(ev)
+
+	tc, ok := ctx.Value(contextKeyConn).(*trackedConn)
+	if ok && tc.startSession(svr.auditEvent(ctx, AuditSessionStart)) {
+		svr.audit(tc.session)
+		go svr.enforceTimeouts(tc, svr.timeoutsFor(fp), ctx.Done())
+	}
+}
+
+// sessionEnded will audit the end of the session when the connection closes
+func (svr *Server) sessionEnded(conn *trackedConn) {
+	conn.mu.Lock()
+	start, ev := conn.started, conn.session
+	conn.mu.Unlock()
+
+	if start.IsZero() {
+		return
+	}
+
+	ev.Event = AuditSessionEnd
+	ev.DurationMS = int64(time.Since(start) / time.Millisecond)
+	ev.BytesIn = atomic.LoadInt64(&conn.in)
+	ev.BytesOut = atomic.LoadInt64(&conn.out)
+	ev.Error = conn.CloseReason()
+	svr.audit(ev)
+}
+
+// auditForwards will wrap the tcpip-forward request handler so that every
+// bind and cancel of a reverse forward is audited
+func (svr *Server) auditForwards(handler ssh.RequestHandler) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		ok, payload := handler(ctx, srv, req)
+
+		fwd := remoteForwardRequest{}
+		gossh.Unmarshal(req.Payload, &fwd)
+
+		ev := svr.auditEvent(ctx, AuditForwardBind)
+		if req.Type == "cancel-tcpip-forward" {
+			ev.Event = AuditForwardCancel
+		} else if res := (remoteForwardSuccess{}); ok && gossh.Unmarshal(payload, &res) == nil {
+			fwd.BindPort = res.BindPort
+		}
+
+		ev.Bind = net.JoinHostPort(fwd.BindAddr, strconv.Itoa(int(fwd.BindPort)))
+		if !ok {
+			ev.Error = "refused"
+			if len(payload) > 0 {
+				ev.Error = string(payload)
+			}
+		}
+
+		svr.audit(ev)
+		return ok, payload
+	}
+}
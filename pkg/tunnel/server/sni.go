@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sniPeekTimeout is how long a client has to send its TLS ClientHello
+const sniPeekTimeout = 10 * time.Second
+
+// tlsAlertUnrecognizedName is a fatal TLS alert record saying that there is
+// nothing for the server name the client asked for
+var tlsAlertUnrecognizedName = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x70}
+
+// errPeekedHello stops the TLS handshake once the ClientHello has been read
+var errPeekedHello = errors.New("peeked at the client hello")
+
+// SNIConfig is the config for the TLS front, which routes connections to the
+// reverse forwards of clients by the server name in the TLS ClientHello, without
+// terminating TLS.  Clients ask for a hostname by forwarding from it, which they
+// can only do if the hostname is authorized for their key
+type SNIConfig struct {
+	Listen string `json:"listen,omitempty"`
+
+	// Default is the hostname that connections are routed to when there is no
+	// reverse forward for the server name they ask for, if empty they are refused
+	Default string `json:"default,omitempty"`
+
+	// Hosts are the hostnames authorized for each key fingerprint, which can
+	// be wildcards like *.example.com to match any single subdomain
+	Hosts map[string][]string `json:"hosts,omitempty"`
+}
+
+func (sc SNIConfig) enabled() bool {
+	return sc.Listen != ""
+}
+
+// known will return true if the host is authorized for any key
+func (sc SNIConfig) known(host string) bool {
+	if !sc.enabled() {
+		return false
+	}
+
+	for _, patterns := range sc.Hosts {
+		if matchHost(patterns, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed will return true if the key with the given fingerprint can use the host
+func (sc SNIConfig) allowed(fp, host string) bool {
+	return fp != "" && matchHost(sc.Hosts[fp], host)
+}
+
+// matchHost will return true if the host matches any of the patterns
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSuffix(p, "."))
+		if p == host {
+			return true
+		}
+
+		if strings.HasPrefix(p, "*.") {
+			i := strings.Index(host, ".")
+			if i > 0 && host[i:] == p[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ListenAndServeSNI will run the TLS front, if it is configured, until the
+// context is done.  Then it stops accepting connections but lets the ones in
+// progress finish
+func (svr *Server) ListenAndServeSNI(ctx context.Context) error {
+	if !svr.cfg.SNI.enabled() {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", svr.cfg.SNI.Listen)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go svr.handleSNI(conn)
+	}
+}
+
+// handleSNI will route the connection to the reverse forward for the server name
+// it asks for, or the default one, refusing it with a TLS alert if there isn't one
+func (svr *Server) handleSNI(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	name, hello, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		svr.events.Go("log", fmt.Sprintf("refused TLS connection from %s: %s", conn.RemoteAddr(), err))
+		return
+	}
+
+	if svr.isDraining() {
+		conn.Write(tlsAlertUnrecognizedName)
+		return
+	}
+
+	ch, err := svr.dialVirtual(VirtualSNI, name, conn.RemoteAddr())
+	if err == ErrNoVirtualForward && svr.cfg.SNI.Default != "" {
+		ch, err = svr.dialVirtual(VirtualSNI, svr.cfg.SNI.Default, conn.RemoteAddr())
+	}
+
+	if err != nil {
+		svr.events.Go("log", fmt.Sprintf("refused TLS connection from %s for %q: %s", conn.RemoteAddr(), name, err))
+		conn.Write(tlsAlertUnrecognizedName)
+		return
+	}
+	defer ch.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, io.MultiReader(hello, conn))
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, ch)
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	wg.Wait()
+}
+
+// peekServerName will read the TLS ClientHello from the reader and return the
+// server name from it, along with what was read so that it can be replayed
+func peekServerName(r io.Reader) (string, io.Reader, error) {
+	buf := new(bytes.Buffer)
+
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errPeekedHello
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return "", nil, fmt.Errorf("not a TLS client hello: %s", err)
+	}
+
+	return hello.ServerName, buf, nil
+}
+
+// readOnlyConn lets the TLS library read the ClientHello without
+// being able to write anything back to the client
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
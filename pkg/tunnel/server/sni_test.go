@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestPeekServerName(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "app.example.com"}).Handshake()
+		client.Close()
+	}()
+
+	name, hello, err := peekServerName(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	if name != "app.example.com" {
+		t.Errorf("expected the server name app.example.com but got %q", name)
+	}
+
+	b, _ := ioutil.ReadAll(hello)
+	if len(b) < 5 || b[0] != 0x16 {
+		t.Errorf("expected the client hello to be replayed but got %d bytes", len(b))
+	}
+}
+
+func TestSNIConfigHosts(t *testing.T) {
+	sc := SNIConfig{
+		Listen: ":443",
+		Hosts: map[string][]string{
+			"SHA256:alice": {"app.example.com", "*.alice.example.com"},
+		},
+	}
+
+	tests := []struct {
+		fp, host string
+		allowed  bool
+	}{
+		{"SHA256:alice", "app.example.com", true},
+		{"SHA256:alice", "APP.example.com.", true},
+		{"SHA256:alice", "shop.alice.example.com", true},
+		{"SHA256:alice", "alice.example.com", false},
+		{"SHA256:alice", "a.b.alice.example.com", false},
+		{"SHA256:bob", "app.example.com", false},
+		{"", "app.example.com", false},
+	}
+
+	for _, test := range tests {
+		if sc.allowed(test.fp, test.host) != test.allowed {
+			t.Errorf("expected %s using %s to be allowed=%v", test.fp, test.host, test.allowed)
+		}
+	}
+
+	if !sc.known("shop.alice.example.com") || sc.known("other.example.com") {
+		t.Error("expected only the authorized hosts to be known")
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/penguinpowernz/mole/pkg/sshutil"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Reasons that the server disconnected a session
+const (
+	DisconnectIdle       = "idle_timeout"
+	DisconnectMaxSession = "max_session_duration"
+)
+
+// defaultWarnBefore is how long before the maximum session duration is
+// reached that the client is warned, if not configured
+const defaultWarnBefore = time.Minute
+
+// TimeoutsConfig is the config for disconnecting sessions that are idle or have
+// been connected for too long.  Zero values mean there is no timeout
+type TimeoutsConfig struct {
+	IdleTimeout        string `json:"idle_timeout,omitempty"`
+	ChannelIdleTimeout string `json:"channel_idle_timeout,omitempty"`
+	MaxSessionDuration string `json:"max_session_duration,omitempty"`
+	WarnBefore         string `json:"warn_before,omitempty"`
+	DisconnectMessage  string `json:"disconnect_message,omitempty"`
+}
+
+// Override will return the timeouts with any of the fields that are set in
+// the given timeouts replacing these ones
+func (tc TimeoutsConfig) Override(o TimeoutsConfig) TimeoutsConfig {
+	set := func(s *string, v string) {
+		if v != "" {
+			*s = v
+		}
+	}
+
+	set(&tc.IdleTimeout, o.IdleTimeout)
+	set(&tc.ChannelIdleTimeout, o.ChannelIdleTimeout)
+	set(&tc.MaxSessionDuration, o.MaxSessionDuration)
+	set(&tc.WarnBefore, o.WarnBefore)
+	set(&tc.DisconnectMessage, o.DisconnectMessage)
+	return tc
+}
+
+// timeouts are the parsed timeouts for a session
+type timeouts struct {
+	idle        time.Duration
+	channelIdle time.Duration
+	maxSession  time.Duration
+	warnBefore  time.Duration
+	message     string
+}
+
+// parseTimeouts will parse the durations in the given config
+func parseTimeouts(tc TimeoutsConfig) (to timeouts, err error) {
+	to.message = tc.DisconnectMessage
+
+	if to.idle, err = parseDuration(tc.IdleTimeout, 0); err != nil {
+		return to, fmt.Errorf("invalid idle_timeout: %s", err)
+	}
+
+	if to.channelIdle, err = parseDuration(tc.ChannelIdleTimeout, 0); err != nil {
+		return to, fmt.Errorf("invalid channel_idle_timeout: %s", err)
+	}
+
+	if to.maxSession, err = parseDuration(tc.MaxSessionDuration, 0); err != nil {
+		return to, fmt.Errorf("invalid max_session_duration: %s", err)
+	}
+
+	if to.warnBefore, err = parseDuration(tc.WarnBefore, defaultWarnBefore); err != nil {
+		return to, fmt.Errorf("invalid warn_before: %s", err)
+	}
+
+	return to, nil
+}
+
+// validateTimeouts will check that the global timeouts and the ones
+// for each key can all be parsed
+func (cfg Config) validateTimeouts() error {
+	if _, err := parseTimeouts(cfg.Timeouts); err != nil {
+		return err
+	}
+
+	for fp, tc := range cfg.KeyTimeouts {
+		if _, err := parseTimeouts(cfg.Timeouts.Override(tc)); err != nil {
+			return fmt.Errorf("timeouts for key %s: %s", fp, err)
+		}
+	}
+
+	return nil
+}
+
+// timeoutsFor will return the timeouts for the key with the given fingerprint,
+// any that can't be parsed are ignored as they were reported on startup
+func (svr *Server) timeoutsFor(fp string) timeouts {
+	tc := svr.cfg.Timeouts
+	if o, found := svr.cfg.KeyTimeouts[fp]; found && fp != "" {
+		tc = tc.Override(o)
+	}
+
+	to, _ := parseTimeouts(tc)
+	return to
+}
+
+// enforceTimeouts will disconnect the session once it has been idle for too long
+// or has been connected for longer than the maximum duration, warning the client
+// before that happens.  A session is idle when it has no open channels and no
+// data has gone through any of its forwards, keepalives and other requests
+// from the client don't count.  The context isn't used as it is still being
+// changed after the handshake, so it is done with the tracked connection
+func (svr *Server) enforceTimeouts(tc *trackedConn, to timeouts, done <-chan struct{}) {
+	if to.idle <= 0 && to.maxSession <= 0 {
+		return
+	}
+
+	start := time.Now()
+	warned := false
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		wait := time.Duration(1<<63 - 1)
+
+		if to.maxSession > 0 {
+			left := to.maxSession - now.Sub(start)
+			if left <= 0 {
+				svr.disconnect(tc, DisconnectMaxSession, to.message)
+				return
+			}
+
+			if !warned && to.warnBefore > 0 && left <= to.warnBefore {
+				warned = true
+				svr.notify(tc, fmt.Sprintf("the maximum session duration will be reached in %s, you will be disconnected", left.Round(time.Second)))
+			}
+
+			wait = left
+			if !warned && left > to.warnBefore {
+				wait = left - to.warnBefore
+			}
+		}
+
+		if to.idle > 0 {
+			left := to.idle
+			if svr.limits.Channels(tc.session.Session) == 0 {
+				left -= now.Sub(tc.LastForwarded())
+			}
+
+			if left <= 0 {
+				svr.disconnect(tc, DisconnectIdle, to.message)
+				return
+			}
+
+			if left < wait {
+				wait = left
+			}
+		}
+
+		timer.Reset(wait)
+	}
+}
+
+// waitForIdle will block until no data has gone through the connection for
+// the given duration, returning false if the done channel was closed first
+func waitForIdle(tc *trackedConn, idle time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return false
+		case <-timer.C:
+		}
+
+		left := idle - time.Since(tc.LastActive())
+		if left <= 0 {
+			return true
+		}
+
+		timer.Reset(left)
+	}
+}
+
+// notify will send a notice to the client, which is ignored by clients that
+// don't understand it
+func (svr *Server) notify(tc *trackedConn, msg string) {
+	if tc.sshConn == nil {
+		return
+	}
+
+	tc.sshConn.SendRequest(sshutil.NoticeRequestType, false, gossh.Marshal(sshutil.Notice{Message: msg}))
+}
+
+// disconnect will tell the client why it is being disconnected and close
+// the connection
+func (svr *Server) disconnect(tc *trackedConn, reason, msg string) {
+	if msg == "" {
+		msg = "disconnected by the server: " + reason
+	}
+
+	tc.reason.Store(reason)
+	svr.notify(tc, msg)
+	svr.events.Go("log", fmt.Sprintf("disconnecting %s: %s", tc.RemoteAddr().String(), reason))
+	svr.events.Go("session.disconnected", tc.RemoteAddr().String(), reason)
+	tc.Close()
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestTimeoutsForKey(t *testing.T) {
+	cfg := &Config{
+		Timeouts: TimeoutsConfig{IdleTimeout: "10m", MaxSessionDuration: "24h"},
+		KeyTimeouts: map[string]TimeoutsConfig{
+			"SHA256:abc": {IdleTimeout: "0", ChannelIdleTimeout: "5m"},
+		},
+	}
+
+	if err := cfg.validateTimeouts(); err != nil {
+		t.Fatal(err)
+	}
+
+	svr := &Server{cfg: cfg}
+
+	to := svr.timeoutsFor("SHA256:xyz")
+	if to.idle != 10*time.Minute || to.channelIdle != 0 || to.maxSession != 24*time.Hour || to.warnBefore != defaultWarnBefore {
+		t.Errorf("expected the global timeouts but got %+v", to)
+	}
+
+	to = svr.timeoutsFor("SHA256:abc")
+	if to.idle != 0 || to.channelIdle != 5*time.Minute || to.maxSession != 24*time.Hour {
+		t.Errorf("expected the key timeouts to override the global ones but got %+v", to)
+	}
+
+	cfg.KeyTimeouts["SHA256:bad"] = TimeoutsConfig{IdleTimeout: "soon"}
+	if err := cfg.validateTimeouts(); err == nil {
+		t.Error("expected an error for the invalid timeout")
+	}
+}
+
+func TestWaitForIdle(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	tc := newTrackedConn(a, nil)
+	defer tc.Close()
+
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(20 * time.Millisecond)
+			tc.Write([]byte("x"))
+		}
+	}()
+
+	if !waitForIdle(tc, 50*time.Millisecond, make(chan struct{})) {
+		t.Fatal("expected the connection to become idle")
+	}
+
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("expected the writes to keep the connection active but it was idle after %s", took)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if waitForIdle(tc, time.Hour, done) {
+		t.Error("expected waiting to stop when done")
+	}
+}
+
+func TestIdleTimeoutIgnoresKeepalives(t *testing.T) {
+	signer := newTestSigner(t)
+	_, addr := startTestServer(t, &Config{
+		AuthorizedKeys: []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))},
+		Timeouts:       TimeoutsConfig{IdleTimeout: "200ms"},
+	})
+
+	client, err := dialTestServer(addr, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	// the client keeps sending keepalives but nothing is forwarded
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			client.SendRequest("keepalive@openssh.com", true, nil)
+		case <-timeout:
+			t.Fatal("expected the idle client to be disconnected")
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+var (
+	// ErrInvalidToken is returned when an enrollment token is unknown or malformed
+	ErrInvalidToken = errors.New("invalid enrollment token")
+
+	// ErrTokenExpired is returned when an enrollment token has expired or been used up
+	ErrTokenExpired = errors.New("enrollment token has expired")
+)
+
+// EnrollToken is a token that allows new clients to have their public key
+// authorized a limited number of times before it expires
+type EnrollToken struct {
+	ID      string        `json:"id"`
+	Hash    string        `json:"hash"`
+	Note    string        `json:"note,omitempty"`
+	Uses    int           `json:"uses"`
+	MaxUses int           `json:"max_uses"`
+	Created time.Time     `json:"created"`
+	Expires time.Time     `json:"expires"`
+	Tunnels []TokenTunnel `json:"tunnels,omitempty"`
+}
+
+// TokenOptions are the options used to create a new enrollment token
+type TokenOptions struct {
+	MaxUses int           `json:"max_uses"`
+	TTL     time.Duration `json:"ttl"`
+	Note    string        `json:"note"`
+	Tunnels []TokenTunnel `json:"tunnels"`
+}
+
+// Usable will return true if the token has not expired or been used up
+func (tok *EnrollToken) Usable() bool {
+	if tok.MaxUses > 0 && tok.Uses >= tok.MaxUses {
+		return false
+	}
+	return tok.Expires.IsZero() || time.Now().Before(tok.Expires)
+}
+
+// TokenStore is a persistent store of enrollment tokens
+type TokenStore struct {
+	filename string
+	tokens   map[string]*EnrollToken
+	mu       *sync.Mutex
+}
+
+// NewTokenStore will create a new token store persisted to the given filename,
+// loading any tokens that were already saved in it.  If the filename is empty
+// the tokens will only be kept in memory
+func NewTokenStore(filename string) (*TokenStore, error) {
+	ts := &TokenStore{filename: filename, tokens: map[string]*EnrollToken{}, mu: new(sync.Mutex)}
+	if filename == "" {
+		return ts, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ts, nil
+	}
+	if err != nil {
+		return ts, err
+	}
+
+	tokens := []*EnrollToken{}
+	if err := yaml.Unmarshal(data, &tokens); err != nil {
+		return ts, err
+	}
+
+	for _, tok := range tokens {
+		ts.tokens[tok.ID] = tok
+	}
+
+	return ts, nil
+}
+
+// Create will create a new token with the given options, returning the secret
+// token text that is to be given to the client.  Only a hash of the secret is
+// kept in the store
+func (ts *TokenStore) Create(opts TokenOptions) (string, *EnrollToken, error) {
+	id, err := randomHex(4)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if opts.MaxUses == 0 {
+		opts.MaxUses = 1
+	}
+
+	tok := &EnrollToken{
+		ID:      id,
+		Hash:    hashSecret(secret),
+		Note:    opts.Note,
+		MaxUses: opts.MaxUses,
+		Created: time.Now(),
+		Tunnels: opts.Tunnels,
+	}
+
+	if opts.TTL > 0 {
+		tok.Expires = tok.Created.Add(opts.TTL)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens[id] = tok
+	return id + "." + secret, tok, ts.save()
+}
+
+// Validate will return the token matching the given secret token text if
+// it is still usable
+func (ts *TokenStore) Validate(text string) (*EnrollToken, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.find(text)
+}
+
+// Use will validate the given secret token text and count it as used
+func (ts *TokenStore) Use(text string) (*EnrollToken, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tok, err := ts.find(text)
+	if err != nil {
+		return nil, err
+	}
+
+	tok.Uses++
+	return tok, ts.save()
+}
+
+// Release will give back a use of the token when enrolling with it failed, so
+// that it can be used again
+func (ts *TokenStore) Release(tok *EnrollToken) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if tok.Uses > 0 {
+		tok.Uses--
+	}
+	ts.tokens[tok.ID] = tok
+	return ts.save()
+}
+
+// Revoke will remove the token with the given ID
+func (ts *TokenStore) Revoke(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, found := ts.tokens[id]; !found {
+		return ErrInvalidToken
+	}
+
+	delete(ts.tokens, id)
+	return ts.save()
+}
+
+// List will return all the tokens that are still usable, oldest first
+func (ts *TokenStore) List() []*EnrollToken {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tokens := []*EnrollToken{}
+	for _, tok := range ts.tokens {
+		if tok.Usable() {
+			tokens = append(tokens, tok)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens
+}
+
+func (ts *TokenStore) find(text string) (*EnrollToken, error) {
+	bits := strings.SplitN(strings.TrimSpace(text), ".", 2)
+	if len(bits) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	tok, found := ts.tokens[bits[0]]
+	if !found {
+		return nil, ErrInvalidToken
+	}
+
+	if subtle.ConstantTimeCompare([]byte(tok.Hash), []byte(hashSecret(bits[1]))) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	if !tok.Usable() {
+		return nil, ErrTokenExpired
+	}
+
+	return tok, nil
+}
+
+// save will write the tokens to disk, dropping any that can no longer be used
+func (ts *TokenStore) save() error {
+	tokens := []*EnrollToken{}
+	for id, tok := range ts.tokens {
+		if !tok.Usable() {
+			delete(ts.tokens, id)
+			continue
+		}
+		tokens = append(tokens, tok)
+	}
+
+	if ts.filename == "" {
+		return nil
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+
+	data, err := yaml.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ts.filename, data, 0600)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
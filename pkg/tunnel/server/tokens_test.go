@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenStoreUses(t *testing.T) {
+	ts, _ := NewTokenStore("")
+
+	text, tok, err := ts.Create(TokenOptions{MaxUses: 2, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.Validate(tok.ID + ".nope"); err != ErrInvalidToken {
+		t.Errorf("expected invalid token error but got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Use(text); err != nil {
+			t.Fatalf("use %d failed: %s", i+1, err)
+		}
+	}
+
+	if _, err := ts.Use(text); err == nil {
+		t.Error("expected the token to be used up")
+	}
+
+	if len(ts.List()) != 0 {
+		t.Error("expected the used up token to not be listed")
+	}
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	ts, _ := NewTokenStore("")
+
+	text, tok, err := ts.Create(TokenOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok.Expires = time.Now().Add(-time.Second)
+	if _, err := ts.Validate(text); err != ErrTokenExpired {
+		t.Errorf("expected token expired error but got %v", err)
+	}
+}
+
+func TestTokenStoreRelease(t *testing.T) {
+	ts, _ := NewTokenStore("")
+
+	text, _, err := ts.Create(TokenOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := ts.Use(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key couldn't be saved so the single use is given back
+	if err := ts.Release(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.Use(text); err != nil {
+		t.Errorf("expected the token to be usable again but got %v", err)
+	}
+
+	if _, err := ts.Use(text); err == nil {
+		t.Error("expected the token to be used up")
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrNoVirtualForward is returned when there is no virtual forward for a name
+var ErrNoVirtualForward = errors.New("no tunnel for that name")
+
+// The kinds of virtual forward, which say which front routes connections to them
+const (
+	VirtualHTTP  = "http"
+	VirtualSNI   = "sni"
+	VirtualAlias = "alias"
+)
+
+// virtualForward is a reverse forward for a name that doesn't have a listener of
+// its own, instead connections are routed to it by the fronts of the server
+type virtualForward struct {
+	Kind        string
+	Name        string
+	Port        uint32
+	Fingerprint string
+	Session     string
+
+	conn *gossh.ServerConn
+}
+
+// virtualForwards holds the virtual forwards by name
+type virtualForwards struct {
+	forwards map[string]*virtualForward
+	mu       *sync.Mutex
+}
+
+func newVirtualForwards() *virtualForwards {
+	return &virtualForwards{forwards: map[string]*virtualForward{}, mu: new(sync.Mutex)}
+}
+
+// add will add the virtual forward for the session, returning false if the
+// name is already being used
+func (vfs *virtualForwards) add(ctx ssh.Context, conn *gossh.ServerConn, kind, name string, port uint32) bool {
+	name = strings.ToLower(name)
+
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	if _, found := vfs.forwards[name]; found {
+		return false
+	}
+
+	vf := &virtualForward{
+		Kind:        kind,
+		Name:        name,
+		Port:        port,
+		Fingerprint: fingerprintOf(ctx),
+		Session:     sessionID(ctx),
+		conn:        conn,
+	}
+	vfs.forwards[name] = vf
+
+	go func() {
+		<-ctx.Done()
+		vfs.remove(vf.Session, name)
+	}()
+
+	return true
+}
+
+// remove will remove the sessions virtual forward with the given name, returning
+// false if the session didn't have one
+func (vfs *virtualForwards) remove(session, name string) bool {
+	name = strings.ToLower(name)
+
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	vf, found := vfs.forwards[name]
+	if !found || vf.Session != session {
+		return false
+	}
+
+	delete(vfs.forwards, name)
+	return true
+}
+
+// get will return the virtual forward of the given kind with the given name
+func (vfs *virtualForwards) get(kind, name string) (*virtualForward, bool) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vf, found := vfs.forwards[strings.ToLower(name)]
+	if !found || vf.Kind != kind {
+		return nil, false
+	}
+	return vf, true
+}
+
+// removeAll will remove all the virtual forwards so that no new connections
+// are routed to them
+func (vfs *virtualForwards) removeAll() {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.forwards = map[string]*virtualForward{}
+}
+
+// virtualHost will check if a reverse forward for the host should be virtual
+// instead of listening on the server, returning the kind of virtual forward.  An
+// error is returned if the key the session authenticated with isn't allowed to
+// use the host
+func (svr *Server) virtualHost(ctx ssh.Context, host string) (string, error) {
+	fp := fingerprintOf(ctx)
+
+	if ac, ok := svr.cfg.alias(host); ok {
+		if !ac.canServe(fp) {
+			return VirtualAlias, fmt.Errorf("not allowed to serve the alias %s", host)
+		}
+		return VirtualAlias, nil
+	}
+
+	if name, ok := svr.cfg.HTTP.nameOf(host); ok {
+		if !svr.cfg.HTTP.allowed(fp, name) {
+			return VirtualHTTP, fmt.Errorf("not allowed to use the name %s", name)
+		}
+		return VirtualHTTP, nil
+	}
+
+	if svr.cfg.SNI.known(host) {
+		if !svr.cfg.SNI.allowed(fp, host) {
+			return VirtualSNI, fmt.Errorf("not allowed to use the hostname %s", host)
+		}
+		return VirtualSNI, nil
+	}
+
+	return "", nil
+}
+
+// dialVirtual will open a forwarded-tcpip channel to the client that has the
+// virtual forward for the given name, as if the origin had connected to it
+func (svr *Server) dialVirtual(kind, name string, origin net.Addr) (*channelConn, error) {
+	vf, found := svr.forwards.virtual.get(kind, name)
+	if !found {
+		return nil, ErrNoVirtualForward
+	}
+
+	host, port, _ := net.SplitHostPort(origin.String())
+	originPort, _ := strconv.Atoi(port)
+
+	ch, reqs, err := vf.conn.OpenChannel(forwardedTCPChannelType, gossh.Marshal(&forwardedTCPData{
+		DestAddr:   vf.Name,
+		DestPort:   vf.Port,
+		OriginAddr: host,
+		OriginPort: uint32(originPort),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	go gossh.DiscardRequests(reqs)
+
+	return &channelConn{Channel: ch, local: vf, remote: origin, done: svr.bridges.add()}, nil
+}
+
+// channelConn is a connection over an SSH channel
+type channelConn struct {
+	gossh.Channel
+	local  net.Addr
+	remote net.Addr
+	done   func()
+}
+
+func (c *channelConn) Close() error {
+	c.done()
+	return c.Channel.Close()
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.local }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Network will return the network of the virtual forward, as an address
+func (vf *virtualForward) Network() string { return "tcp" }
+
+// String will return the name and port of the virtual forward, as an address
+func (vf *virtualForward) String() string {
+	return net.JoinHostPort(vf.Name, strconv.Itoa(int(vf.Port)))
+}
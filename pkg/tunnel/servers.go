@@ -0,0 +1,210 @@
+package tunnel
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// the policies for choosing which of the clients servers to connect to
+const (
+	PolicyFailover = "failover"
+	PolicyRandom   = "random"
+	PolicyLatency  = "latency"
+)
+
+// failbackInterval is how often the preferred server is checked while
+// connected to another one
+const failbackInterval = 30 * time.Second
+
+// probeTimeout is how long to wait when checking if a server is reachable
+const probeTimeout = 5 * time.Second
+
+// serverTimeout is how long to wait for each server to connect when the
+// client has no timeout set, so that one server can't stall the others
+const serverTimeout = 15 * time.Second
+
+// validatePolicy will return an error if the policy is not known
+func (cl *Client) validatePolicy() error {
+	switch cl.Policy {
+	case "", PolicyFailover, PolicyRandom, PolicyLatency:
+		return nil
+	}
+	return fmt.Errorf("unknown policy for %s: %s", cl.Address, cl.Policy)
+}
+
+// preferredServers will return the servers the client can connect to in the
+// order they were given, looking them up from the SRV record if there is one
+func (cl *Client) preferredServers() ([]string, error) {
+	if cl.SRV == "" {
+		if len(cl.Addresses) == 0 {
+			return []string{cl.Address}, nil
+		}
+		return append([]string{}, cl.Addresses...), nil
+	}
+
+	_, srvs, err := net.LookupSRV("", "", cl.SRV)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %s: %s", cl.SRV, err)
+	}
+
+	addrs := []string{}
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no servers found for %s", cl.SRV)
+	}
+
+	return addrs, nil
+}
+
+// servers will return the servers to try connecting to in the order that the
+// policy says they should be tried
+func (cl *Client) servers() ([]string, error) {
+	addrs, err := cl.preferredServers()
+	if err != nil || len(addrs) == 1 {
+		return addrs, err
+	}
+
+	switch cl.Policy {
+	case PolicyRandom:
+		rand.New(rand.NewSource(time.Now().UnixNano())).Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	case PolicyLatency:
+		sortByLatency(addrs)
+	default:
+		// stay with the server that it was last connected to, unless it
+		// should go back to the preferred server
+		if !cl.Failback {
+			active := cl.activeServer()
+			for i, addr := range addrs {
+				if addr == active {
+					addrs = append(addrs[i:], addrs[:i]...)
+					break
+				}
+			}
+		}
+	}
+
+	return addrs, nil
+}
+
+// activeServer will return the server the client last connected to
+func (cl *Client) activeServer() (addr string) {
+	if cl.state != nil {
+		cl.state.update(func(st *clientState) { addr = st.server })
+	}
+	return
+}
+
+// sortByLatency will sort the addresses by how long they take to connect to,
+// with those that can't be connected to at the end
+func sortByLatency(addrs []string) {
+	type result struct {
+		addr string
+		took time.Duration
+	}
+
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			took, err := probe(addr)
+			if err != nil {
+				took = probeTimeout + 1
+			}
+			results <- result{addr, took}
+		}(addr)
+	}
+
+	took := map[string]time.Duration{}
+	for range addrs {
+		r := <-results
+		took[r.addr] = r.took
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool { return took[addrs[i]] < took[addrs[j]] })
+}
+
+// probe will check if the server can be connected to, returning how long it took
+func probe(addr string) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// failback will close the connection to a server that isn't the preferred one
+// once the preferred one can be connected to again, so that the client reconnects
+// to it and the tunnels are opened there instead
+func (cl *Client) failback(conn *ssh.Client, preferred string) {
+	done := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+
+	t := time.NewTicker(failbackInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		if err := cl.probeSSH(preferred); err != nil {
+			continue
+		}
+
+		if cl.events != nil {
+			cl.events.Go("log", fmt.Sprintf("server %s for %s has recovered, reconnecting to it", preferred, cl.Address))
+		}
+		conn.Close()
+		return
+	}
+}
+
+// probeSSH will check that the client can log in to the server, so that it
+// doesn't go back to a server that is listening but not working
+func (cl *Client) probeSSH(addr string) error {
+	c, chans, reqs, err := cl.handshake(addr)
+	if err != nil {
+		return err
+	}
+	return ssh.NewClient(c, chans, reqs).Close()
+}
+
+// handshake will connect to the server and do the SSH handshake, giving up if
+// it takes longer than the clients timeout
+func (cl *Client) handshake(addr string) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	timeout := cl.sshcfg.Timeout
+	if timeout == 0 {
+		timeout = serverTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cl.sshcfg)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, chans, reqs, nil
+}
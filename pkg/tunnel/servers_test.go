@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerOrder(t *testing.T) {
+	cl := &Client{}
+	if err := json.Unmarshal([]byte(`{"addresses":["a:22","b:22","c:22"]}`), cl); err != nil {
+		t.Fatal(err)
+	}
+
+	if cl.Address != "a:22" {
+		t.Errorf("expected the client to be named after the first server but got %s", cl.Address)
+	}
+
+	cl.state = newClientState()
+	cl.state.server = "b:22"
+
+	addrs, _ := cl.servers()
+	if !reflect.DeepEqual(addrs, []string{"b:22", "c:22", "a:22"}) {
+		t.Errorf("expected to stay with the active server but got %v", addrs)
+	}
+
+	cl.Failback = true
+	addrs, _ = cl.servers()
+	if !reflect.DeepEqual(addrs, []string{"a:22", "b:22", "c:22"}) {
+		t.Errorf("expected to go back to the preferred server but got %v", addrs)
+	}
+
+	cl.Policy = "fastest"
+	if err := cl.validatePolicy(); err == nil {
+		t.Error("expected an unknown policy to be invalid")
+	}
+}
+
+func TestSortByLatency(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+
+	addrs := []string{down.Addr().String(), l.Addr().String()}
+	sortByLatency(addrs)
+
+	if addrs[0] != l.Addr().String() {
+		t.Errorf("expected the reachable server first but got %v", addrs)
+	}
+}
+
+func TestProbeSSH(t *testing.T) {
+	svr := startTestServer(t)
+
+	cl := &Client{Address: svr.Addr().String(), Private: newTestKey(t)}
+	if err := cl.init(); err != nil {
+		t.Fatal(err)
+	}
+	cl.sshcfg.Timeout = 200 * time.Millisecond
+
+	if err := cl.probeSSH(svr.Addr().String()); err != nil {
+		t.Errorf("expected the server to be logged in to: %s", err)
+	}
+
+	// a server that accepts connections but never does the handshake
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	go func() {
+		for {
+			conn, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	if err := cl.probeSSH(stuck.Addr().String()); err == nil {
+		t.Error("expected a server that doesn't do the handshake to fail the probe")
+	}
+
+	if err := cl.connectTo(stuck.Addr().String()); err == nil {
+		t.Error("expected a server that doesn't do the handshake to fail to connect")
+	}
+
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("expected the handshakes to time out but they took %s", took)
+	}
+}
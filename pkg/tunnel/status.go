@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/penguinpowernz/mole/internal/util"
+	"golang.org/x/crypto/ssh"
+)
+
+// rttInterval is how often the round trip time to the server is measured
+const rttInterval = 30 * time.Second
+
+// ClientStatus is the status of a client and its tunnels
+type ClientStatus struct {
+	Address        string         `json:"address"`
+	Server         string         `json:"server,omitempty"`
+	Connected      bool           `json:"connected"`
+	LastConnect    *time.Time     `json:"last_connect,omitempty"`
+	LastDisconnect *time.Time     `json:"last_disconnect,omitempty"`
+	LastError      string         `json:"last_error,omitempty"`
+	RTTMS          float64        `json:"rtt_ms"`
+	Queued         int64          `json:"queued"`
+	Tunnels        []TunnelStatus `json:"tunnels"`
+}
+
+// clientState holds the connection history of a client
+type clientState struct {
+	connected      bool
+	lastConnect    time.Time
+	lastDisconnect time.Time
+	lastError      string
+	server         string
+	rtt            time.Duration
+	mu             *sync.Mutex
+}
+
+func newClientState() *clientState {
+	return &clientState{mu: new(sync.Mutex)}
+}
+
+func (st *clientState) update(fn func(st *clientState)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(st)
+}
+
+// Status will return the status of the client and its tunnels
+func (cl *Client) Status() ClientStatus {
+	cs := ClientStatus{Address: cl.Address, Queued: cl.limits.queued(), Tunnels: []TunnelStatus{}}
+
+	if cl.state != nil {
+		cl.state.update(func(st *clientState) {
+			cs.Connected = st.connected
+			cs.Server = st.server
+			cs.LastError = st.lastError
+			cs.RTTMS = float64(st.rtt) / float64(time.Millisecond)
+			if !st.lastConnect.IsZero() {
+				t := st.lastConnect
+				cs.LastConnect = &t
+			}
+			if !st.lastDisconnect.IsZero() {
+				t := st.lastDisconnect
+				cs.LastDisconnect = &t
+			}
+		})
+	}
+
+	for _, tun := range cl.Tunnels {
+		cs.Tunnels = append(cs.Tunnels, tun.Status())
+	}
+
+	return cs
+}
+
+// measureRTT will measure the round trip time to the server until the
+// connection is closed, using a request that the server has to reply to
+func (cl *Client) measureRTT(conn *ssh.Client) {
+	for {
+		start := time.Now()
+		if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			return
+		}
+
+		rtt := time.Since(start)
+		cl.state.update(func(st *clientState) { st.rtt = rtt })
+		time.Sleep(rttInterval)
+	}
+}
+
+// Status will return the status of every client except the default one
+func (cfg Config) Status() []ClientStatus {
+	sts := []ClientStatus{}
+	for _, cl := range cfg.Clients {
+		if cl.Address == "*" {
+			continue
+		}
+		sts = append(sts, cl.Status())
+	}
+	return sts
+}
+
+// StatusHandler will return a handler that responds with the status of the
+// clients as JSON
+func (cfg *Config) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(cfg.Status())
+	})
+}
+
+// ListenAndServeStatus will serve the status of the clients as JSON on the
+// given address until the context is done.  An address starting with a / or
+// unix: is a unix socket that only the user running the client can access
+func (cfg *Config) ListenAndServeStatus(ctx context.Context, addr string) error {
+	var ln net.Listener
+	var err error
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "unix:") {
+		addr = strings.TrimPrefix(addr, "unix:")
+		ln, err = util.ListenUnix(addr)
+		defer os.Remove(addr)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	s := &http.Server{Handler: cfg.StatusHandler()}
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	if err := s.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
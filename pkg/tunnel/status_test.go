@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusHandler(t *testing.T) {
+	tun, _ := NewTunnelFromOpts(Local("3000"), Remote("0"), Reverse())
+	tun.setBound("127.0.0.1:20001")
+
+	cfg := &Config{Clients: []*Client{
+		{Address: "*"},
+		{Address: "example.com:8022", Tunnels: []*Tunnel{tun}},
+	}}
+
+	rec := httptest.NewRecorder()
+	cfg.StatusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected OK but got %d", rec.Code)
+	}
+
+	sts := []ClientStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &sts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sts) != 1 || sts[0].Address != "example.com:8022" || sts[0].Connected {
+		t.Fatalf("expected only the disconnected client but got %+v", sts)
+	}
+
+	if len(sts[0].Tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel but got %d", len(sts[0].Tunnels))
+	}
+
+	st := sts[0].Tunnels[0]
+	if st.Local != "localhost:3000" || st.Remote != "127.0.0.1:20001" || st.Direction != "reverse" || st.Open {
+		t.Errorf("unexpected tunnel status %+v", st)
+	}
+
+	rec = httptest.NewRecorder()
+	cfg.StatusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a POST not to be allowed but got %d", rec.Code)
+	}
+}
@@ -2,8 +2,6 @@ package tunnel
 
 import (
 	"context"
-	"io"
-	"log"
 	"net"
 )
 
@@ -24,32 +22,75 @@ func ReverseStrategy(local, remote string) Strategy {
 		if err != nil {
 			return err
 		}
-		defer l.Close()
 
+		// the listener stops when the SSH connection drops, so the tunnel is
+		// closed and opened again once it has reconnected
+		done := make(chan struct{})
+		defer close(done)
 		go func() {
-			for {
-				upstream, err := l.Accept()
-				if err != nil {
-					break
+			select {
+			case <-ctx.Done():
+			case <-done:
+			}
+			l.Close()
+		}()
+
+		conns := connTrackerOf(ctx)
+		for {
+			upstream, err := l.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+
+			if !permitted(ctx, upstream, upstream.RemoteAddr(), remote) {
+				continue
+			}
+			throttleAccepts(ctx)
+
+			go func() {
+				release, ok := admit(ctx, upstream, upstream.RemoteAddr(), remote)
+				if !ok {
+					return
 				}
+				defer release()
+				conns.accepted()
 
-				downstream, err := net.Dial("tcp", local)
+				downstream, err := dialWithRetry(ctx, func() (net.Conn, error) { return net.Dial("tcp", local) })
 				if err != nil {
-					continue
+					failDial(ctx, upstream, nil, local, err)
+					return
 				}
 
-				go Bridge(ctx, upstream, downstream)
-			}
-		}()
+				if err := sendProxyHeader(ctx, downstream, upstream.RemoteAddr(), upstream.LocalAddr()); err != nil {
+					failDial(ctx, upstream, downstream, local, err)
+					return
+				}
 
-		<-ctx.Done()
-		return nil
+				bridge(ctx, upstream, downstream, upstream.RemoteAddr().String(), local)
+			}()
+		}
 	})
 }
 
-// LocalStrategy is a strategy for setting up a port
-// forward from a local port to a remote port
-func LocalStrategy(local, remote string) Strategy {
+// RemoteDialer will dial the remote end of a local tunnel through the SSH
+// connection, returning the address that was dialed and a func to call once
+// the connection is finished with
+type RemoteDialer func(SSHConn) (net.Conn, string, func(), error)
+
+// DialRemote will return a RemoteDialer for a single remote address
+func DialRemote(remote string) RemoteDialer {
+	return func(conn SSHConn) (net.Conn, string, func(), error) {
+		c, err := conn.Dial("tcp", remote)
+		return c, remote, func() {}, err
+	}
+}
+
+// LocalStrategy is a strategy for setting up a port forward from a local port
+// to the remote end that is dialed with the given RemoteDialer
+func LocalStrategy(local string, dial RemoteDialer) Strategy {
 	return Strategy(func(ctx context.Context, conn SSHConn) error {
 		l, err := net.Listen("tcp", local)
 		if err != nil {
@@ -57,6 +98,7 @@ func LocalStrategy(local, remote string) Strategy {
 		}
 		defer l.Close()
 
+		conns := connTrackerOf(ctx)
 		go func() {
 			for {
 				downstream, err := l.Accept()
@@ -64,12 +106,38 @@ func LocalStrategy(local, remote string) Strategy {
 					break
 				}
 
-				upstream, err := conn.Dial("tcp", remote)
-				if err != nil {
+				if !permitted(ctx, downstream, downstream.RemoteAddr(), local) {
 					continue
 				}
-
-				go Bridge(ctx, upstream, downstream)
+				throttleAccepts(ctx)
+
+				go func() {
+					release, ok := admit(ctx, downstream, downstream.RemoteAddr(), local)
+					if !ok {
+						return
+					}
+					defer release()
+					conns.accepted()
+
+					var remote string
+					var done func()
+					upstream, err := dialWithRetry(ctx, func() (c net.Conn, err error) {
+						c, remote, done, err = dial(conn)
+						return c, err
+					})
+					if err != nil {
+						failDial(ctx, downstream, nil, remote, err)
+						return
+					}
+					defer done()
+
+					if err := sendProxyHeader(ctx, upstream, downstream.RemoteAddr(), downstream.LocalAddr()); err != nil {
+						failDial(ctx, downstream, upstream, remote, err)
+						return
+					}
+
+					bridge(ctx, upstream, downstream, downstream.RemoteAddr().String(), remote)
+				}()
 			}
 		}()
 
@@ -77,42 +145,3 @@ func LocalStrategy(local, remote string) Strategy {
 		return nil
 	})
 }
-
-// Bridge will mirror two active network connections using the given
-// context to allow stopping the mirror
-func Bridge(ctx context.Context, upstream, downstream net.Conn) {
-	upDone := make(chan struct{})
-	downDone := make(chan struct{})
-
-	// Copy localConn.Reader to sshConn.Writer
-	go func() {
-		_, err := io.Copy(upstream, downstream)
-		if err != nil {
-			log.Printf("io.Copy failed: %v", err)
-		}
-		close(upDone)
-	}()
-
-	// Copy sshConn.Reader to localConn.Writer
-	go func() {
-		_, err := io.Copy(downstream, upstream)
-		if err != nil {
-			log.Printf("io.Copy failed: %v", err)
-		}
-		close(downDone)
-	}()
-
-	defer downstream.Close()
-	defer upstream.Close()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-downDone:
-			return
-		case <-upDone:
-			return
-		}
-	}
-}
@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// contextKeyTimeouts holds the timeouts for the connections of the tunnel
+var contextKeyTimeouts = contextKey("timeouts")
+
+// connTimeouts close connections that have had no bytes go either way for
+// the idle timeout, or that have been open for longer than the max lifetime
+type connTimeouts struct {
+	idle     time.Duration
+	lifetime time.Duration
+}
+
+// parseConnTimeouts will parse the timeouts, returning nil if there aren't any
+func parseConnTimeouts(idle, lifetime string) (*connTimeouts, error) {
+	if idle == "" && lifetime == "" {
+		return nil, nil
+	}
+
+	ct := &connTimeouts{}
+	for _, d := range []struct {
+		name string
+		s    string
+		dur  *time.Duration
+	}{{"idle_timeout", idle, &ct.idle}, {"max_lifetime", lifetime, &ct.lifetime}} {
+		if d.s == "" {
+			continue
+		}
+
+		var err error
+		if *d.dur, err = time.ParseDuration(d.s); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+		if *d.dur <= 0 {
+			return nil, fmt.Errorf("invalid %s: must be more than 0", d.name)
+		}
+	}
+
+	return ct, nil
+}
+
+func withConnTimeouts(ctx context.Context, ct *connTimeouts) context.Context {
+	if ct == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyTimeouts, ct)
+}
+
+// activeConn keeps the time that bytes last went through the connection
+type activeConn struct {
+	net.Conn
+	last int64
+}
+
+func (c *activeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activeConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite will half close the connection if it can be
+func (c *activeConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// idleFor will return how long it has been since bytes went through the connection
+func (c *activeConn) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+}
+
+// enforceTimeouts will close the bridged connections once they hit the timeouts
+// of the tunnel in the context, if there are any.  It returns the local side
+// wrapped so that its activity is seen, and a func to call when they are done
+func enforceTimeouts(ctx context.Context, upstream, downstream net.Conn, source, dest string) (net.Conn, func()) {
+	ct, ok := ctx.Value(contextKeyTimeouts).(*connTimeouts)
+	if !ok {
+		return downstream, func() {}
+	}
+
+	ac := &activeConn{Conn: downstream, last: time.Now().UnixNano()}
+	done := make(chan struct{})
+
+	go func() {
+		var idle, lifetime <-chan time.Time
+		var idleTimer *time.Timer
+		if ct.idle > 0 {
+			idleTimer = time.NewTimer(ct.idle)
+			defer idleTimer.Stop()
+			idle = idleTimer.C
+		}
+		if ct.lifetime > 0 {
+			t := time.NewTimer(ct.lifetime)
+			defer t.Stop()
+			lifetime = t.C
+		}
+
+		var reason error
+		for reason == nil {
+			select {
+			case <-done:
+				return
+			case <-idle:
+				if d := ac.idleFor(); d < ct.idle {
+					idleTimer.Reset(ct.idle - d)
+					continue
+				}
+				reason = fmt.Errorf("it was idle for %s", ct.idle)
+				connTrackerOf(ctx).closedIdle()
+			case <-lifetime:
+				reason = fmt.Errorf("it reached the max lifetime of %s", ct.lifetime)
+				connTrackerOf(ctx).closedLifetime()
+			}
+		}
+
+		log.Printf("closed connection from %s to %s as %s", source, dest, reason)
+		upstream.Close()
+		downstream.Close()
+	}()
+
+	return ac, func() { close(done) }
+}
@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnTimeouts(t *testing.T) {
+	if _, err := parseConnTimeouts("0s", ""); err == nil {
+		t.Error("expected an idle timeout of 0 to fail")
+	}
+
+	ct, err := parseConnTimeouts("100ms", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newConnTracker()
+	ctx := withConnTimeouts(withConnTracker(context.Background(), tr), ct)
+
+	up, upPeer := net.Pipe()
+	down, downPeer := net.Pipe()
+	defer upPeer.Close()
+	defer downPeer.Close()
+
+	conn, stop := enforceTimeouts(ctx, up, down, "source", "dest")
+	defer stop()
+
+	// keep it busy for longer than the idle timeout
+	go io.Copy(ioutil.Discard, downPeer)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("expected the busy connection to stay open but got %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := conn.Write([]byte("ping")); err == nil {
+		t.Error("expected the idle connection to be closed")
+	}
+
+	if st := tr.Stats(); st.ClosedIdle != 1 || st.ClosedLifetime != 0 {
+		t.Errorf("expected the idle close to be counted but got %+v", st)
+	}
+
+	ct, err = parseConnTimeouts("", "100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = withConnTimeouts(withConnTracker(context.Background(), tr), ct)
+
+	up, upPeer = net.Pipe()
+	down, downPeer = net.Pipe()
+	defer upPeer.Close()
+	defer downPeer.Close()
+
+	_, stop = enforceTimeouts(ctx, up, down, "source", "dest")
+	defer stop()
+
+	if _, err := upPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed at its max lifetime but got %v", err)
+	}
+
+	if st := tr.Stats(); st.ClosedLifetime != 1 {
+		t.Errorf("expected the lifetime close to be counted but got %+v", st)
+	}
+}
@@ -9,9 +9,11 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AlexanderGrom/go-event"
+	"github.com/penguinpowernz/mole/pkg/proxyproto"
 )
 
 // Dialer is a function that will dial a remote SSH server
@@ -29,11 +31,71 @@ type Tunnel struct {
 	ReverseDef string `json:"R"`
 	LocalDef   string `json:"L"`
 
+	// StateFile is written with the bound remote address when the tunnel opens
+	// and OnBound is a command that is run with it in the environment
+	StateFile string `json:"state_file,omitempty"`
+	OnBound   string `json:"on_bound,omitempty"`
+
+	// Targets are remote addresses that a local tunnel spreads its connections
+	// across instead of the Remote, using the Balance policy
+	Targets []*Target `json:"targets,omitempty"`
+	Balance string    `json:"balance,omitempty"`
+
+	Health *HealthCheck `json:"health,omitempty"`
+
+	// ProxyProtocol is the version of the PROXY protocol header to send to
+	// the service with the address of the peer that connected to the tunnel
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+
+	// Allow and Deny are the IPs or CIDRs that can connect to the tunnel, which
+	// are taken from the client if neither are set
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// Bandwidth limits the rate of the tunnel and can close it once it has
+	// used up a quota, the rates of the client are also applied on top of it
+	Bandwidth *Bandwidth `json:"bandwidth,omitempty"`
+
+	// MaxConnections limits how many connections can go through the tunnel at
+	// once, with up to QueueSize more waiting for one to finish until the
+	// QueueTimeout.  AcceptRate limits how many are accepted each second
+	MaxConnections int     `json:"max_connections,omitempty"`
+	QueueSize      int     `json:"queue_size,omitempty"`
+	QueueTimeout   string  `json:"queue_timeout,omitempty"`
+	AcceptRate     float64 `json:"accept_rate,omitempty"`
+
+	// IdleTimeout closes connections that have had nothing go through them
+	// for that long, and MaxLifetime closes them after being open that long
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	MaxLifetime string `json:"max_lifetime,omitempty"`
+
+	// DialRetry is how long to keep retrying when the other end of a
+	// connection can't be dialed, before the connection is rejected
+	DialRetry string `json:"dial_retry,omitempty"`
+
 	IsOpen bool `json:"-"`
 
-	mu       *sync.Mutex
-	strategy Strategy
-	doneChan chan bool
+	mu        *sync.Mutex
+	strategy  Strategy
+	doneChan  chan bool
+	bound     atomic.Value
+	events    event.Dispatcher
+	conns     *connTracker
+	stop      context.CancelFunc
+	balancer  *balancer
+	health    *healthChecker
+	acl       *accessList
+	clientACL *accessList
+	bandwidth *bandwidth
+	clientBW  *bandwidth
+	quota     *quota
+	limits    *connLimiter
+	clientLim *connLimiter
+	timeouts  *connTimeouts
+	dialRetry time.Duration
+
+	dialFailures int
+	dialLoggedAt time.Time
 }
 
 type Tunnels []*Tunnel
@@ -41,7 +103,7 @@ type Tunnels []*Tunnel
 func (tuns Tunnels) Open() []*Tunnel {
 	tunss := []*Tunnel{}
 	for _, t := range tuns {
-		if t.IsOpen {
+		if t.Opened() {
 			tunss = append(tunss, t)
 		}
 	}
@@ -50,7 +112,7 @@ func (tuns Tunnels) Open() []*Tunnel {
 
 // NewTunnelFromOpts will create a new tunnel from the given options
 func NewTunnelFromOpts(opts ...Option) (*Tunnel, error) {
-	t := &Tunnel{}
+	t := &Tunnel{conns: newConnTracker(), mu: new(sync.Mutex)}
 	for _, opt := range opts {
 		if err := opt(t); err != nil {
 			return t, err
@@ -58,9 +120,8 @@ func NewTunnelFromOpts(opts ...Option) (*Tunnel, error) {
 	}
 
 	if t.strategy == nil {
-		t.strategy = LocalStrategy(t.Local, t.Remote)
-		if t.Reverse {
-			t.strategy = ReverseStrategy(t.Local, t.Remote)
+		if err := t.setupStrategy(); err != nil {
+			return t, err
 		}
 	}
 
@@ -70,15 +131,17 @@ func NewTunnelFromOpts(opts ...Option) (*Tunnel, error) {
 // UnmarshalJSON will unmarshal the individual tunnel config and
 // setup the relevant config derived fields so that it is ready to use
 func (tun *Tunnel) UnmarshalJSON(data []byte) error {
-	if err := json.Unmarshal(data, tun); err != nil {
+	type tunnel Tunnel
+	if err := json.Unmarshal(data, (*tunnel)(tun)); err != nil {
 		return err
 	}
+	tun.conns = newConnTracker()
+	tun.mu = new(sync.Mutex)
 
 	if tun.LocalDef != "" {
 		if err := PFD(tun.LocalDef)(tun); err != nil {
 			return err
 		}
-		return nil
 	}
 
 	if tun.ReverseDef != "" {
@@ -86,14 +149,75 @@ func (tun *Tunnel) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		tun.Reverse = true
-		return nil
 	}
 
 	if tun.strategy == nil {
-		tun.strategy = LocalStrategy(tun.Local, tun.Remote)
-		if tun.Reverse {
-			tun.strategy = ReverseStrategy(tun.Local, tun.Remote)
+		return tun.setupStrategy()
+	}
+
+	return nil
+}
+
+// setupStrategy will pick the strategy for the tunnel from its config
+func (tun *Tunnel) setupStrategy() error {
+	tun.normalizePorts()
+
+	acl, err := newAccessList(tun.Allow, tun.Deny)
+	if err != nil {
+		return err
+	}
+	tun.acl = acl
+
+	bw, q, err := newBandwidth(tun.Bandwidth)
+	if err != nil {
+		return err
+	}
+	tun.bandwidth, tun.quota = bw, q
+
+	lim, err := newConnLimiter(tun.MaxConnections, tun.QueueSize, tun.QueueTimeout, tun.AcceptRate)
+	if err != nil {
+		return err
+	}
+	tun.limits = lim
+
+	ct, err := parseConnTimeouts(tun.IdleTimeout, tun.MaxLifetime)
+	if err != nil {
+		return err
+	}
+	tun.timeouts = ct
+
+	if tun.dialRetry, err = parseDialRetry(tun.DialRetry); err != nil {
+		return err
+	}
+
+	if tun.ProxyProtocol != "" {
+		if err := proxyproto.Validate(tun.ProxyProtocol); err != nil {
+			return err
+		}
+	}
+
+	if tun.Health != nil {
+		h, err := newHealthChecker(tun.Health)
+		if err != nil {
+			return err
+		}
+		tun.health = h
+	}
+
+	switch {
+	case tun.Reverse && len(tun.Targets) > 0:
+		return errors.New("targets can only be used with local tunnels")
+	case tun.Reverse:
+		tun.strategy = ReverseStrategy(tun.Local, tun.Remote)
+	case len(tun.Targets) > 0:
+		b, err := newBalancer(tun.Balance, tun.Targets)
+		if err != nil {
+			return err
 		}
+		tun.balancer = b
+		tun.strategy = LocalStrategy(tun.Local, b.dialer())
+	default:
+		tun.strategy = LocalStrategy(tun.Local, DialRemote(tun.Remote))
 	}
 
 	return nil
@@ -101,27 +225,130 @@ func (tun *Tunnel) UnmarshalJSON(data []byte) error {
 
 // KeepOpen will open the tunnel and keep it open if it closes
 func (tun *Tunnel) KeepOpen(ctx context.Context, cl SSHConn, ev event.Dispatcher) {
+	if tun.mu == nil {
+		tun.mu = new(sync.Mutex)
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	tun.mu.Lock()
+	tun.events = ev
+	tun.stop = stop
+	tun.mu.Unlock()
+
+	// on demand clients aren't connected to check the health until the
+	// tunnel is used, so they are always opened
+	_, onDemand := cl.(onDemandConn)
+	gated := tun.health != nil && tun.Health.Gate && !onDemand
+	if tun.health != nil {
+		go tun.runHealthCheck(ctx, cl)
+	}
+
 	for {
-		if err := tun.Open(ctx, cl); err != nil {
+		if tun.quota.exceeded() {
+			until := tun.quota.resetAt()
+			ev.Go("log", fmt.Sprintf("the quota for %s is used up until %s", tun.Name(), until.Format(time.RFC3339)))
+			select {
+			case <-time.After(time.Until(until)):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if gated && !tun.health.isHealthy() {
+			ev.Go("log", fmt.Sprintf("waiting for %s to be healthy before opening it", tun.Name()))
+			if !tun.health.waitHealthy(ctx) {
+				return
+			}
+		}
+
+		openCtx, closeOpen := context.WithCancel(ctx)
+		if err := tun.Open(openCtx, cl); err != nil {
+			closeOpen()
 			ev.Go("log", fmt.Sprintf("ERROR: failed to open tunnel for %s: %s", tun.Name(), err))
-			time.Sleep(time.Second)
-			continue
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
 		}
 
 		ev.Go("log", fmt.Sprintf("tunnel opened: %s", tun.Name()))
 
+		var unhealthy <-chan struct{}
+		if gated {
+			unhealthy = tun.health.waitUnhealthy(openCtx)
+		}
+
 		select {
+		case <-tun.quota.hitChan():
+			closeOpen()
+			<-tun.doneChan
+			ev.Go("log", fmt.Sprintf("tunnel closed as its quota is used up: %s", tun.Name()))
+			ev.Go("tunnel.quota_exceeded", tun)
+			continue
+		case <-unhealthy:
+			closeOpen()
+			<-tun.doneChan
+			ev.Go("log", fmt.Sprintf("tunnel closed while unhealthy: %s", tun.Name()))
+			continue
 		case <-tun.doneChan:
+			closeOpen()
 			ev.Go("log", fmt.Sprintf("tunnel closed: %s", tun.Name()))
+			if ctx.Err() != nil {
+				return
+			}
 			time.Sleep(time.Second)
 			continue
 		case <-ctx.Done():
+			closeOpen()
 			ev.Go("log", fmt.Sprintf("tunnel done: %s", tun.Name()))
 			return
 		}
 	}
 }
 
+// Opened will return true if the tunnel is open
+func (tun *Tunnel) Opened() bool {
+	if tun.mu == nil {
+		return tun.IsOpen
+	}
+
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	return tun.IsOpen
+}
+
+// dispatcher will return the events dispatcher the tunnel was opened with
+func (tun *Tunnel) dispatcher() event.Dispatcher {
+	if tun.mu == nil {
+		return nil
+	}
+
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	return tun.events
+}
+
+// Close will stop keeping the tunnel open and close its listener, the
+// connections already going through it are left to finish
+func (tun *Tunnel) Close() {
+	if tun.mu == nil {
+		return
+	}
+
+	tun.mu.Lock()
+	stop := tun.stop
+	tun.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
 // Open will "open" the tunnel, by listening for new connections coming into
 // the local port, and then hooking them up to the remote port on the fly
 func (tun *Tunnel) Open(ctx context.Context, cl SSHConn) (err error) {
@@ -140,11 +367,24 @@ func (tun *Tunnel) Open(ctx context.Context, cl SSHConn) (err error) {
 		return nil
 	}
 
-	tun.normalizePorts()
+	if tun.conns == nil {
+		tun.conns = newConnTracker()
+	}
+	ctx = withConnTracker(ctx, tun.conns)
+	ctx = withProxyProtocol(ctx, tun.ProxyProtocol)
+	if tun.acl != nil {
+		ctx = withAccessList(ctx, tun.acl)
+	} else {
+		ctx = withAccessList(ctx, tun.clientACL)
+	}
+	ctx = withBandwidth(ctx, tun.bandwidth, tun.clientBW, tun.quota)
+	ctx = withConnLimits(ctx, tun.limits, tun.clientLim)
+	ctx = withConnTimeouts(ctx, tun.timeouts)
+	ctx = withDialPolicy(ctx, tun.dialRetry, tun.dialFailed)
 
 	tun.doneChan = make(chan bool)
 	go func() {
-		if err := tun.strategy(ctx, cl); err != nil && ctx.Err() == nil {
+		if err := tun.strategy(ctx, boundConn{cl, tun}); err != nil && ctx.Err() == nil {
 			log.Printf("ERROR: %s stopped: %s", tun, err) // only print the error if the ctx wasn't quit
 		}
 		close(tun.doneChan)
@@ -154,13 +394,19 @@ func (tun *Tunnel) Open(ctx context.Context, cl SSHConn) (err error) {
 
 	go func() {
 		<-tun.doneChan
+		tun.mu.Lock()
 		tun.IsOpen = false
+		tun.mu.Unlock()
 	}()
 
 	return nil
 }
 
 func normalizePort(p string) string {
+	if p == "" {
+		return p
+	}
+
 	h := "localhost"
 	if p[0] == ':' || (p[0] != ':' && !strings.Contains(p, ":")) {
 		if p[0] != ':' {
@@ -186,5 +432,28 @@ func (tun *Tunnel) String() string {
 	if tun.Reverse {
 		dir = "<--"
 	}
-	return fmt.Sprintf("%50s [    %30s  %s  %-30s     ]", tun.addr, tun.Local, dir, tun.Remote)
+	remote := tun.remote()
+	return fmt.Sprintf("%50s [    %30s  %s  %-30s     ]", tun.addr, tun.Local, dir, remote)
+}
+
+// remote will return the remote address of the tunnel, which is the address
+// that was bound for a reverse tunnel, or the targets of a balanced one
+func (tun *Tunnel) remote() string {
+	if addr := tun.BoundAddr(); addr != "" {
+		return addr
+	}
+	return tun.configuredRemote()
+}
+
+// configuredRemote will return the remote address or targets from the config
+func (tun *Tunnel) configuredRemote() string {
+	if len(tun.Targets) == 0 {
+		return tun.Remote
+	}
+
+	remotes := []string{}
+	for _, t := range tun.Targets {
+		remotes = append(remotes, t.Remote)
+	}
+	return strings.Join(remotes, ",")
 }